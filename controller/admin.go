@@ -0,0 +1,163 @@
+package controller
+
+import (
+	"crypto/subtle"
+	"github.com/gin-gonic/gin"
+	"idGenerator/model"
+	"idGenerator/model/jsonApi"
+	"strconv"
+)
+
+//管理接口的token 校验, 需要请求头 X-Admin-Token, 没有配置 adminToken 时拒绝所有请求
+func AdminAuth() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		adminToken := model.GetApplication().ConfigData.AdminToken
+
+		if adminToken == "" {
+			jsonApi.Fail(context, "没有配置 adminToken, 管理接口不可用", 300000, 403)
+			context.Abort()
+			return
+		}
+
+		if !validAdminToken(context) {
+			jsonApi.Fail(context, "无权限", 300000, 403)
+			context.Abort()
+			return
+		}
+
+		context.Next()
+	}
+}
+
+//请求头 X-Admin-Token 和配置的 adminToken 一致, 没有配置时总是false
+func validAdminToken(context *gin.Context) bool {
+	adminToken := model.GetApplication().ConfigData.AdminToken
+
+	return adminToken != "" && subtle.ConstantTimeCompare([]byte(context.GetHeader("X-Admin-Token")), []byte(adminToken)) == 1
+}
+
+//source 配置列表
+func AdminSourceListAction(context *gin.Context) {
+	sourceConfigs, err := model.GetSourceRegistry().ListSourceConfigs()
+	if err != nil {
+		jsonApi.Fail(context, "获取source 列表异常:"+err.Error(), 300001)
+		return
+	}
+
+	jsonApi.Success(context, gin.H{"count": len(sourceConfigs), "list": sourceConfigs})
+}
+
+//单个source 配置
+func AdminSourceGetAction(context *gin.Context) {
+	source, err := getNamespacedSource(context, context.Params.ByName("source"))
+	if err != nil {
+		jsonApi.Fail(context, err.Error(), 300006)
+		return
+	}
+
+	sourceConfig, err := model.GetSourceRegistry().GetSourceConfig(source)
+	if err != nil {
+		jsonApi.Fail(context, "获取source 配置异常:"+err.Error(), 300001)
+		return
+	}
+
+	if sourceConfig == nil {
+		jsonApi.Fail(context, "source 不存在", 300002, 404)
+		return
+	}
+
+	jsonApi.Success(context, gin.H{"source": sourceConfig})
+}
+
+//新增或更新source 配置, 数字参数不传时为0
+func AdminSourceSaveAction(context *gin.Context) {
+	namespace, err := getNamespace(context)
+	if err != nil {
+		jsonApi.Fail(context, err.Error(), 300006)
+		return
+	}
+
+	source := getParam(context, "source", "")
+	if source != "" {
+		if err := model.ValidateSource(source); err != nil {
+			jsonApi.Fail(context, err.Error(), 300006)
+			return
+		}
+
+		source = model.NamespacedSource(namespace, source)
+	}
+
+	sourceConfig := &model.SourceConfig{
+		Source:        source,
+		GeneratorType: getParam(context, "generatorType", ""),
+		Description:   getParam(context, "description", ""),
+		Owner:         getParam(context, "owner", ""),
+	}
+
+	intParams := map[string]*int{
+		"startId":    &sourceConfig.StartId,
+		"bucketStep": &sourceConfig.BucketStep,
+		"maxId":      &sourceConfig.MaxId,
+	}
+
+	for key, value := range intParams {
+		intValue, err := strconv.Atoi(getParam(context, key, "0"))
+		if err != nil {
+			jsonApi.Fail(context, key+"参数错误", 300003)
+			return
+		}
+
+		*value = intValue
+	}
+
+	if err := model.GetSourceRegistry().SaveSourceConfig(sourceConfig); err != nil {
+		jsonApi.Fail(context, "保存source 配置异常:"+err.Error(), 300004)
+		return
+	}
+
+	jsonApi.Success(context, gin.H{"source": sourceConfig})
+}
+
+//删除source 配置, 不会删除已持久化的当前id
+func AdminSourceDeleteAction(context *gin.Context) {
+	source, err := getNamespacedSource(context, context.Params.ByName("source"))
+	if err != nil {
+		jsonApi.Fail(context, err.Error(), 300006)
+		return
+	}
+
+	if err := model.GetSourceRegistry().DeleteSourceConfig(source); err != nil {
+		jsonApi.Fail(context, "删除source 配置异常:"+err.Error(), 300005)
+		return
+	}
+
+	jsonApi.Success(context, gin.H{"source": source})
+}
+
+//slave 提升为master, master 宕机后手动切换
+func AdminPromoteAction(context *gin.Context) {
+	//提升会停止主从同步并写入数据文件, 不依赖路由上的校验, 必须配置了token
+	if !validAdminToken(context) {
+		jsonApi.Fail(context, "提升为master 需要配置 adminToken 并带上请求头 X-Admin-Token", 300000, 403)
+		return
+	}
+
+	result, err := model.GetApplication().PromoteToMaster("管理接口手动提升")
+	if err != nil {
+		jsonApi.Fail(context, "提升为master 失败:"+err.Error(), 300007)
+		return
+	}
+
+	jsonApi.Success(context, gin.H{"promote": result})
+}
+
+//master 上各个slave 的同步进度 和 落后情况
+func AdminSlaveListAction(context *gin.Context) {
+	status, err := model.GetApplication().ReplicationStatus()
+	if err != nil {
+		jsonApi.Fail(context, "获取slave 同步状态异常:"+err.Error(), 300008)
+		return
+	}
+
+	jsonApi.Success(context, gin.H{"count": len(status.Slaves), "replication": status})
+}
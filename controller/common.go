@@ -9,12 +9,22 @@ import (
 	//"idGenerator/model/logger"
 	"idGenerator/model/jsonApi"
 	"strconv"
+	"strings"
 	//"fmt"
 )
 
+//snow flake id 解析的路由 /snowflake/parse
+const SNOWFLAKE_PARSE_PATH = "parse"
+
 //使用自增方法
 func AutoIncrementAction(context *gin.Context) {
 
+	//带了count 参数的走批量获取
+	if _, ok := context.GetQuery("count"); ok {
+		AutoIncrementBatchAction(context)
+		return
+	}
+
 	source := context.DefaultQuery("source", "")
 
 	if source == "" {
@@ -22,22 +32,93 @@ func AutoIncrementAction(context *gin.Context) {
 		return
 	}
 
+	namespace, err := getNamespace(context)
+	if err != nil {
+		jsonApi.Fail(context, err.Error(), 200004)
+		return
+	}
+
 	var nextId int
-	var err error
 
-	nextId, err = model.GetAutoIncrIdWorker().NextId(source)
+	nextId, err = model.GetAutoIncrIdWorker().NextId(namespace, source)
 
 	if err != nil {
 		jsonApi.Fail(context, "获取id异常:"+err.Error(), 200002)
 		return
 	}
 
-	jsonApi.Success(context, gin.H{"souce": source, "id": nextId})
+	jsonApi.Success(context, gin.H{"souce": source, "namespace": namespace, "id": nextId})
+}
+
+//批量获取自增id, GET 和 POST 都支持
+func AutoIncrementBatchAction(context *gin.Context) {
+
+	source := getParam(context, "source", "")
+
+	if source == "" {
+		jsonApi.Fail(context, "参数错误", 200001)
+		return
+	}
+
+	namespace, err := getNamespace(context)
+	if err != nil {
+		jsonApi.Fail(context, err.Error(), 200004)
+		return
+	}
+
+	count, err := strconv.Atoi(getParam(context, "count", "1"))
+	if err != nil || count < 1 || count > model.MAX_BATCH_COUNT {
+		jsonApi.Fail(context, "count参数错误, 范围 1-"+strconv.Itoa(model.MAX_BATCH_COUNT), 200003)
+		return
+	}
+
+	idRanges, err := model.GetAutoIncrIdWorker().NextIds(namespace, source, count)
+
+	if err != nil {
+		jsonApi.Fail(context, "获取id异常:"+err.Error(), 200002)
+		return
+	}
+
+	result := gin.H{
+		"souce":      source,
+		"namespace":  namespace,
+		"count":      count,
+		"contiguous": len(idRanges) == 1,
+		"firstId":    idRanges[0].FirstId,
+		"lastId":     idRanges[len(idRanges)-1].LastId,
+	}
+
+	//不连续时 返回完整的id 列表
+	if len(idRanges) > 1 {
+		ids := make([]int, 0, count)
+		for _, idRange := range idRanges {
+			for id := idRange.FirstId; id <= idRange.LastId; id++ {
+				ids = append(ids, id)
+			}
+		}
+
+		result["ids"] = ids
+	}
+
+	jsonApi.Success(context, result)
 }
 
 //使用snow flake 算法
 func SnowFlakeAction(context *gin.Context) {
 	workerSource := context.Params.ByName("id")
+
+	//和 /snowflake/:id 共用路由
+	if workerSource == SNOWFLAKE_PARSE_PATH {
+		SnowFlakeParseBatchAction(context)
+		return
+	}
+
+	//开启租约后 不允许调用方指定worker id, 避免冲突
+	if model.GetApplication().ConfigData.SnowFlake.LeaseWorkerId {
+		jsonApi.Fail(context, "已开启 worker id 租约, 请使用 /snowflake", 100008)
+		return
+	}
+
 	workerid, err := strconv.Atoi(workerSource)
 
 	if err != nil {
@@ -45,30 +126,180 @@ func SnowFlakeAction(context *gin.Context) {
 		return
 	}
 
+	var workerInstance *model.SnowFlakeIdWorker
+
 	idWorkerMap := model.GetApplication().GetIdWorkerMap()
 	currentWorker, hasOld := idWorkerMap.Get(workerSource)
 
 	if hasOld {
-		//获取下一个递增id
-		workerInstance, typeOk := currentWorker.(*model.SnowFlakeIdWorker)
+		var typeOk bool
+		workerInstance, typeOk = currentWorker.(*model.SnowFlakeIdWorker)
 		if !typeOk {
 			jsonApi.Fail(context, "workerInstance类型错误", 100002)
 			return
 		}
 
-		nid, _ := workerInstance.NextId()
-		jsonApi.Success(context, gin.H{"id": nid})
+	} else {
+		//获取新的
+		workerInstance, err = model.NewSnowFlakeIdWorker(int64(workerid))
+		if err != nil {
+			jsonApi.Fail(context, err.Error(), 100001)
+			return
+		}
+
+		idWorkerMap.Set(workerSource, workerInstance)
+	}
+
+	snowFlakeNextId(context, workerInstance)
+}
+
+//使用租约的 worker id 生成 snow flake id
+func SnowFlakeLeaseAction(context *gin.Context) {
+	workerInstance := model.GetApplication().LeasedSnowFlakeWorker
+	if workerInstance == nil {
+		jsonApi.Fail(context, "未开启 worker id 租约", 100007)
 		return
 	}
 
-	//获取新的
-	workerInstance, err := model.NewSnowFlakeIdWorker(int64(workerid))
+	snowFlakeNextId(context, workerInstance)
+}
+
+//生成id 并输出, 带count参数时批量获取
+func snowFlakeNextId(context *gin.Context, workerInstance *model.SnowFlakeIdWorker) {
+	//带了source 参数时 校验source 是否允许使用snow flake
+	if source, ok := context.GetQuery("source"); ok {
+		namespacedSource, err := getNamespacedSource(context, source)
+		if err != nil {
+			jsonApi.Fail(context, err.Error(), 100009)
+			return
+		}
+
+		if _, err := model.GetSourceRegistry().CheckSource(namespacedSource, model.GENERATOR_TYPE_SNOWFLAKE); err != nil {
+			jsonApi.Fail(context, err.Error(), 100009)
+			return
+		}
+	}
+
+	if countParam, ok := context.GetQuery("count"); ok {
+		count, err := strconv.Atoi(countParam)
+		if err != nil || count < 1 || count > model.MAX_BATCH_COUNT {
+			jsonApi.Fail(context, "count参数错误, 范围 1-"+strconv.Itoa(model.MAX_BATCH_COUNT), 100003)
+			return
+		}
+
+		ids, err := workerInstance.NextIds(count)
+		if err != nil {
+			jsonApi.Fail(context, "获取id异常:"+err.Error(), 100004)
+			return
+		}
+
+		jsonApi.Success(context, gin.H{"count": count, "ids": ids})
+		return
+	}
+
+	//获取下一个递增id
+	nid, err := workerInstance.NextId()
 	if err != nil {
-		jsonApi.Fail(context, err.Error(), 100001)
+		jsonApi.Fail(context, "获取id异常:"+err.Error(), 100004)
 		return
 	}
 
-	nid, _ := workerInstance.NextId()
-	idWorkerMap.Set(workerSource, workerInstance)
 	jsonApi.Success(context, gin.H{"id": nid})
 }
+
+//解析snow flake id, 路由为 /snowflake/parse/:value
+func SnowFlakeParseAction(context *gin.Context) {
+	if context.Params.ByName("id") != SNOWFLAKE_PARSE_PATH {
+		jsonApi.Fail(context, "路由不存在", 100006, 404)
+		return
+	}
+
+	id, err := strconv.ParseInt(context.Params.ByName("value"), 10, 64)
+	if err != nil || id < 0 {
+		jsonApi.Fail(context, "id参数错误", 100006)
+		return
+	}
+
+	jsonApi.Success(context, snowFlakeIdInfoToH(model.GetApplication().GetSnowFlakeLayout().Parse(id)))
+}
+
+//批量解析snow flake id, 路由为 /snowflake/parse?ids=xxx,yyy, 多个id用逗号分隔
+func SnowFlakeParseBatchAction(context *gin.Context) {
+	idsParam := getParam(context, "ids", "")
+	if idsParam == "" {
+		jsonApi.Fail(context, "ids参数错误", 100006)
+		return
+	}
+
+	values := strings.Split(idsParam, ",")
+	if len(values) > model.MAX_BATCH_COUNT {
+		jsonApi.Fail(context, "ids数量超过 "+strconv.Itoa(model.MAX_BATCH_COUNT), 100006)
+		return
+	}
+
+	layout := model.GetApplication().GetSnowFlakeLayout()
+	result := make([]gin.H, 0, len(values))
+
+	for _, value := range values {
+		id, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil || id < 0 {
+			jsonApi.Fail(context, "id参数错误: "+value, 100006)
+			return
+		}
+
+		result = append(result, snowFlakeIdInfoToH(layout.Parse(id)))
+	}
+
+	jsonApi.Success(context, gin.H{"count": len(result), "list": result})
+}
+
+//snow flake 时钟回拨的统计
+func SnowFlakeStatsAction(context *gin.Context) {
+	stats := model.GetClockBackwardStats()
+
+	jsonApi.Success(context, gin.H{"clockBackward": stats})
+}
+
+func snowFlakeIdInfoToH(info *model.SnowFlakeIdInfo) gin.H {
+	return gin.H{
+		"id":           info.Id,
+		"timestamp":    info.TimeStamp,
+		"time":         info.Time.Format("2006-01-02 15:04:05.000"),
+		"dataCenterId": info.DataCenterId,
+		"workerId":     info.WorkerId,
+		"sequence":     info.Sequence,
+	}
+}
+
+//获取请求参数, 优先取 POST 表单中的值
+func getParam(context *gin.Context, key string, defaultValue string) string {
+	if value, ok := context.GetPostForm(key); ok {
+		return value
+	}
+
+	return context.DefaultQuery(key, defaultValue)
+}
+
+//请求的namespace, 参数 namespace 优先, 没有时取请求头 X-Id-Namespace, 都没有时为默认namespace
+func getNamespace(context *gin.Context) (string, error) {
+	namespace := getParam(context, model.NAMESPACE_PARAM, "")
+	if namespace == "" {
+		namespace = context.GetHeader(model.NAMESPACE_HEADER)
+	}
+
+	return namespace, model.ValidateNamespace(namespace)
+}
+
+//请求的namespace 下的source, source 中不能有namespace 分隔符
+func getNamespacedSource(context *gin.Context, source string) (string, error) {
+	namespace, err := getNamespace(context)
+	if err != nil {
+		return "", err
+	}
+
+	if err := model.ValidateSource(source); err != nil {
+		return "", err
+	}
+
+	return model.NamespacedSource(namespace, source), nil
+}
@@ -2,7 +2,11 @@ package model
 
 import (
 	"database/sql"
+	"errors"
+	"net"
 	"os"
+	"os/signal"
+	"syscall"
 	"fmt"
 	"time"
 	"idGenerator/model/cmap"
@@ -15,6 +19,7 @@ import (
 const (
 	SERVER_MASTER = "master"
 	SERVER_SLAVE = "slave"
+	SERVER_CLUSTER = "cluster"
 )
 
 type Application struct {
@@ -24,6 +29,11 @@ type Application struct {
 	BasePath string //应用根目录
 	DataBackUpSocketClient *Client
 	RpcSocketClient *Client
+	SnowFlakeLayout *SnowFlakeLayout //snowflake id 的位分布, 启动时确定, 热加载不修改
+	SnowFlakeLease *SnowFlakeWorkerLease //worker id 租约
+	LeasedSnowFlakeWorker *SnowFlakeIdWorker //使用租约worker id 的 snowflake worker
+	RaftNode *RaftNode //cluster 模式的 raft 节点
+	Role string //运行时的角色 master, slave, cluster, 启动和提升为master 时设置, 热加载不修改
 }
 
 var application *Application
@@ -64,6 +74,24 @@ func (application *Application) InitConfig(configFile string) {
 
 	application.ConfigData = config.GetConfigFromFile(configFile)
 
+	//校验 snowflake 的位分布
+	layout, err := NewSnowFlakeLayoutFromConfig(application.ConfigData.SnowFlake)
+	if err != nil {
+		panic(err)
+	}
+
+	if application.ConfigData.SnowFlake.DataCenterId < 0 ||
+		application.ConfigData.SnowFlake.DataCenterId > layout.MaxDataCenterId() {
+		panic("snowflake dataCenterId 超出范围")
+	}
+
+	application.SnowFlakeLayout = layout
+
+	//校验持久化方式
+	if !HasSegmentStore(currentPersistType()) {
+		panic("不支持的持久化方式: " + currentPersistType())
+	}
+
 	//异步 如果配置文件有修改, 动态load 配置文件
 	go func() {
 
@@ -97,7 +125,7 @@ func (application *Application) InitConfig(configFile string) {
 					waitChan<-true
 				}()
 
-				application.ConfigData = config.GetConfigFromFile(configFile)
+				application.reloadConfig(configFile)
 
 			}()
 
@@ -109,11 +137,32 @@ func (application *Application) InitConfig(configFile string) {
 	}()
 }
 
+//重新加载配置文件, 启动时确定的数据文件路径保持不变(slave 使用 .backup 文件)
+func (application *Application) reloadConfig(configFile string) {
+	configData := config.GetConfigFromFile(configFile)
+	configData.Bolt.FilePath = application.ConfigData.Bolt.FilePath
+
+	application.ConfigData = configData
+}
+
+//当前运行的角色, 没有启动服务时(export, import, 测试) 使用配置的 serverType
+func (application *Application) currentRole() string {
+	if application.Role != "" {
+		return application.Role
+	}
+
+	return application.ConfigData.ServerType
+}
+
 //启动数据备份服务
 func (application *Application) StartDataBackUpServer() {
+	application.startDataBackUpServer(application.ConfigData.MasterAddress)
+}
+
+func (application *Application) startDataBackUpServer(address string) {
 
 	go func() {
-		masterServer := NewServer(application.ConfigData.MasterAddress, SERVER_TYPE_DATA_BACKUP)
+		masterServer := NewServer(address, SERVER_TYPE_DATA_BACKUP)
 		masterServer.StartMasterServer()
 	}()
 }
@@ -141,9 +190,13 @@ func (application *Application) StartDataBackUpClient() {
 
 //启动rpc server端
 func (application *Application) StartRpcServer() {
+	application.startRpcServer(application.ConfigData.RpcSeverAddress)
+}
+
+func (application *Application) startRpcServer(address string) {
 
 	go func() {
-		masterServer := NewServer(application.ConfigData.RpcSeverAddress, SERVER_TYPE_RPC)
+		masterServer := NewServer(address, SERVER_TYPE_RPC)
 		masterServer.StartMasterServer()
 	}()
 
@@ -170,6 +223,120 @@ func (application *Application) StartRpcClient() {
 	}()
 }
 
+//启动 cluster 模式的 raft 节点, 监听 peers 中自己的地址
+func (application *Application) StartRaftNode() {
+	raftConfig := application.ConfigData.Raft
+	if raftConfig.NodeId < 1 || raftConfig.NodeId > len(raftConfig.Peers) {
+		panic(fmt.Sprintf("raft nodeId 超出范围: %d", raftConfig.NodeId))
+	}
+
+	node, err := NewRaftNode(RaftNodeConfig{
+		Id:                raftConfig.NodeId,
+		Peers:             raftConfig.Peers,
+		FilePath:          raftConfig.FilePath,
+		ElectionTimeout:   time.Duration(raftConfig.ElectionTimeoutMs) * time.Millisecond,
+		HeartbeatInterval: time.Duration(raftConfig.HeartbeatMs) * time.Millisecond,
+		ProposeTimeout:    time.Duration(raftConfig.ProposeTimeoutMs) * time.Millisecond,
+		SnapshotLogs:      raftConfig.SnapshotLogs,
+		OnRaise: func(source string) {
+			//导入的值更大, 重新从raft 加载号段
+			GetAutoIncrIdWorker().WorkerMap.Remove(source)
+		},
+	})
+	CheckErr(err)
+
+	listener, err := net.Listen("tcp", raftConfig.Peers[raftConfig.NodeId-1])
+	if err != nil {
+		node.Stop()
+		panic(err)
+	}
+
+	node.Start(listener)
+	application.RaftNode = node
+}
+
+//租用snowflake worker id, 需要在数据备份/rpc 启动之后调用
+func (application *Application) StartSnowFlakeWorkerLease() {
+	if !application.ConfigData.SnowFlake.LeaseWorkerId {
+		return
+	}
+
+	segmentStore, err := getCurrentSegmentStore()
+	if err != nil {
+		panic(err)
+	}
+
+	store, ok := segmentStore.(WorkerLeaseStore)
+	if !ok {
+		panic("当前持久化方式不支持 worker id 租约: " + currentPersistType())
+	}
+
+	lease := NewSnowFlakeWorkerLease(store, application.ConfigData.SnowFlake.LeaseTtl)
+	err = lease.Start(application.GetSnowFlakeLayout().MaxWorkerId())
+	if err != nil {
+		panic(err)
+	}
+
+	worker, err := NewSnowFlakeIdWorker(lease.WorkerId)
+	if err != nil {
+		lease.Release()
+		panic(err)
+	}
+
+	worker.lease = lease
+
+	application.SnowFlakeLease = lease
+	application.LeasedSnowFlakeWorker = worker
+}
+
+//收到退出信号时 释放资源后退出
+func (application *Application) HandleShutdownSignal() {
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signalChan
+		logger.Printf("收到退出信号: %v\n", sig)
+
+		if application.SnowFlakeLease != nil {
+			application.SnowFlakeLease.Release()
+		}
+
+		if application.RaftNode != nil {
+			application.RaftNode.Stop()
+		}
+
+		os.Exit(0)
+	}()
+}
+
+//升级当前持久化方式的表结构, 返回本次执行的版本号
+func (application *Application) MigrateSchema() ([]int, error) {
+	switch currentPersistType() {
+	case PERSIST_TYPE_MYSQL:
+		db, err := application.GetMysqlDB()
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("获取mysql 连接失败: %v", err))
+		}
+
+		return MigrateMysql(db)
+
+	default:
+		if migrator, exist := schemaMigrators[currentPersistType()]; exist {
+			return migrator(application)
+		}
+	}
+
+	return nil, nil
+}
+
+//其他持久化方式的表结构升级, 和持久化方式一起在 init 中注册, 例如使用编译标签的 sqlite
+var schemaMigrators = make(map[string]func(application *Application) ([]int, error))
+
+func registerSchemaMigrator(name string, migrator func(application *Application) ([]int, error)) {
+	schemaMigrators[name] = migrator
+}
+
 //获取Mysql连接
 func (application *Application) GetMysqlDB() (db *sql.DB, err interface{}) {
 	defer func() {
@@ -190,6 +357,27 @@ func (application *Application) GetMysqlDB() (db *sql.DB, err interface{}) {
 	return db, nil
 }
 
+//获取PostgreSQL连接
+func (application *Application) GetPostgresDB() (db *sql.DB, err interface{}) {
+	defer func() {
+		err = recover()
+		return
+	}()
+
+	db = persistent.GetPostgresDB(
+		application.ConfigData.Postgres.User,
+		application.ConfigData.Postgres.Password,
+		application.ConfigData.Postgres.Host,
+		application.ConfigData.Postgres.Port,
+		application.ConfigData.Postgres.Name,
+		application.ConfigData.Postgres.SslMode,
+		application.ConfigData.Postgres.MaxIdleConns,
+		application.ConfigData.Postgres.MaxOpenConns,
+	)
+
+	return db, nil
+}
+
 //获取BoltDB
 func (application *Application) GetBoltDB() (db *bolt.DB, err interface{}) {
 	defer func() {
@@ -202,6 +390,33 @@ func (application *Application) GetBoltDB() (db *bolt.DB, err interface{}) {
 	return db, nil
 }
 
+//获取redis 连接池
+func (application *Application) GetRedisPool() (pool *persistent.RedisPool, err interface{}) {
+	defer func() {
+		err = recover()
+		return
+	}()
+
+	pool = persistent.GetRedisPool(
+		application.ConfigData.Redis.Address,
+		application.ConfigData.Redis.Password,
+		application.ConfigData.Redis.Db,
+		application.ConfigData.Redis.MaxIdleConns,
+		time.Duration(application.ConfigData.Redis.TimeoutMs)*time.Millisecond,
+	)
+
+	return pool, nil
+}
+
+//获取snowflake 的位分布, 没有初始化配置时使用默认的
+func (application *Application) GetSnowFlakeLayout() *SnowFlakeLayout {
+	if application.SnowFlakeLayout == nil {
+		application.SnowFlakeLayout = DefaultSnowFlakeLayout()
+	}
+
+	return application.SnowFlakeLayout
+}
+
 //获取worker map
 func (application *Application) GetIdWorkerMap() cmap.ConcurrentMap {
 	applicationInstance := GetApplication()
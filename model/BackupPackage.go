@@ -17,6 +17,9 @@ const (
 	ACTION_SYNC_DATA byte = 0x02 //同步数据
 	ACTION_CHUNK_DATA byte = 0x03 //同步数据，块数据
 	ACTION_CHUNK_END byte = 0x04 //同步数据完成的标识
+	ACTION_SYNC_LOG byte = 0x05 //slave 请求已应用序号之后的同步日志, 日志不可用时 master 回复全量数据
+	ACTION_LOG_ENTRIES byte = 0x06 //同步日志
+	ACTION_FENCE byte = 0x07 //新的master 通知旧master 不再分配id, 旧master 回复同样的action
 
 
 	DATA_LEGTH_TAG = 4
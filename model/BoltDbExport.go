@@ -0,0 +1,272 @@
+package model
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	COUNTER_FORMAT_JSON = "json"
+	COUNTER_FORMAT_CSV  = "csv"
+
+	COUNTER_SNAPSHOT_VERSION = 1 //导出文件的格式版本
+)
+
+var counterCsvHeader = []string{"namespace", "source", "currentId", "bucketStep", "createdAt", "updatedAt"}
+
+//一个source 已分配的最大值
+type SourceCounter struct {
+	Namespace  string `json:"namespace"`
+	Source     string `json:"source"`
+	CurrentId  int    `json:"currentId"`
+	BucketStep int    `json:"bucketStep"`
+	CreatedAt  int64  `json:"createdAt"`
+	UpdatedAt  int64  `json:"updatedAt"`
+}
+
+//json 导出文件
+type CounterSnapshot struct {
+	Version    int              `json:"version"`
+	ExportedAt int64            `json:"exportedAt"`
+	Counters   []*SourceCounter `json:"counters"`
+}
+
+//导入结果, 已有的值不小于导入的值时跳过
+type CounterImportResult struct {
+	Created int
+	Raised  int
+	Skipped int
+}
+
+//bucket 对应的namespace, 不是号段bucket 时返回false
+func boltBucketNamespace(baseBucketName string, bucketName string) (string, bool) {
+	if bucketName == baseBucketName {
+		return "", true
+	}
+
+	prefix := baseBucketName + BUCKET_NAMESPACE_SEPARATOR
+	if !strings.HasPrefix(bucketName, prefix) {
+		return "", false
+	}
+
+	namespace := bucketName[len(prefix):]
+	if namespace == "" || ValidateNamespace(namespace) != nil {
+		return "", false
+	}
+
+	return namespace, true
+}
+
+//在一个读事务中导出所有namespace 的source, 导出期间不影响id 分配
+func ExportBoltCounters(boltDb *bolt.DB) ([]*SourceCounter, error) {
+	baseBucketName := boltBaseBucketName()
+	counters := make([]*SourceCounter, 0)
+
+	err := boltDb.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			namespace, ok := boltBucketNamespace(baseBucketName, string(name))
+			if !ok {
+				return nil
+			}
+
+			//旧版本的记录没有步长
+			_, stepBucketName := boltBucketNames(namespace)
+			stepBucket := tx.Bucket([]byte(stepBucketName))
+
+			return bucket.ForEach(func(key []byte, value []byte) error {
+				record, err := decodeBoltRecord(value)
+				if err != nil {
+					return errors.New(fmt.Sprintf("%s, bucket: %s, source: %s", err.Error(), name, key))
+				}
+
+				if record.BucketStep == 0 && stepBucket != nil {
+					if step := stepBucket.Get(key); step != nil {
+						record.BucketStep = bytesToInt(step)
+					}
+				}
+
+				counters = append(counters, &SourceCounter{
+					Namespace:  namespace,
+					Source:     string(key),
+					CurrentId:  record.CurrentId,
+					BucketStep: record.BucketStep,
+					CreatedAt:  record.CreatedAt,
+					UpdatedAt:  record.UpdatedAt,
+				})
+
+				return nil
+			})
+		})
+	})
+
+	return counters, err
+}
+
+func validateSourceCounter(counter *SourceCounter) error {
+	switch {
+	case counter == nil || counter.Source == "":
+		return errors.New("source 不能为空")
+	case counter.CurrentId < 0 || counter.BucketStep < 0:
+		return errors.New("currentId, bucketStep 不能小于0, source: " + counter.Source)
+	}
+
+	if err := ValidateSource(counter.Source); err != nil {
+		return err
+	}
+
+	return ValidateNamespace(counter.Namespace)
+}
+
+//在一个写事务中导入, 只会增大已有的值, 不会减小, 保证不会重复分配已发出的id
+func ImportBoltCounters(boltDb *bolt.DB, counters []*SourceCounter) (result *CounterImportResult, err error) {
+	for _, counter := range counters {
+		if err := validateSourceCounter(counter); err != nil {
+			return nil, err
+		}
+	}
+
+	defer func() {
+		if errRecovered := recover(); errRecovered != nil {
+			result = nil
+			err = errors.New(fmt.Sprintf("%v", errRecovered))
+		}
+	}()
+
+	//先创建每个namespace 的bucket, 默认namespace 会复制旧版本的数据
+	services := make(map[string]*BoltDbService)
+	for _, counter := range counters {
+		if _, exist := services[counter.Namespace]; !exist {
+			services[counter.Namespace] = NewBoltDbServiceWithNamespace(counter.Namespace)
+		}
+	}
+
+	result = new(CounterImportResult)
+
+	err = boltDb.Update(func(tx *bolt.Tx) error {
+		for _, counter := range counters {
+			bucket := tx.Bucket([]byte(services[counter.Namespace].BucketName))
+
+			record := getBoltSourceRecord(bucket, counter.Source)
+			switch {
+			case record == nil:
+				record = &boltSourceRecord{CurrentId: counter.CurrentId, BucketStep: counter.BucketStep, CreatedAt: counter.CreatedAt}
+				result.Created++
+			case record.CurrentId >= counter.CurrentId:
+				result.Skipped++
+				continue
+			default:
+				record.CurrentId = counter.CurrentId
+				if record.BucketStep == 0 {
+					record.BucketStep = counter.BucketStep
+				}
+				result.Raised++
+			}
+
+			putBoltSourceRecord(bucket, counter.Source, record)
+			services[counter.Namespace].appendReplicationLog(tx, counter.Source, record)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func WriteSourceCounters(writer io.Writer, format string, counters []*SourceCounter) error {
+	switch format {
+	case COUNTER_FORMAT_JSON:
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+
+		return encoder.Encode(&CounterSnapshot{COUNTER_SNAPSHOT_VERSION, time.Now().Unix(), counters})
+
+	case COUNTER_FORMAT_CSV:
+		csvWriter := csv.NewWriter(writer)
+		if err := csvWriter.Write(counterCsvHeader); err != nil {
+			return err
+		}
+
+		for _, counter := range counters {
+			err := csvWriter.Write([]string{
+				counter.Namespace,
+				counter.Source,
+				strconv.Itoa(counter.CurrentId),
+				strconv.Itoa(counter.BucketStep),
+				strconv.FormatInt(counter.CreatedAt, 10),
+				strconv.FormatInt(counter.UpdatedAt, 10),
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		csvWriter.Flush()
+		return csvWriter.Error()
+	}
+
+	return errors.New("不识别的格式: " + format)
+}
+
+func ReadSourceCounters(reader io.Reader, format string) ([]*SourceCounter, error) {
+	switch format {
+	case COUNTER_FORMAT_JSON:
+		snapshot := new(CounterSnapshot)
+		if err := json.NewDecoder(reader).Decode(snapshot); err != nil {
+			return nil, err
+		}
+
+		if snapshot.Version > COUNTER_SNAPSHOT_VERSION {
+			return nil, errors.New("不支持的导出文件版本: " + strconv.Itoa(snapshot.Version))
+		}
+
+		return snapshot.Counters, nil
+
+	case COUNTER_FORMAT_CSV:
+		csvReader := csv.NewReader(reader)
+		csvReader.FieldsPerRecord = len(counterCsvHeader)
+
+		rows, err := csvReader.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+
+		counters := make([]*SourceCounter, 0, len(rows))
+		for i, row := range rows {
+			if i == 0 && row[0] == counterCsvHeader[0] && row[1] == counterCsvHeader[1] {
+				continue //表头
+			}
+
+			//namespace, source 之后都是数字
+			values := make([]int64, len(row)-2)
+			for j := range values {
+				if values[j], err = strconv.ParseInt(row[j+2], 10, 64); err != nil {
+					return nil, errors.New(fmt.Sprintf("第%d行 %s 错误: %s", i+1, counterCsvHeader[j+2], row[j+2]))
+				}
+			}
+
+			counters = append(counters, &SourceCounter{
+				Namespace:  row[0],
+				Source:     row[1],
+				CurrentId:  int(values[0]),
+				BucketStep: int(values[1]),
+				CreatedAt:  values[2],
+				UpdatedAt:  values[3],
+			})
+		}
+
+		return counters, nil
+	}
+
+	return nil, errors.New("不识别的格式: " + format)
+}
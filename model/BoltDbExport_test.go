@@ -0,0 +1,113 @@
+package model
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func sortedCounters(counters []*SourceCounter) []*SourceCounter {
+	sort.Slice(counters, func(i, j int) bool {
+		return NamespacedSource(counters[i].Namespace, counters[i].Source) < NamespacedSource(counters[j].Namespace, counters[j].Source)
+	})
+
+	return counters
+}
+
+func TestBoltCounterExportImport(t *testing.T) {
+	boltDb := initTestBoltDb(t)
+
+	GetApplication().ConfigData.Bolt.BucketName = "TestExport" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	defer func() { GetApplication().ConfigData.Bolt.BucketName = "" }()
+
+	NewBoltDbService().LoadCurrentIdFromDb("order", 100)
+	NewBoltDbService().LoadCurrentIdFromDb("user", 10)
+	NewBoltDbServiceWithNamespace("tenant_a").LoadCurrentIdFromDb("order", 50)
+
+	counters, err := ExportBoltCounters(boltDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counters = sortedCounters(counters)
+	if len(counters) != 3 {
+		t.Fatalf("exported: %d", len(counters))
+	}
+
+	if counters[0].Source != "order" || counters[0].CurrentId != 100 || counters[0].BucketStep != 100 || counters[0].CreatedAt == 0 {
+		t.Errorf("exported order: %+v", counters[0])
+	}
+	if counters[1].Namespace != "tenant_a" || counters[1].CurrentId != 50 {
+		t.Errorf("exported tenant_a/order: %+v", counters[1])
+	}
+
+	for _, format := range []string{COUNTER_FORMAT_JSON, COUNTER_FORMAT_CSV} {
+		buffer := new(bytes.Buffer)
+		if err := WriteSourceCounters(buffer, format, counters); err != nil {
+			t.Fatal(err)
+		}
+
+		readCounters, err := ReadSourceCounters(buffer, format)
+		if err != nil {
+			t.Fatal(format, err)
+		}
+
+		readCounters = sortedCounters(readCounters)
+		for i := range counters {
+			if *readCounters[i] != *counters[i] {
+				t.Errorf("%s: %+v, want %+v", format, readCounters[i], counters[i])
+			}
+		}
+	}
+
+	//导出之后继续分配
+	NewBoltDbService().IncrSourceCurrentId("order", 100, 100)
+
+	backup := []*SourceCounter{
+		{Source: "order", CurrentId: 150},                              //已分配到200, 不能减小
+		{Source: "user", CurrentId: 1000, BucketStep: 10},              //增大
+		{Namespace: "tenant_b", Source: "order", CurrentId: 70, BucketStep: 7}, //新增
+	}
+
+	result, err := ImportBoltCounters(boltDb, backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *result != (CounterImportResult{Created: 1, Raised: 1, Skipped: 1}) {
+		t.Errorf("import result: %+v", result)
+	}
+
+	if currentId := NewBoltDbService().LoadCurrentIdFromDb("order", 10); currentId != 200 {
+		t.Errorf("order lowered: %d", currentId)
+	}
+	if currentId := NewBoltDbService().LoadCurrentIdFromDb("user", 10); currentId != 1000 {
+		t.Errorf("user not raised: %d", currentId)
+	}
+
+	tenantB := NewBoltDbServiceWithNamespace("tenant_b")
+	if currentId := tenantB.LoadCurrentIdFromDb("order", 7); currentId != 70 {
+		t.Errorf("tenant_b/order: %d", currentId)
+	}
+
+	//参数错误时不导入任何数据
+	_, err = ImportBoltCounters(boltDb, []*SourceCounter{
+		{Source: "user", CurrentId: 5000},
+		{Namespace: "bad/namespace", Source: "order", CurrentId: 1},
+	})
+	if err == nil {
+		t.Error("invalid namespace imported")
+	}
+	if currentId := NewBoltDbService().LoadCurrentIdFromDb("user", 10); currentId != 1010 {
+		t.Errorf("partial import: %d", currentId)
+	}
+}
+
+func TestReadSourceCountersCsvError(t *testing.T) {
+	_, err := ReadSourceCounters(bytes.NewBufferString("namespace,source,currentId,bucketStep,createdAt,updatedAt\n,order,abc,1,0,0\n"), COUNTER_FORMAT_CSV)
+	if err == nil {
+		t.Error("invalid currentId accepted")
+	}
+}
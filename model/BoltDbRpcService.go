@@ -10,10 +10,24 @@ type BoltDbRpcService  struct {
 }
 
 type LoadCurrentIdFromDbArgs struct {
+	Namespace string
 	Source string
 	BucketStep int
 }
 
+//namespace 对应的持久化, 默认namespace 使用启动时创建的
+func (this *BoltDbRpcService) namespaceService(namespace string, source string) *BoltDbService {
+	CheckErr(ValidateSource(source))
+
+	if namespace == "" {
+		return this.BoltDbService
+	}
+
+	CheckErr(ValidateNamespace(namespace))
+
+	return NewBoltDbServiceWithNamespace(namespace)
+}
+
 func (this *BoltDbRpcService) LoadCurrentIdFromDb(args *LoadCurrentIdFromDbArgs, result *int) (err error) {
 
 	defer func() {
@@ -24,11 +38,18 @@ func (this *BoltDbRpcService) LoadCurrentIdFromDb(args *LoadCurrentIdFromDbArgs,
 		}
 	}()
 
-	*result = this.BoltDbService.LoadCurrentIdFromDb(args.Source, args.BucketStep)
+	//master 租约过期时 slave 也不能获取新的号段
+	CheckErr(checkMasterLease())
+	*result = this.namespaceService(args.Namespace, args.Source).LoadCurrentIdFromDb(args.Source, args.BucketStep)
+
+	//slave 使用这个号段前 半同步等待确认, 不持有master 上source 的锁
+	waitSemiSyncAck(NamespacedSource(args.Namespace, args.Source), *result)
+
 	return err
 }
 
 type IncrSourceCurrentIdArgs struct {
+	Namespace string
 	Source string
 	CurrentId int
 	BucketStep int
@@ -49,7 +70,9 @@ func (this *BoltDbRpcService) IncrSourceCurrentId(args *IncrSourceCurrentIdArgs,
 		}
 	}()
 
-	resultCurrentId, newDbCurrentId := this.BoltDbService.IncrSourceCurrentId(args.Source, args.CurrentId, args.BucketStep)
+	CheckErr(checkMasterLease())
+	resultCurrentId, newDbCurrentId := this.namespaceService(args.Namespace, args.Source).IncrSourceCurrentId(args.Source, args.CurrentId, args.BucketStep)
+	waitSemiSyncAck(NamespacedSource(args.Namespace, args.Source), resultCurrentId)
 
 	result.ResultCurrentId = resultCurrentId
 	result.NewDbCurrentId = newDbCurrentId
@@ -57,6 +80,105 @@ func (this *BoltDbRpcService) IncrSourceCurrentId(args *IncrSourceCurrentIdArgs,
 	return err
 }
 
+type WorkerLeaseArgs struct {
+	Owner       string
+	WorkerId    int64
+	MaxWorkerId int64
+	Ttl         int
+}
+
+func (this *BoltDbRpcService) AcquireWorkerLease(args *WorkerLeaseArgs, result *int64) error {
+	workerId, err := this.BoltDbService.AcquireWorkerLease(args.Owner, args.MaxWorkerId, args.Ttl)
+	*result = workerId
+
+	return err
+}
+
+func (this *BoltDbRpcService) RenewWorkerLease(args *WorkerLeaseArgs, result *int) error {
+	return this.BoltDbService.RenewWorkerLease(args.Owner, args.WorkerId, args.Ttl)
+}
+
+func (this *BoltDbRpcService) ReleaseWorkerLease(args *WorkerLeaseArgs, result *int) error {
+	return this.BoltDbService.ReleaseWorkerLease(args.Owner, args.WorkerId)
+}
+
+type LoadSourceStepArgs struct {
+	Namespace string
+	Source string
+}
+
+func (this *BoltDbRpcService) LoadSourceStep(args *LoadSourceStepArgs, result *int) (err error) {
+
+	defer func() {
+		errRecovered := recover()
+
+		if errRecovered != nil {
+			err = errors.New(fmt.Sprintf("%#v", errRecovered))
+		}
+	}()
+
+	*result = this.namespaceService(args.Namespace, args.Source).LoadSourceStep(args.Source)
+	return err
+}
+
+func (this *BoltDbRpcService) GetSourceConfig(source string, result *SourceConfig) error {
+	sourceConfig, err := this.BoltDbService.GetSourceConfig(source)
+	if sourceConfig != nil {
+		*result = *sourceConfig
+	}
+
+	return err
+}
+
+func (this *BoltDbRpcService) SaveSourceConfig(args *SourceConfig, result *int) error {
+	return this.BoltDbService.SaveSourceConfig(args)
+}
+
+func (this *BoltDbRpcService) DeleteSourceConfig(source string, result *int) error {
+	return this.BoltDbService.DeleteSourceConfig(source)
+}
+
+func (this *BoltDbRpcService) ListSourceConfigs(args int, result *[]*SourceConfig) error {
+	sourceConfigs, err := this.BoltDbService.ListSourceConfigs()
+	*result = sourceConfigs
+
+	return err
+}
+
+//导出所有source 已分配的最大值
+func (this *BoltDbRpcService) ExportCounters(args int, result *[]*SourceCounter) error {
+	boltDb, errGetBolt := GetApplication().GetBoltDB()
+	if errGetBolt != nil {
+		return errors.New(fmt.Sprintf("%#v", errGetBolt))
+	}
+
+	counters, err := ExportBoltCounters(boltDb)
+	*result = counters
+
+	return err
+}
+
+//导入后丢弃导入的source 的内存号段, 重新从增大后的值加载
+func (this *BoltDbRpcService) ImportCounters(args []*SourceCounter, result *CounterImportResult) error {
+	boltDb, errGetBolt := GetApplication().GetBoltDB()
+	if errGetBolt != nil {
+		return errors.New(fmt.Sprintf("%#v", errGetBolt))
+	}
+
+	importResult, err := ImportBoltCounters(boltDb, args)
+	if err != nil {
+		return err
+	}
+
+	for _, counter := range args {
+		GetAutoIncrIdWorker().WorkerMap.Remove(NamespacedSource(counter.Namespace, counter.Source))
+	}
+
+	*result = *importResult
+
+	return nil
+}
+
 //保活 keep alive 请求
 func (this *BoltDbRpcService) KeepAlive(args int, result *int) (err error) {
 	*result = args + 1
@@ -70,19 +192,29 @@ func NewBoltDbRpcService() *BoltDbRpcService {
 /******************************************************/
 type BoltDbRpcClient struct {
 	Client *Client
+	Namespace string
+}
+
+func init() {
+	RegisterSegmentStore(PERSIST_TYPE_RPC, func(namespace string) SegmentStore {
+		client := NewBoltDbRpcClient(GetApplication().RpcSocketClient)
+		client.Namespace = namespace
+
+		return client
+	})
 }
 
 func NewBoltDbRpcClient(socketClient *Client) *BoltDbRpcClient {
 	if socketClient == nil {
 		panic("rpc socket client 为 nil")
 	}
-	return &BoltDbRpcClient{socketClient}
+	return &BoltDbRpcClient{socketClient, ""}
 }
 
 
 func(this *BoltDbRpcClient) LoadCurrentIdFromDb(source string, bucketStep int) int {
 
-	args := LoadCurrentIdFromDbArgs{Source:source, BucketStep:bucketStep}
+	args := LoadCurrentIdFromDbArgs{Namespace:this.Namespace, Source:source, BucketStep:bucketStep}
 	result := 0
 
 	err := this.Client.GetRpcClient().Call("BoltDbRpcService.LoadCurrentIdFromDb", args, &result)
@@ -93,7 +225,7 @@ func(this *BoltDbRpcClient) LoadCurrentIdFromDb(source string, bucketStep int) i
 
 func(this *BoltDbRpcClient)  IncrSourceCurrentId(source string, currentId int, bucketStep int) (resultCurrentId int, newDbCurrentId int) {
 
-	args := IncrSourceCurrentIdArgs{Source:source, CurrentId:currentId, BucketStep:bucketStep}
+	args := IncrSourceCurrentIdArgs{Namespace:this.Namespace, Source:source, CurrentId:currentId, BucketStep:bucketStep}
 	result := new(IncrSourceCurrentIdResult)
 
 	err := this.Client.GetRpcClient().Call("BoltDbRpcService.IncrSourceCurrentId", args, result)
@@ -101,3 +233,94 @@ func(this *BoltDbRpcClient)  IncrSourceCurrentId(source string, currentId int, b
 
 	return result.ResultCurrentId, result.NewDbCurrentId
 }
+
+func(this *BoltDbRpcClient) LoadSourceStep(source string) int {
+
+	args := LoadSourceStepArgs{Namespace:this.Namespace, Source:source}
+	result := 0
+
+	err := this.Client.GetRpcClient().Call("BoltDbRpcService.LoadSourceStep", args, &result)
+	CheckErr(err)
+
+	return result
+}
+
+func(this *BoltDbRpcClient) AcquireWorkerLease(owner string, maxWorkerId int64, ttl int) (int64, error) {
+
+	args := WorkerLeaseArgs{Owner:owner, MaxWorkerId:maxWorkerId, Ttl:ttl}
+	var result int64 = -1
+
+	err := this.Client.GetRpcClient().Call("BoltDbRpcService.AcquireWorkerLease", args, &result)
+
+	return result, err
+}
+
+func(this *BoltDbRpcClient) RenewWorkerLease(owner string, workerId int64, ttl int) error {
+
+	args := WorkerLeaseArgs{Owner:owner, WorkerId:workerId, Ttl:ttl}
+	result := 0
+
+	return this.Client.GetRpcClient().Call("BoltDbRpcService.RenewWorkerLease", args, &result)
+}
+
+func(this *BoltDbRpcClient) ReleaseWorkerLease(owner string, workerId int64) error {
+
+	args := WorkerLeaseArgs{Owner:owner, WorkerId:workerId}
+	result := 0
+
+	return this.Client.GetRpcClient().Call("BoltDbRpcService.ReleaseWorkerLease", args, &result)
+}
+
+//source 不存在时 rpc 返回空的 SourceConfig
+func(this *BoltDbRpcClient) GetSourceConfig(source string) (*SourceConfig, error) {
+
+	result := new(SourceConfig)
+
+	err := this.Client.GetRpcClient().Call("BoltDbRpcService.GetSourceConfig", source, result)
+	if err != nil || result.Source == "" {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func(this *BoltDbRpcClient) SaveSourceConfig(sourceConfig *SourceConfig) error {
+
+	result := 0
+
+	return this.Client.GetRpcClient().Call("BoltDbRpcService.SaveSourceConfig", sourceConfig, &result)
+}
+
+func(this *BoltDbRpcClient) DeleteSourceConfig(source string) error {
+
+	result := 0
+
+	return this.Client.GetRpcClient().Call("BoltDbRpcService.DeleteSourceConfig", source, &result)
+}
+
+func(this *BoltDbRpcClient) ListSourceConfigs() ([]*SourceConfig, error) {
+
+	var result []*SourceConfig
+
+	err := this.Client.GetRpcClient().Call("BoltDbRpcService.ListSourceConfigs", 0, &result)
+
+	return result, err
+}
+
+func(this *BoltDbRpcClient) ExportCounters() ([]*SourceCounter, error) {
+
+	var result []*SourceCounter
+
+	err := this.Client.GetRpcClient().Call("BoltDbRpcService.ExportCounters", 0, &result)
+
+	return result, err
+}
+
+func(this *BoltDbRpcClient) ImportCounters(counters []*SourceCounter) (*CounterImportResult, error) {
+
+	result := new(CounterImportResult)
+
+	err := this.Client.GetRpcClient().Call("BoltDbRpcService.ImportCounters", counters, result)
+
+	return result, err
+}
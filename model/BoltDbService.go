@@ -1,38 +1,120 @@
 package model
 
 import (
+	"idGenerator/model/cmap"
 	"idGenerator/model/logger"
 	"github.com/boltdb/bolt"
 	"strconv"
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
+	"time"
 )
 
 const (
-	BUCKET_NAME = "IdGeneratorBucket"
+	BUCKET_NAME = "IdGeneratorBucket" //没有配置 bolt.bucketName 时使用
+	BUCKET_STEP_SUFFIX = "Step" //旧版本每个source 最近一次使用的步长, 保存在 bucketName + Step(.namespace) 中, 新版本保存在记录中
+	BUCKET_STEP_NAME = BUCKET_NAME + BUCKET_STEP_SUFFIX
+	BUCKET_NAMESPACE_SEPARATOR = "." //不同namespace 使用 bucketName.namespace
 )
 
-type BoltDbUtil interface {
-	LoadCurrentIdFromDb(source string, bucketStep int) int
-	IncrSourceCurrentId(source string, currentId int, bucketStep int) (int, int)
-}
-
 type BoltDbService struct {
+	Namespace string
 	BucketName string
+	StepBucketName string
+}
+
+//已经创建过的bucket, 避免每次都开启写事务
+var boltBucketInited = cmap.New()
+
+func init() {
+	RegisterSegmentStore(PERSIST_TYPE_BOLTDB, func(namespace string) SegmentStore {
+		return NewBoltDbServiceWithNamespace(namespace)
+	})
 }
 
 func NewBoltDbService() *BoltDbService {
+	return NewBoltDbServiceWithNamespace("")
+}
+
+//每个namespace 使用单独的bucket, 不同namespace 的source 互不影响
+func NewBoltDbServiceWithNamespace(namespace string) *BoltDbService {
+	bucketName, stepBucketName := boltBucketNames(namespace)
+
+	service := &BoltDbService{namespace, bucketName, stepBucketName}
+	service.initBuckets(namespace == "")
+
+	return service
+}
+
+//默认namespace 的bucket, 其他namespace 的bucket 为 bucketName.namespace
+func boltBaseBucketName() string {
+	if bucketName := GetApplication().ConfigData.Bolt.BucketName; bucketName != "" {
+		return bucketName
+	}
+
+	return BUCKET_NAME
+}
+
+//namespace 对应的号段bucket 和旧版本的步长bucket
+func boltBucketNames(namespace string) (bucketName string, stepBucketName string) {
+	bucketName = boltBaseBucketName()
+	stepBucketName = bucketName + BUCKET_STEP_SUFFIX
+
+	if namespace != "" {
+		bucketName = bucketName + BUCKET_NAMESPACE_SEPARATOR + namespace
+		stepBucketName = stepBucketName + BUCKET_NAMESPACE_SEPARATOR + namespace
+	}
+
+	return bucketName, stepBucketName
+}
+
+//copyLegacy: 默认namespace 需要兼容旧版本的bucket
+func (this *BoltDbService) initBuckets(copyLegacy bool) {
+	if boltBucketInited.Has(this.BucketName) {
+		return
+	}
 
 	boltDb, err := GetApplication().GetBoltDB()
 	CheckErr(err)
 
-	boltDb.Update(func(tx *bolt.Tx) error {
-			_, err := tx.CreateBucketIfNotExists([]byte(BUCKET_NAME))
-			CheckErr(err)
-			return nil
+	err = boltDb.Update(func(tx *bolt.Tx) error {
+		//配置了新的bucket名, 旧版本的数据在 BUCKET_NAME 中, 复制过去, 保证已发出的id 不会再次分配
+		if copyLegacy && this.BucketName != BUCKET_NAME && tx.Bucket([]byte(this.BucketName)) == nil && tx.Bucket([]byte(BUCKET_NAME)) != nil {
+			if err := copyBoltBucket(tx, BUCKET_NAME, this.BucketName); err != nil {
+				return err
+			}
+
+			if err := copyBoltBucket(tx, BUCKET_STEP_NAME, this.StepBucketName); err != nil {
+				return err
+			}
+
+			logger.AsyncInfo("copy boltdb bucket " + BUCKET_NAME + " to " + this.BucketName)
+		}
+
+		_, err := tx.CreateBucketIfNotExists([]byte(this.BucketName))
+		return err
 	})
+	CheckErr(err)
 
-	return &BoltDbService{BUCKET_NAME}
+	boltBucketInited.Set(this.BucketName, true)
+}
+
+//复制bucket 中的所有数据, 源bucket 不存在时什么也不做
+func copyBoltBucket(tx *bolt.Tx, from string, to string) error {
+	fromBucket := tx.Bucket([]byte(from))
+	if fromBucket == nil {
+		return nil
+	}
+
+	if _, err := tx.CreateBucketIfNotExists([]byte(to)); err != nil {
+		return err
+	}
+
+	//同时写入同步日志, slave 上也会有复制后的数据
+	return fromBucket.ForEach(func(key []byte, value []byte) error {
+		return putReplicatedBucketValue(tx, to, key, value)
+	})
 }
 
 func (this *BoltDbService) NextId(source string) int {
@@ -42,7 +124,7 @@ func (this *BoltDbService) NextId(source string) int {
 	CheckErr(err)
 
 	boltDb.Update(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte(BUCKET_NAME))
+			b := tx.Bucket([]byte(this.BucketName))
 			err := b.Put([]byte(source), []byte("100"))
 			CheckErr(err)
 
@@ -62,7 +144,6 @@ func (this *BoltDbService) LoadCurrentIdFromDb(source string, bucketStep int) in
 	}
 
 	var currentId int
-
 	boltDb, errGetBolt := GetApplication().GetBoltDB()
 	CheckErr(errGetBolt)
 
@@ -86,22 +167,17 @@ func (this *BoltDbService) LoadCurrentIdFromDb(source string, bucketStep int) in
 
 	bucket := dbTx.Bucket([]byte(this.BucketName))
 
-	oldCurrentId := bucket.Get([]byte(source))
-
-	if oldCurrentId == nil {//还没有记录
-
-		currentId = 0
-
-		errInsert := bucket.Put([]byte(source), intToBytes(currentId +bucketStep))
-		checkErr(errInsert)
-
-	} else {//更新记录
+	record := getBoltSourceRecord(bucket, source)
+	if record == nil {//还没有记录
+		record = &boltSourceRecord{}
+	}
 
-		currentId = bytesToInt(oldCurrentId)
+	currentId = record.CurrentId
 
-		errUpdate := bucket.Put([]byte(source), intToBytes(currentId +bucketStep))
-		checkErr(errUpdate)
-	}
+	record.CurrentId = currentId + bucketStep
+	record.BucketStep = bucketStep
+	putBoltSourceRecord(bucket, source, record)
+	this.appendReplicationLog(dbTx, source, record)
 
 	logger.AsyncInfo("load current id from boltdb, source: " + source + " , currentId: " + strconv.Itoa(currentId))
 
@@ -137,12 +213,12 @@ func (this *BoltDbService) IncrSourceCurrentId(source string, currentId int, buc
 
 	bucket := dbTx.Bucket([]byte(this.BucketName))
 
-	dbRes := bucket.Get([]byte(source))
-	if dbRes == nil {//还没有记录
+	record := getBoltSourceRecord(bucket, source)
+	if record == nil {//还没有记录
 		panic("boltdb中数据不存在, 不可更新")
 	}
 
-	oldCurrentId := bytesToInt(dbRes)
+	oldCurrentId := record.CurrentId
 
 	resultCurrentId = currentId
 	newDbCurrentId = currentId + bucketStep
@@ -152,19 +228,270 @@ func (this *BoltDbService) IncrSourceCurrentId(source string, currentId int, buc
 		newDbCurrentId = oldCurrentId + bucketStep;
 	}
 
-	errUpdate := bucket.Put([]byte(source), intToBytes(newDbCurrentId))
-	checkErr(errUpdate)
+	record.CurrentId = newDbCurrentId
+	record.BucketStep = bucketStep
+	putBoltSourceRecord(bucket, source, record)
+	this.appendReplicationLog(dbTx, source, record)
 
 	logger.AsyncInfo("source: " + source + " update bolt current_id to " + strconv.Itoa(newDbCurrentId))
 
 	return resultCurrentId, newDbCurrentId
 }
 
+//记录计数变化, slave 按顺序同步, 返回日志的序号
+func (this *BoltDbService) appendReplicationLog(tx *bolt.Tx, source string, record *boltSourceRecord) uint64 {
+	entry := &ReplicationLogEntry{
+		Namespace:  this.Namespace,
+		Source:     source,
+		CurrentId:  record.CurrentId,
+		BucketStep: record.BucketStep,
+	}
+	appendReplicationLog(tx, entry)
+
+	//半同步: 提交后记录这个号段, 发出其中的id 之前等待slave 确认
+	if GetApplication().ConfigData.Bolt.SemiSyncSlaves > 0 {
+		logId, _ := replicationState(tx)
+		namespacedSource := NamespacedSource(this.Namespace, source)
+		segment := semiSyncSegment{logId: logId, seq: entry.Seq, firstId: record.CurrentId - record.BucketStep, maxId: record.CurrentId}
+
+		tx.OnCommit(func() {
+			GetSlaveRegistry().addPending(namespacedSource, segment)
+		})
+	}
+
+	return entry.Seq
+}
+
+//获取source 最近一次使用的步长, 没有记录时返回0
+func (this *BoltDbService) LoadSourceStep(source string) int {
+	boltDb, errGetBolt := GetApplication().GetBoltDB()
+	CheckErr(errGetBolt)
+
+	var step int
+
+	err := boltDb.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket([]byte(this.BucketName)); bucket != nil {
+			if record := getBoltSourceRecord(bucket, source); record != nil && record.BucketStep > 0 {
+				step = record.BucketStep
+				return nil
+			}
+		}
+
+		//旧版本的记录没有步长, 保存在单独的bucket 中
+		bucket := tx.Bucket([]byte(this.StepBucketName))
+		if bucket == nil {
+			return nil
+		}
+
+		if value := bucket.Get([]byte(source)); value != nil {
+			step = bytesToInt(value)
+		}
+
+		return nil
+	})
+	checkErr(err)
+
+	return step
+}
+
+/****************************************************/
+/*snowflake worker id 租约*/
+
+//申请一个空闲或已过期的 worker id
+func (this *BoltDbService) AcquireWorkerLease(owner string, maxWorkerId int64, ttl int) (int64, error) {
+	boltDb, errGetBolt := GetApplication().GetBoltDB()
+	CheckErr(errGetBolt)
+
+	var workerId int64 = -1
+	now := time.Now().Unix()
+
+	err := boltDb.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(WORKER_LEASE_BUCKET_NAME))
+		if err != nil {
+			return err
+		}
+
+		for id := int64(0); id <= maxWorkerId; id++ {
+			key := []byte(strconv.FormatInt(id, 10))
+
+			var record workerLeaseRecord
+			if value := bucket.Get(key); value != nil {
+				if err := json.Unmarshal(value, &record); err != nil {
+					return err
+				}
+
+				if record.Owner != owner && record.ExpireAt >= now {
+					continue //别人持有 还没过期
+				}
+			}
+
+			record = workerLeaseRecord{owner, now + int64(ttl)}
+			value, _ := json.Marshal(record)
+			if err := putReplicatedBucketValue(tx, WORKER_LEASE_BUCKET_NAME, key, value); err != nil {
+				return err
+			}
+
+			workerId = id
+			return nil
+		}
+
+		return ErrNoFreeWorkerId
+	})
+
+	return workerId, err
+}
+
+//续约, 租约已被别人持有时返回 ErrWorkerLeaseLost
+func (this *BoltDbService) RenewWorkerLease(owner string, workerId int64, ttl int) error {
+	boltDb, errGetBolt := GetApplication().GetBoltDB()
+	CheckErr(errGetBolt)
+
+	return boltDb.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(WORKER_LEASE_BUCKET_NAME))
+		if err != nil {
+			return err
+		}
+
+		key := []byte(strconv.FormatInt(workerId, 10))
+
+		var record workerLeaseRecord
+		value := bucket.Get(key)
+		if value == nil {
+			return ErrWorkerLeaseLost
+		}
+
+		if err := json.Unmarshal(value, &record); err != nil {
+			return err
+		}
+
+		if record.Owner != owner {
+			return ErrWorkerLeaseLost
+		}
+
+		record.ExpireAt = time.Now().Unix() + int64(ttl)
+		value, _ = json.Marshal(record)
+
+		return putReplicatedBucketValue(tx, WORKER_LEASE_BUCKET_NAME, key, value)
+	})
+}
+
+//释放租约, 只删除自己持有的
+func (this *BoltDbService) ReleaseWorkerLease(owner string, workerId int64) error {
+	boltDb, errGetBolt := GetApplication().GetBoltDB()
+	CheckErr(errGetBolt)
+
+	return boltDb.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(WORKER_LEASE_BUCKET_NAME))
+		if bucket == nil {
+			return nil
+		}
+
+		key := []byte(strconv.FormatInt(workerId, 10))
+
+		var record workerLeaseRecord
+		value := bucket.Get(key)
+		if value == nil {
+			return nil
+		}
+
+		if err := json.Unmarshal(value, &record); err != nil {
+			return err
+		}
+
+		if record.Owner != owner {
+			return nil
+		}
+
+		return putReplicatedBucketValue(tx, WORKER_LEASE_BUCKET_NAME, key, nil)
+	})
+}
+
+/****************************************************/
+/*source 配置*/
+
+func (this *BoltDbService) GetSourceConfig(source string) (*SourceConfig, error) {
+	boltDb, errGetBolt := GetApplication().GetBoltDB()
+	CheckErr(errGetBolt)
+
+	var sourceConfig *SourceConfig
+
+	err := boltDb.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(SOURCE_BUCKET_NAME))
+		if bucket == nil {
+			return nil
+		}
+
+		value := bucket.Get([]byte(source))
+		if value == nil {
+			return nil
+		}
+
+		sourceConfig = new(SourceConfig)
+		return json.Unmarshal(value, sourceConfig)
+	})
+
+	return sourceConfig, err
+}
+
+func (this *BoltDbService) SaveSourceConfig(sourceConfig *SourceConfig) error {
+	boltDb, errGetBolt := GetApplication().GetBoltDB()
+	CheckErr(errGetBolt)
+
+	value, err := json.Marshal(sourceConfig)
+	if err != nil {
+		return err
+	}
+
+	return boltDb.Update(func(tx *bolt.Tx) error {
+		return putReplicatedBucketValue(tx, SOURCE_BUCKET_NAME, []byte(sourceConfig.Source), value)
+	})
+}
+
+func (this *BoltDbService) DeleteSourceConfig(source string) error {
+	boltDb, errGetBolt := GetApplication().GetBoltDB()
+	CheckErr(errGetBolt)
+
+	return boltDb.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(SOURCE_BUCKET_NAME))
+		if bucket == nil || bucket.Get([]byte(source)) == nil {
+			return nil
+		}
+
+		return putReplicatedBucketValue(tx, SOURCE_BUCKET_NAME, []byte(source), nil)
+	})
+}
+
+func (this *BoltDbService) ListSourceConfigs() ([]*SourceConfig, error) {
+	boltDb, errGetBolt := GetApplication().GetBoltDB()
+	CheckErr(errGetBolt)
+
+	result := make([]*SourceConfig, 0)
+
+	err := boltDb.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(SOURCE_BUCKET_NAME))
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.ForEach(func(key []byte, value []byte) error {
+			sourceConfig := new(SourceConfig)
+			if err := json.Unmarshal(value, sourceConfig); err != nil {
+				return err
+			}
+
+			result = append(result, sourceConfig)
+			return nil
+		})
+	})
+
+	return result, err
+}
+
 func (this *BoltDbService) CallFuncFromMaster() {
 	
 }
 
-//整形转换成字节  
+//整形转换成字节, 小端, boltdb 旧版本的记录格式  
 func intToBytes(n int) []byte {
     bytesBuffer := bytes.NewBuffer([]byte{})
 	tmp := int64(n)
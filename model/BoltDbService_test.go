@@ -0,0 +1,205 @@
+package model
+
+import (
+	"github.com/boltdb/bolt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testBoltDbOnce sync.Once
+
+//boltdb 是单例, 所有测试共用一个临时文件, 每个测试使用不同的bucket
+func initTestBoltDb(t *testing.T) *bolt.DB {
+	testBoltDbOnce.Do(func() {
+		dir, err := os.MkdirTemp("", "idGenerator_bolt")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		GetApplication().ConfigData.Bolt.FilePath = filepath.Join(dir, "bolt_kv.db")
+	})
+
+	boltDb, err := GetApplication().GetBoltDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return boltDb
+}
+
+func TestBoltDbServiceBucketAndNamespace(t *testing.T) {
+	boltDb := initTestBoltDb(t)
+
+	//旧版本的数据在 BUCKET_NAME 中
+	err := boltDb.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(BUCKET_NAME))
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte("legacy"), intToBytes(100))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//其他测试配置新的bucket 时不再复制
+	defer boltDb.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte(BUCKET_NAME))
+	})
+
+	bucketName := "TestBucket" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	GetApplication().ConfigData.Bolt.BucketName = bucketName
+	defer func() { GetApplication().ConfigData.Bolt.BucketName = "" }()
+
+	store := NewBoltDbService()
+	if store.BucketName != bucketName || store.StepBucketName != bucketName+BUCKET_STEP_SUFFIX {
+		t.Fatalf("bucket: %s, %s", store.BucketName, store.StepBucketName)
+	}
+
+	//复制了旧bucket 的数据, 不会重复分配
+	if currentId := store.LoadCurrentIdFromDb("legacy", 10); currentId != 100 {
+		t.Errorf("legacy source: %d", currentId)
+	}
+
+	if currentId := store.LoadCurrentIdFromDb("order", 10); currentId != 0 {
+		t.Errorf("default namespace: %d", currentId)
+	}
+
+	tenantA := NewBoltDbServiceWithNamespace("tenant_a")
+	tenantB := NewBoltDbServiceWithNamespace("tenant_b")
+
+	if tenantA.BucketName != bucketName+".tenant_a" {
+		t.Errorf("namespace bucket: %s", tenantA.BucketName)
+	}
+
+	//同名source 在不同namespace 中互不影响
+	if currentId := tenantA.LoadCurrentIdFromDb("order", 5); currentId != 0 {
+		t.Errorf("tenant_a first load: %d", currentId)
+	}
+	if currentId, maxId := tenantA.IncrSourceCurrentId("order", 5, 5); currentId != 5 || maxId != 10 {
+		t.Errorf("tenant_a incr: %d, %d", currentId, maxId)
+	}
+	if currentId := tenantB.LoadCurrentIdFromDb("order", 5); currentId != 0 {
+		t.Errorf("tenant_b first load: %d", currentId)
+	}
+	if currentId := store.LoadCurrentIdFromDb("order", 10); currentId != 10 {
+		t.Errorf("default namespace second load: %d", currentId)
+	}
+
+	if step := tenantA.LoadSourceStep("order"); step != 5 {
+		t.Errorf("tenant_a step: %d", step)
+	}
+	if step := NewBoltDbServiceWithNamespace("tenant_c").LoadSourceStep("order"); step != 0 {
+		t.Errorf("tenant_c step: %d", step)
+	}
+}
+
+func TestBoltDbServiceWorkerLease(t *testing.T) {
+	boltDb := initTestBoltDb(t)
+
+	//只有这个测试使用租约 bucket, 清空后 worker id 从0 开始
+	boltDb.Update(func(tx *bolt.Tx) error {
+		tx.DeleteBucket([]byte(WORKER_LEASE_BUCKET_NAME))
+		return nil
+	})
+
+	store := NewBoltDbService()
+	var maxWorkerId int64 = 1
+
+	leaseA, leaseB := NewSnowFlakeWorkerLease(store, 30), NewSnowFlakeWorkerLease(store, 30)
+	if err := leaseA.Start(maxWorkerId); err != nil {
+		t.Fatal(err)
+	}
+	defer leaseA.Release()
+	if err := leaseB.Start(maxWorkerId); err != nil {
+		t.Fatal(err)
+	}
+	defer leaseB.Release()
+
+	if leaseA.WorkerId == leaseB.WorkerId || !leaseA.IsValid() || !leaseB.IsValid() {
+		t.Fatalf("a: %d, b: %d", leaseA.WorkerId, leaseB.WorkerId)
+	}
+
+	//没有空闲的 worker id
+	if _, err := store.AcquireWorkerLease("c", maxWorkerId, 30); err != ErrNoFreeWorkerId {
+		t.Fatalf("acquire without free id: %v", err)
+	}
+
+	//只能续约自己持有的
+	if err := store.RenewWorkerLease("c", leaseB.WorkerId, 30); err != ErrWorkerLeaseLost {
+		t.Fatalf("renew by other owner: %v", err)
+	}
+	if err := store.RenewWorkerLease(leaseA.Owner, leaseA.WorkerId, 30); err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+
+	//b 的租约过期后 可以被别人申请, b 再续约失败
+	if err := store.RenewWorkerLease(leaseB.Owner, leaseB.WorkerId, -10); err != nil {
+		t.Fatal(err)
+	}
+	if workerId, err := store.AcquireWorkerLease("c", maxWorkerId, 30); err != nil || workerId != leaseB.WorkerId {
+		t.Fatalf("reclaim expired: %d, %v", workerId, err)
+	}
+	if err := store.RenewWorkerLease(leaseB.Owner, leaseB.WorkerId, 30); err != ErrWorkerLeaseLost {
+		t.Fatalf("renew reclaimed: %v", err)
+	}
+
+	//别人的释放请求不影响 a 的租约
+	if err := store.ReleaseWorkerLease("c", leaseA.WorkerId); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.AcquireWorkerLease("d", maxWorkerId, 30); err != ErrNoFreeWorkerId {
+		t.Fatalf("release by other owner: %v", err)
+	}
+
+	//a 释放后 本地失效, worker id 可以被申请
+	if err := leaseA.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if leaseA.IsValid() {
+		t.Fatal("released lease still valid")
+	}
+	if workerId, err := store.AcquireWorkerLease("d", maxWorkerId, 30); err != nil || workerId != leaseA.WorkerId {
+		t.Fatalf("acquire released: %d, %v", workerId, err)
+	}
+}
+
+func TestBoltDbServiceWorkerLeaseHeartbeatLost(t *testing.T) {
+	boltDb := initTestBoltDb(t)
+
+	boltDb.Update(func(tx *bolt.Tx) error {
+		tx.DeleteBucket([]byte(WORKER_LEASE_BUCKET_NAME))
+		return nil
+	})
+
+	store := NewBoltDbService()
+
+	//租约最短3秒, 每秒心跳一次
+	lease := NewSnowFlakeWorkerLease(store, 3)
+	if err := lease.Start(0); err != nil {
+		t.Fatal(err)
+	}
+	defer lease.Release()
+
+	if err := store.RenewWorkerLease(lease.Owner, lease.WorkerId, -10); err != nil {
+		t.Fatal(err)
+	}
+	if workerId, err := store.AcquireWorkerLease("other", 0, 30); err != nil || workerId != lease.WorkerId {
+		t.Fatalf("reclaim expired: %d, %v", workerId, err)
+	}
+
+	//心跳续约时发现租约被别人持有, 本地立即失效
+	deadline := time.Now().Add(3 * time.Second)
+	for lease.IsValid() && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if lease.IsValid() {
+		t.Fatal("lease still valid after being reclaimed")
+	}
+}
@@ -0,0 +1,130 @@
+package model
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/boltdb/bolt"
+	"hash/crc32"
+	"strconv"
+	"time"
+)
+
+const (
+	BOLT_RECORD_VERSION = 1 //当前的记录格式版本
+
+	BOLT_LEGACY_VALUE_LEN = 8 //旧版本只保存了 current_id, 小端 int64
+	BOLT_RECORD_FIELD_LEN = 8 //每个字段都是大端 int64
+
+	//记录格式: 版本(1字节) + 字段区长度(2字节) + 字段区 + crc32(4字节, 前面所有字节的校验)
+	boltRecordHeaderLen   = 3
+	boltRecordChecksumLen = 4
+)
+
+var ErrBoltRecordCorrupted = errors.New("boltdb 记录损坏")
+
+//boltdb 中每个source 保存的记录
+//新增字段只能追加在最后, 旧版本程序读取时忽略不认识的字段, 新版本读取旧记录时新字段为0
+type boltSourceRecord struct {
+	Version    int   //读取到的记录版本, 0 表示旧版本的小端格式
+	CurrentId  int   //已分配的最大值
+	BucketStep int   //最近一次使用的步长
+	CreatedAt  int64 //创建时间戳 单位秒
+	UpdatedAt  int64 //更新时间戳 单位秒
+}
+
+//按顺序编码的字段
+func (record *boltSourceRecord) fields() []int64 {
+	return []int64{int64(record.CurrentId), int64(record.BucketStep), record.CreatedAt, record.UpdatedAt}
+}
+
+func (record *boltSourceRecord) setFields(fields []int64) {
+	record.CurrentId = int(fields[0])
+	record.BucketStep = int(fields[1])
+	record.CreatedAt = fields[2]
+	record.UpdatedAt = fields[3]
+}
+
+//编码为当前版本的格式
+func encodeBoltRecord(record *boltSourceRecord) []byte {
+	fields := record.fields()
+	bodyLen := len(fields) * BOLT_RECORD_FIELD_LEN
+
+	value := make([]byte, boltRecordHeaderLen+bodyLen+boltRecordChecksumLen)
+	value[0] = BOLT_RECORD_VERSION
+	binary.BigEndian.PutUint16(value[1:boltRecordHeaderLen], uint16(bodyLen))
+
+	for i, field := range fields {
+		offset := boltRecordHeaderLen + i*BOLT_RECORD_FIELD_LEN
+		binary.BigEndian.PutUint64(value[offset:offset+BOLT_RECORD_FIELD_LEN], uint64(field))
+	}
+
+	checksumOffset := boltRecordHeaderLen + bodyLen
+	binary.BigEndian.PutUint32(value[checksumOffset:], crc32.ChecksumIEEE(value[:checksumOffset]))
+
+	return value
+}
+
+//解码记录, 兼容旧版本只有 current_id 的小端格式
+func decodeBoltRecord(value []byte) (*boltSourceRecord, error) {
+	if len(value) == BOLT_LEGACY_VALUE_LEN {
+		return &boltSourceRecord{Version: 0, CurrentId: bytesToInt(value)}, nil
+	}
+
+	if len(value) < boltRecordHeaderLen+boltRecordChecksumLen || value[0] < 1 {
+		return nil, ErrBoltRecordCorrupted
+	}
+
+	bodyLen := int(binary.BigEndian.Uint16(value[1:boltRecordHeaderLen]))
+	checksumOffset := boltRecordHeaderLen + bodyLen
+
+	if len(value) != checksumOffset+boltRecordChecksumLen || bodyLen%BOLT_RECORD_FIELD_LEN != 0 {
+		return nil, ErrBoltRecordCorrupted
+	}
+
+	if crc32.ChecksumIEEE(value[:checksumOffset]) != binary.BigEndian.Uint32(value[checksumOffset:]) {
+		return nil, ErrBoltRecordCorrupted
+	}
+
+	record := &boltSourceRecord{Version: int(value[0])}
+
+	fields := make([]int64, len(record.fields()))
+	for i := range fields {
+		offset := boltRecordHeaderLen + i*BOLT_RECORD_FIELD_LEN
+		if offset+BOLT_RECORD_FIELD_LEN > checksumOffset {
+			break //旧版本的记录没有这个字段
+		}
+
+		fields[i] = int64(binary.BigEndian.Uint64(value[offset : offset+BOLT_RECORD_FIELD_LEN]))
+	}
+
+	record.setFields(fields)
+
+	return record, nil
+}
+
+//读取source 的记录, 不存在时返回nil, 记录损坏时 panic, 和其他持久化错误一致
+func getBoltSourceRecord(bucket *bolt.Bucket, source string) *boltSourceRecord {
+	value := bucket.Get([]byte(source))
+	if value == nil {
+		return nil
+	}
+
+	record, err := decodeBoltRecord(value)
+	if err != nil {
+		panic(err.Error() + ", source: " + source + ", length: " + strconv.Itoa(len(value)))
+	}
+
+	return record
+}
+
+//按当前版本写入, 旧版本的记录写入时自动升级
+func putBoltSourceRecord(bucket *bolt.Bucket, source string, record *boltSourceRecord) {
+	now := time.Now().Unix()
+	if record.CreatedAt == 0 {
+		record.CreatedAt = now
+	}
+	record.UpdatedAt = now
+	record.Version = BOLT_RECORD_VERSION
+
+	checkErr(bucket.Put([]byte(source), encodeBoltRecord(record)))
+}
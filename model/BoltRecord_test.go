@@ -0,0 +1,131 @@
+package model
+
+import (
+	"encoding/binary"
+	"github.com/boltdb/bolt"
+	"hash/crc32"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBoltRecordEncodeDecode(t *testing.T) {
+	record := &boltSourceRecord{CurrentId: 1 << 40, BucketStep: 1000, CreatedAt: 1700000000, UpdatedAt: 1700000100}
+
+	value := encodeBoltRecord(record)
+	if value[0] != BOLT_RECORD_VERSION {
+		t.Fatalf("version: %d", value[0])
+	}
+
+	//大端, 按字节比较时和数值大小一致
+	if binary.BigEndian.Uint64(value[boltRecordHeaderLen:]) != 1<<40 {
+		t.Errorf("current id is not big endian: %v", value)
+	}
+
+	decoded, err := decodeBoltRecord(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record.Version = BOLT_RECORD_VERSION
+	if *decoded != *record {
+		t.Errorf("decoded: %+v, want %+v", decoded, record)
+	}
+
+	//旧版本的小端格式
+	legacy, err := decodeBoltRecord(intToBytes(12345))
+	if err != nil || legacy.Version != 0 || legacy.CurrentId != 12345 || legacy.BucketStep != 0 {
+		t.Errorf("legacy: %+v, %v", legacy, err)
+	}
+
+	//校验失败
+	corrupted := append([]byte(nil), value...)
+	corrupted[5]++
+	if _, err := decodeBoltRecord(corrupted); err != ErrBoltRecordCorrupted {
+		t.Errorf("corrupted record: %v", err)
+	}
+
+	if _, err := decodeBoltRecord(value[:len(value)-1]); err != ErrBoltRecordCorrupted {
+		t.Errorf("truncated record: %v", err)
+	}
+}
+
+//以后的版本在最后追加字段, 当前版本读取时忽略
+func TestBoltRecordDecodeNewerVersion(t *testing.T) {
+	fields := []int64{500, 10, 1700000000, 1700000100, 42}
+	bodyLen := len(fields) * BOLT_RECORD_FIELD_LEN
+
+	value := make([]byte, boltRecordHeaderLen+bodyLen+boltRecordChecksumLen)
+	value[0] = BOLT_RECORD_VERSION + 1
+	binary.BigEndian.PutUint16(value[1:], uint16(bodyLen))
+	for i, field := range fields {
+		binary.BigEndian.PutUint64(value[boltRecordHeaderLen+i*BOLT_RECORD_FIELD_LEN:], uint64(field))
+	}
+	checksumOffset := boltRecordHeaderLen + bodyLen
+	binary.BigEndian.PutUint32(value[checksumOffset:], crc32.ChecksumIEEE(value[:checksumOffset]))
+
+	record, err := decodeBoltRecord(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if record.Version != BOLT_RECORD_VERSION+1 || record.CurrentId != 500 || record.BucketStep != 10 || record.UpdatedAt != 1700000100 {
+		t.Errorf("newer record: %+v", record)
+	}
+}
+
+//旧版本的数据在写入时升级, 步长从旧的 step bucket 中读取
+func TestBoltDbServiceUpgradeLegacyRecord(t *testing.T) {
+	boltDb := initTestBoltDb(t)
+
+	namespace := "upgrade" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	store := NewBoltDbServiceWithNamespace(namespace)
+
+	err := boltDb.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte(store.BucketName)).Put([]byte("order"), intToBytes(300)); err != nil {
+			return err
+		}
+
+		stepBucket, err := tx.CreateBucketIfNotExists([]byte(store.StepBucketName))
+		if err != nil {
+			return err
+		}
+
+		return stepBucket.Put([]byte("order"), intToBytes(30))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if step := store.LoadSourceStep("order"); step != 30 {
+		t.Errorf("legacy step: %d", step)
+	}
+
+	if currentId, maxId := store.IncrSourceCurrentId("order", 100, 20); currentId != 301 || maxId != 320 {
+		t.Errorf("incr legacy: %d, %d", currentId, maxId)
+	}
+
+	if step := store.LoadSourceStep("order"); step != 20 {
+		t.Errorf("upgraded step: %d", step)
+	}
+
+	err = boltDb.View(func(tx *bolt.Tx) error {
+		record, err := decodeBoltRecord(tx.Bucket([]byte(store.BucketName)).Get([]byte("order")))
+		if err != nil {
+			return err
+		}
+
+		if record.Version != BOLT_RECORD_VERSION || record.CurrentId != 320 || record.CreatedAt == 0 || record.UpdatedAt == 0 {
+			t.Errorf("upgraded record: %+v", record)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if currentId := store.LoadCurrentIdFromDb("order", 20); currentId != 320 {
+		t.Errorf("load upgraded: %d", currentId)
+	}
+}
@@ -0,0 +1,197 @@
+package model
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	COMMAND_EXPORT = "export" //导出所有source 已分配的最大值
+	COMMAND_IMPORT = "import" //导入, 只会增大已有的值
+)
+
+//执行 export/import 子命令
+//默认直接打开 bolt.filePath, 需要先停止master; -rpc 时通过运行中master 的rpc 服务导出/导入
+//import -raft 时导入到运行中的集群(cluster 模式), 通过 raft.peers 中 raft.nodeId 的节点提交
+func RunCounterCommand(command string, arguments []string) error {
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	file := flags.String("file", "", "导出/导入的文件")
+	format := flags.String("format", "", "json 或 csv, 默认按文件扩展名, 其他扩展名为 json")
+	useRpc := flags.Bool("rpc", false, "通过运行中master 的rpc 服务导出/导入")
+	useRaft := flags.Bool("raft", false, "导入到运行中的集群(cluster 模式)")
+
+	if err := flags.Parse(arguments); err != nil {
+		return err
+	}
+
+	if *file == "" {
+		return errors.New("缺少 -file 参数")
+	}
+
+	if *format == "" {
+		*format = COUNTER_FORMAT_JSON
+		if strings.EqualFold(filepath.Ext(*file), "."+COUNTER_FORMAT_CSV) {
+			*format = COUNTER_FORMAT_CSV
+		}
+	}
+
+	if *format != COUNTER_FORMAT_JSON && *format != COUNTER_FORMAT_CSV {
+		return errors.New("不识别的格式: " + *format)
+	}
+
+	if *useRaft && command != COMMAND_IMPORT {
+		return errors.New("-raft 只支持 import")
+	}
+
+	switch command {
+	case COMMAND_EXPORT:
+		return exportCounters(*file, *format, *useRpc)
+	case COMMAND_IMPORT:
+		return importCounters(*file, *format, *useRpc, *useRaft)
+	}
+
+	return errors.New("不识别的命令: " + command)
+}
+
+func exportCounters(file string, format string, useRpc bool) error {
+	var counters []*SourceCounter
+	var err error
+
+	if useRpc {
+		client, errClient := newCommandRpcClient()
+		if errClient != nil {
+			return errClient
+		}
+
+		counters, err = client.ExportCounters()
+	} else {
+		boltDb, errBolt := commandBoltDb()
+		if errBolt != nil {
+			return errBolt
+		}
+
+		counters, err = ExportBoltCounters(boltDb)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	//先写临时文件, 避免导出失败时覆盖之前的备份
+	tmpFile := file + ".tmp"
+	writer, err := os.Create(tmpFile)
+	if err != nil {
+		return err
+	}
+
+	if err = WriteSourceCounters(writer, format, counters); err == nil {
+		err = writer.Sync()
+	}
+
+	if errClose := writer.Close(); err == nil {
+		err = errClose
+	}
+
+	if err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+
+	if err = os.Rename(tmpFile, file); err != nil {
+		return err
+	}
+
+	fmt.Printf("exported %d sources to %s\n", len(counters), file)
+
+	return nil
+}
+
+func importCounters(file string, format string, useRpc bool, useRaft bool) error {
+	reader, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	counters, err := ReadSourceCounters(reader, format)
+	if err != nil {
+		return err
+	}
+
+	var result *CounterImportResult
+
+	if useRaft {
+		result, err = importRaftCounters(counters)
+	} else if useRpc {
+		client, errClient := newCommandRpcClient()
+		if errClient != nil {
+			return errClient
+		}
+
+		result, err = client.ImportCounters(counters)
+	} else {
+		boltDb, errBolt := commandBoltDb()
+		if errBolt != nil {
+			return errBolt
+		}
+
+		result, err = ImportBoltCounters(boltDb, counters)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("imported %d sources from %s, created: %d, raised: %d, skipped(已有的值更大): %d\n",
+		len(counters), file, result.Created, result.Raised, result.Skipped)
+
+	return nil
+}
+
+//连接当前配置的raft 节点, 每个source 提交一条 raise 命令
+func importRaftCounters(counters []*SourceCounter) (*CounterImportResult, error) {
+	raftConfig := GetApplication().ConfigData.Raft
+	if raftConfig.NodeId < 1 || raftConfig.NodeId > len(raftConfig.Peers) {
+		return nil, errors.New(fmt.Sprintf("raft nodeId 超出范围: %d", raftConfig.NodeId))
+	}
+
+	client, err := rpc.Dial("tcp", raftConfig.Peers[raftConfig.NodeId-1])
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("连接raft 节点失败: %v", err))
+	}
+	defer client.Close()
+
+	result := new(CounterImportResult)
+	if err := client.Call("RaftRpcService.ImportCounters", counters, result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+//直接打开bolt 文件, master 运行中时会等待文件锁超时
+func commandBoltDb() (*bolt.DB, error) {
+	boltDb, err := GetApplication().GetBoltDB()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("打开 %s 失败, master 运行中时请使用 -rpc: %v", GetApplication().ConfigData.Bolt.FilePath, err))
+	}
+
+	return boltDb, nil
+}
+
+//连接master 的rpc 服务
+func newCommandRpcClient() (client *BoltDbRpcClient, err error) {
+	defer func() {
+		if errRecovered := recover(); errRecovered != nil {
+			err = errors.New(fmt.Sprintf("连接rpc server 失败: %v", errRecovered))
+		}
+	}()
+
+	return &BoltDbRpcClient{NewClient(GetApplication().ConfigData.RpcSeverAddress), ""}, nil
+}
@@ -0,0 +1,383 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"idGenerator/model/logger"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_FAILOVER_SAFETY_MARGIN = 10000 //提升为master 时每个source 在步长之外额外跳过的id 数
+
+	FENCE_RETRY_INTERVAL = 5 * time.Second //通知旧master 的间隔, 直到旧master 确认
+	FENCE_TIMEOUT        = 5 * time.Second //一次通知的连接和读写超时
+)
+
+var replicationEpochKey = []byte("epoch")     //主从切换的代数, slave 每次提升为master 加1, 随全量数据复制到slave
+var replicationFencedKey = []byte("fencedBy") //被哪一代的master 取代, 大于0 时不再修改计数
+
+//旧master 已被提升的slave 取代
+var ErrMasterFenced = errors.New("已有新的master, 当前节点不再分配id")
+
+//master 租约过期, 和所有slave 失去联系
+var ErrMasterLeaseExpired = errors.New("超过 failover.masterLease 没有收到slave 的同步请求, 暂停分配id")
+
+//同一时间只能有一次提升
+var promoteLock sync.Mutex
+
+//提升为master 的结果
+type PromoteResult struct {
+	Epoch        uint64 `json:"epoch"`
+	LogId        string `json:"logId"`
+	Sources      int    `json:"sources"`
+	SafetyMargin int    `json:"safetyMargin"`
+}
+
+//新的master 通知旧master 不再分配id
+type FenceRequest struct {
+	Epoch uint64 `json:"epoch"`
+}
+
+//Epoch 为节点自己的代数 和 取代它的代数 中较大的
+type FenceResponse struct {
+	Epoch  uint64 `json:"epoch"`
+	Fenced bool   `json:"fenced"`
+}
+
+func replicationEpoch(tx *bolt.Tx) uint64 {
+	return replicationMetaUint64(tx, replicationEpochKey)
+}
+
+func failoverSafetyMargin() int {
+	if margin := GetApplication().ConfigData.Failover.SafetyMargin; margin > 0 {
+		return margin
+	}
+
+	return DEFAULT_FAILOVER_SAFETY_MARGIN
+}
+
+//master 租约: 配置了 failover.masterLease 时, 最近 masterLease 秒内有slave 同步过才能发出id
+//和slave 分区后 旧master 在slave 自动提升(failover.timeout) 之前停止分配, 之前发出的id 由提升时跳过的 safetyMargin 覆盖
+func checkMasterLease() error {
+	application := GetApplication()
+
+	lease := int64(application.ConfigData.Failover.MasterLease)
+	if lease <= 0 || application.currentRole() != SERVER_MASTER {
+		return nil
+	}
+
+	if time.Now().Unix()-GetSlaveRegistry().lastAckedAt() >= lease {
+		return ErrMasterLeaseExpired
+	}
+
+	return nil
+}
+
+//已被取代的master 持久化号段时 panic ErrMasterFenced, 转成错误返回给调用方, 其他的继续 panic
+func recoverMasterFenced(errRecovered interface{}) error {
+	if errRecovered == nil {
+		return nil
+	}
+
+	if errRecovered == ErrMasterFenced {
+		return ErrMasterFenced
+	}
+
+	panic(errRecovered)
+}
+
+//自动提升要求master 开启了租约, 并且在slave 提升之前过期
+func failoverAutoPromoteAllowed(timeout int, masterLease int) bool {
+	return timeout > 0 && masterLease > 0 && masterLease < timeout
+}
+
+//提升后监听的地址, 没有配置时使用原来master 地址的端口
+func failoverListenAddress(address string, masterAddress string) string {
+	if address != "" {
+		return address
+	}
+
+	_, port, err := net.SplitHostPort(masterAddress)
+	CheckErr(err)
+
+	return ":" + port
+}
+
+//把slave 的数据改为master 的数据, 在一个写事务中完成:
+//每个source 跳过 步长 + safetyMargin 个id, 覆盖master 已分配但还没有同步过来的号段;
+//清空同步日志并生成新的日志标识, 其他slave 会重新全量同步; 代数加1
+func PromoteBoltDb(boltDb *bolt.DB, safetyMargin int) (result *PromoteResult, err error) {
+	defer func() {
+		if errRecovered := recover(); errRecovered != nil {
+			result = nil
+			err = errors.New(fmt.Sprintf("%v", errRecovered))
+		}
+	}()
+
+	baseBucketName := boltBaseBucketName()
+	result = &PromoteResult{SafetyMargin: safetyMargin}
+
+	err = boltDb.Update(func(tx *bolt.Tx) error {
+		if logId, _ := replicationState(tx); logId == "" {
+			return errors.New("还没有从master 同步过数据, 不能提升为master")
+		}
+
+		//先找出号段bucket, 遍历时不能修改
+		bucketNames := make([]string, 0)
+		tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			if _, ok := boltBucketNamespace(baseBucketName, string(name)); ok {
+				bucketNames = append(bucketNames, string(name))
+			}
+
+			return nil
+		})
+
+		for _, bucketName := range bucketNames {
+			bucket := tx.Bucket([]byte(bucketName))
+
+			sources := make([]string, 0)
+			bucket.ForEach(func(key []byte, value []byte) error {
+				sources = append(sources, string(key))
+				return nil
+			})
+
+			for _, source := range sources {
+				record := getBoltSourceRecord(bucket, source)
+				record.CurrentId += record.BucketStep + safetyMargin
+				putBoltSourceRecord(bucket, source, record)
+
+				result.Sources++
+			}
+		}
+
+		if err := tx.DeleteBucket([]byte(REPLICATION_LOG_BUCKET_NAME)); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+
+		epoch := replicationEpoch(tx)
+		if fencedBy := replicationMetaUint64(tx, replicationFencedKey); fencedBy > epoch {
+			epoch = fencedBy
+		}
+		result.Epoch = epoch + 1
+
+		meta := tx.Bucket([]byte(REPLICATION_META_BUCKET_NAME))
+		for _, key := range [][]byte{replicationLogIdKey, replicationTxIdKey, replicationFencedKey} {
+			if err := meta.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		logId, err := ensureReplicationLogId(tx)
+		if err != nil {
+			return err
+		}
+		result.LogId = logId
+
+		return putReplicationMetaUint64(tx, replicationEpochKey, result.Epoch)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+//收到更高代数的master 的通知时 记录下来, 之后不再修改计数; epoch 为0 时只读取状态
+func FenceBoltDb(boltDb *bolt.DB, epoch uint64) (*FenceResponse, error) {
+	response := new(FenceResponse)
+
+	fenceState := func(tx *bolt.Tx) (update bool) {
+		ownEpoch, fencedBy := replicationEpoch(tx), replicationMetaUint64(tx, replicationFencedKey)
+
+		response.Epoch = ownEpoch
+		if fencedBy > ownEpoch {
+			response.Epoch = fencedBy
+		}
+		response.Fenced = fencedBy > 0
+
+		return epoch > ownEpoch && epoch > fencedBy
+	}
+
+	update := false
+	err := boltDb.View(func(tx *bolt.Tx) error {
+		update = fenceState(tx)
+		return nil
+	})
+
+	if err != nil || !update {
+		return response, err
+	}
+
+	err = boltDb.Update(func(tx *bolt.Tx) error {
+		if !fenceState(tx) {
+			return nil
+		}
+
+		response.Epoch = epoch
+		response.Fenced = true
+
+		return putReplicationMetaUint64(tx, replicationFencedKey, epoch)
+	})
+
+	return response, err
+}
+
+//master 收到通知 或 slave 的同步请求中带了更高的代数时, 停止分配id
+func fenceMaster(epoch uint64) (*FenceResponse, error) {
+	boltDb, errGetBolt := GetApplication().GetBoltDB()
+	if errGetBolt != nil {
+		return nil, errors.New(fmt.Sprintf("%#v", errGetBolt))
+	}
+
+	response, err := FenceBoltDb(boltDb, epoch)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.Fenced && response.Epoch == epoch {
+		//丢弃已加载的内存号段, 不再发出id
+		GetAutoIncrIdWorker().clearStorages()
+		logger.AsyncInfo(fmt.Sprintf("已被第 %d 代master 取代, 停止分配id", epoch))
+	}
+
+	return response, nil
+}
+
+//slave 提升为master: 停止主从同步, 以读写方式使用同步过来的数据文件, 启动master 的服务, 并通知旧master
+func (application *Application) PromoteToMaster(reason string) (*PromoteResult, error) {
+	promoteLock.Lock()
+	defer promoteLock.Unlock()
+
+	if currentPersistType() != PERSIST_TYPE_RPC {
+		return nil, errors.New("只有使用boltdb 的slave 可以提升为master")
+	}
+
+	boltDb, errGetBolt := application.GetBoltDB()
+	if errGetBolt != nil {
+		return nil, errors.New(fmt.Sprintf("打开数据文件失败: %v", errGetBolt))
+	}
+
+	if state, err := ReplicationState(boltDb); err != nil || state.LogId == "" {
+		return nil, errors.New(fmt.Sprintf("还没有从master 同步过数据, 不能提升为master, %v", err))
+	}
+
+	//先停止同步, 之后不会再写入master 的数据
+	for _, client := range []*Client{application.DataBackUpSocketClient, application.RpcSocketClient} {
+		if client != nil {
+			client.Stop()
+		}
+	}
+
+	result, err := PromoteBoltDb(boltDb, failoverSafetyMargin())
+	if err != nil {
+		logger.AsyncInfo(fmt.Sprintf("提升为master 失败, 主从同步已停止, 可以重试: %v", err))
+		return nil, err
+	}
+
+	application.Role = SERVER_MASTER
+	GetAutoIncrIdWorker().switchPersistType(currentPersistType())
+
+	masterAddress := application.ConfigData.MasterAddress
+	application.startDataBackUpServer(failoverListenAddress(application.ConfigData.Failover.DataBackUpAddress, masterAddress))
+	application.startRpcServer(failoverListenAddress(application.ConfigData.Failover.RpcAddress, application.ConfigData.RpcSeverAddress))
+
+	go application.fenceOldMaster(masterAddress, result.Epoch)
+
+	logger.AsyncInfo(fmt.Sprintf("slave 已提升为master, reason: %s, result: %+v", reason, result))
+
+	return result, nil
+}
+
+//和master 断开超过 failover.timeout 秒时 自动提升为master
+//只凭超时无法区分master 宕机和网络分区, 所以要求 master 租约在 timeout 之前过期, 否则不自动提升
+func (application *Application) StartFailoverWatcher() {
+	failover := application.ConfigData.Failover
+	timeout := int64(failover.Timeout)
+	client := application.DataBackUpSocketClient
+	if timeout <= 0 || client == nil {
+		return
+	}
+
+	if !failoverAutoPromoteAllowed(failover.Timeout, failover.MasterLease) {
+		logger.AsyncInfo(fmt.Sprintf("failover.masterLease(%d) 需要大于0 并小于 failover.timeout(%d), 否则网络分区时新旧master 同时分配id, 不自动提升",
+			failover.MasterLease, failover.Timeout))
+		return
+	}
+
+	go func() {
+		for {
+			time.Sleep(1 * time.Second)
+
+			inactive := time.Now().Unix() - client.getLastReceivedTs()
+			if inactive <= timeout {
+				continue
+			}
+
+			_, err := application.PromoteToMaster(fmt.Sprintf("master 已 %d 秒没有响应", inactive))
+			if err == nil {
+				return
+			}
+
+			logger.AsyncInfo(fmt.Sprintf("自动提升为master 失败: %v", err))
+			time.Sleep(time.Duration(timeout) * time.Second)
+		}
+	}()
+}
+
+//旧master 恢复后通知它停止分配id, 直到旧master 确认
+func (application *Application) fenceOldMaster(address string, epoch uint64) {
+	for {
+		response, err := sendFenceRequest(address, epoch)
+		if err == nil && response.Epoch >= epoch {
+			logger.AsyncInfo(fmt.Sprintf("旧master 已停止分配id, address: %s, response: %+v", address, response))
+			return
+		}
+
+		time.Sleep(FENCE_RETRY_INTERVAL)
+	}
+}
+
+func sendFenceRequest(address string, epoch uint64) (response *FenceResponse, err error) {
+	defer func() {
+		if errRecovered := recover(); errRecovered != nil {
+			response = nil
+			err = errors.New(fmt.Sprintf("%v", errRecovered))
+		}
+	}()
+
+	connection, err := net.DialTimeout("tcp", address, FENCE_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+
+	connection.SetDeadline(time.Now().Add(FENCE_TIMEOUT))
+	context := &Context{connection, time.Now().Unix(), new(sync.Mutex), nil, nil}
+
+	encodedRequest, err := json.Marshal(&FenceRequest{Epoch: epoch})
+	if err != nil {
+		return nil, err
+	}
+
+	requestPackage := NewBackupPackage(ACTION_FENCE)
+	requestPackage.encodeData(encodedRequest)
+	if _, err = context.writePackage(requestPackage); err != nil {
+		return nil, err
+	}
+
+	for {
+		dataPackage := GetDecodedPackageData(context.getReader(), connection)
+		if dataPackage.ActionType != ACTION_FENCE {
+			continue
+		}
+
+		response = new(FenceResponse)
+		return response, json.Unmarshal(dataPackage.Data, response)
+	}
+}
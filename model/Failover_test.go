@@ -0,0 +1,242 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"idGenerator/model/cmap"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+//在一个写事务中追加同步日志, 返回 panic 的错误
+func appendTestReplicationLog(boltDb *bolt.DB) (err error) {
+	defer func() {
+		if errRecovered := recover(); errRecovered != nil {
+			err = errors.New(fmt.Sprintf("%v", errRecovered))
+		}
+	}()
+
+	return boltDb.Update(func(tx *bolt.Tx) error {
+		appendReplicationLog(tx, &ReplicationLogEntry{Source: "fence", CurrentId: 1, BucketStep: 1})
+		return nil
+	})
+}
+
+func TestPromoteBoltDb(t *testing.T) {
+	master := initTestBoltDb(t)
+
+	namespace := "promote" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	store := NewBoltDbServiceWithNamespace(namespace)
+	store.LoadCurrentIdFromDb("order", 10)
+
+	masterState, _ := ReplicationState(master)
+
+	slave := newTestSlaveBoltDb(t, master)
+	defer slave.Close()
+
+	otherSlave := newTestSlaveBoltDb(t, master)
+	defer otherSlave.Close()
+
+	result, err := PromoteBoltDb(slave, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Epoch != masterState.Epoch+1 || result.LogId == "" || result.LogId == masterState.LogId || result.Sources < 1 {
+		t.Errorf("result: %+v, master: %+v", result, masterState)
+	}
+
+	//跳过 步长 + safetyMargin
+	if currentId := slaveCurrentId(t, slave, namespace, "order"); currentId != 10+10+100 {
+		t.Errorf("promoted current id: %d", currentId)
+	}
+
+	state, _ := ReplicationState(slave)
+	if state.LogId != result.LogId || state.Seq != 0 || state.Epoch != result.Epoch || state.TxId != 0 {
+		t.Errorf("promoted state: %+v", state)
+	}
+
+	//从旧master 同步的slave 需要重新全量同步
+	otherState, _ := ReplicationState(otherSlave)
+	if _, err := ReadReplicationLog(slave, otherState.LogId, otherState.Seq, 10); err != ErrReplicationSnapshotRequired {
+		t.Errorf("other slave: %v", err)
+	}
+
+	//提升后可以继续写日志
+	if err := appendTestReplicationLog(slave); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPromoteBoltDbWithoutData(t *testing.T) {
+	boltDb, err := bolt.Open(filepath.Join(t.TempDir(), "empty.db"), 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer boltDb.Close()
+
+	if _, err := PromoteBoltDb(boltDb, 100); err == nil {
+		t.Error("promoted without replicated data")
+	}
+}
+
+func TestFenceBoltDb(t *testing.T) {
+	master := initTestBoltDb(t)
+	NewBoltDbServiceWithNamespace("fence").LoadCurrentIdFromDb("order", 1)
+
+	//用复制的数据文件模拟旧master
+	oldMaster := newTestSlaveBoltDb(t, master)
+	defer oldMaster.Close()
+
+	response, err := FenceBoltDb(oldMaster, 0)
+	if err != nil || response.Fenced {
+		t.Fatalf("state: %+v, %v", response, err)
+	}
+
+	response, err = FenceBoltDb(oldMaster, 2)
+	if err != nil || !response.Fenced || response.Epoch != 2 {
+		t.Fatalf("fence: %+v, %v", response, err)
+	}
+
+	//更低的代数不会覆盖
+	response, _ = FenceBoltDb(oldMaster, 1)
+	if !response.Fenced || response.Epoch != 2 {
+		t.Errorf("lower epoch: %+v", response)
+	}
+
+	if err := appendTestReplicationLog(oldMaster); err == nil || err.Error() != ErrMasterFenced.Error() {
+		t.Errorf("fenced master appended log: %v", err)
+	}
+
+	//再次提升时 代数大于取代它的代数
+	result, err := PromoteBoltDb(oldMaster, 0)
+	if err != nil || result.Epoch != 3 {
+		t.Fatalf("promote fenced: %+v, %v", result, err)
+	}
+
+	if response, _ := FenceBoltDb(oldMaster, 0); response.Fenced || response.Epoch != 3 {
+		t.Errorf("after promote: %+v", response)
+	}
+}
+
+//热加载配置文件不改变运行时的角色 和 slave 的数据文件
+func TestReloadConfigKeepsRole(t *testing.T) {
+	application := GetApplication()
+
+	configData, role := application.ConfigData, application.Role
+	defer func() { application.ConfigData, application.Role = configData, role }()
+
+	configFile := filepath.Join(t.TempDir(), "reload.toml")
+	content := "serverType=\"master\"\npersistType=\"boltdb\"\n[bolt]\nfilePath=\"./data/bolt_kv.db\"\n"
+	if err := ioutil.WriteFile(configFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	application.Role = SERVER_SLAVE
+	application.ConfigData.PersistType = PERSIST_TYPE_BOLTDB
+	application.ConfigData.Bolt.FilePath = "./data/bolt_kv.db.backup"
+
+	application.reloadConfig(configFile)
+
+	if persistType := currentPersistType(); persistType != PERSIST_TYPE_RPC {
+		t.Errorf("slave persist type after reload: %s", persistType)
+	}
+	if filePath := application.ConfigData.Bolt.FilePath; filePath != "./data/bolt_kv.db.backup" {
+		t.Errorf("file path after reload: %s", filePath)
+	}
+
+	//提升为master 后 热加载仍然是master
+	application.Role = SERVER_MASTER
+	application.reloadConfig(configFile)
+
+	if persistType := currentPersistType(); persistType != PERSIST_TYPE_BOLTDB {
+		t.Errorf("promoted persist type after reload: %s", persistType)
+	}
+}
+
+//已被取代的master 持久化时 panic ErrMasterFenced
+type fencedSegmentStore struct {
+	*memorySegmentStore
+}
+
+func (store *fencedSegmentStore) LoadCurrentIdFromDb(source string, bucketStep int) int {
+	panic(ErrMasterFenced)
+}
+
+//master 租约: 最近 masterLease 秒内没有slave 同步时 不再发出id; 已被取代的master 返回错误 而不是 panic
+func TestMasterLeaseAndFencedErrors(t *testing.T) {
+	application := GetApplication()
+	configData, role := application.ConfigData, application.Role
+	registry := GetSlaveRegistry()
+	defer func() {
+		application.ConfigData, application.Role = configData, role
+		slaveRegistryInstance = registry
+	}()
+
+	slaveRegistryInstance = newSlaveRegistry()
+	application.Role = SERVER_MASTER
+	application.ConfigData.BucketStep = 10
+	application.ConfigData.Failover.MasterLease = 10
+
+	setTestSegmentStore("lease_memory", newMemorySegmentStore())
+	application.ConfigData.PersistType = "lease_memory"
+	worker := &AutoIncrIdWorker{WorkerMap: cmap.New(), PersistType: "lease_memory"}
+
+	//还没有slave 同步过
+	if _, err := worker.NextId("", "order"); err != ErrMasterLeaseExpired {
+		t.Fatalf("no slave: %v", err)
+	}
+
+	context := newTestSlaveContext(t)
+	slaveRegistryInstance.ack(context, &ReplicationSyncRequest{SlaveId: "a"})
+
+	if id, err := worker.NextId("", "order"); err != nil || id != 1 {
+		t.Fatalf("lease valid: %d, %v", id, err)
+	}
+
+	//slave 超过租约没有同步, 已加载的号段也不再发出
+	slaveRegistryInstance.lock.Lock()
+	slaveRegistryInstance.slaves["a"].status.AckedAt -= 10
+	slaveRegistryInstance.lock.Unlock()
+
+	if _, err := worker.NextIds("", "order", 2); err != ErrMasterLeaseExpired {
+		t.Fatalf("lease expired: %v", err)
+	}
+
+	//slave 不受租约限制
+	application.Role = SERVER_SLAVE
+	if checkMasterLease() != nil {
+		t.Error("lease checked on slave")
+	}
+
+	application.Role = SERVER_MASTER
+	application.ConfigData.Failover.MasterLease = 0
+
+	setTestSegmentStore("fenced_memory", &fencedSegmentStore{newMemorySegmentStore()})
+	application.ConfigData.PersistType = "fenced_memory"
+	worker = &AutoIncrIdWorker{WorkerMap: cmap.New(), PersistType: "fenced_memory"}
+
+	if _, err := worker.NextId("", "order"); err != ErrMasterFenced {
+		t.Errorf("fenced next id: %v", err)
+	}
+
+	if _, err := worker.NextIds("", "order", 3); err != ErrMasterFenced {
+		t.Errorf("fenced next ids: %v", err)
+	}
+
+	//租约需要在slave 自动提升之前过期
+	cases := []struct {
+		timeout, lease int
+		allowed        bool
+	}{{0, 0, false}, {30, 0, false}, {30, 30, false}, {30, 40, false}, {30, 10, true}}
+
+	for _, c := range cases {
+		if allowed := failoverAutoPromoteAllowed(c.timeout, c.lease); allowed != c.allowed {
+			t.Errorf("timeout: %d, lease: %d, allowed: %v", c.timeout, c.lease, allowed)
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"idGenerator/model/logger"
+)
+
+const (
+	SEGMENT_PREFETCH_PERCENT = 20 //当前号段使用超过这个百分比时, 后台预加载下一个号段
+
+	DEFAULT_BUCKET_STEP_TARGET_TS = 900 //自适应步长时 一个号段期望的使用时长 单位秒
+)
+
+//持久化一个号段, 参数为期望的起始id 和步长, 返回实际的起始id 和新的最大id(不可用)
+type segmentIncrFunc func(currentId int, bucketStep int) (int, int)
+
+//source 第一次使用时从持久化层加载, 返回 currentId, 步长
+type segmentLoadFunc func() (int, int)
+
+//每个source 在内存中的号段, 双buffer: 当前号段 + 预加载的下一个号段
+type singleStorage struct {
+	CurrentId    int //最近一次发出的id
+	CurrentMaxId int //当前号段的上界, 可用id 为 (CurrentId, CurrentMaxId)
+
+	segmentStart int //当前号段的起始, 用于计算使用比例
+
+	loaded bool //是否已从持久化层加载
+
+	step       int   //当前的步长, 开启自适应时会根据号段的使用速度调整
+	fixedStep  int   //source 配置中指定的步长, 大于0 时不再自适应
+	lastLoadTs int64 //上一次加载号段的时间戳
+
+	hasNext       bool
+	nextCurrentId int
+	nextMaxId     int
+
+	loading  bool
+	loadDone chan bool //预加载完成时关闭
+
+	now func() int64 //当前时间戳 单位秒, 测试时可替换
+
+	lock *sync.Mutex
+}
+
+//未加载的号段, 第一次使用时通过 ensureLoaded 加载
+func newSingleStorage() *singleStorage {
+	return &singleStorage{
+		now:  currentTimeSeconds,
+		lock: new(sync.Mutex),
+	}
+}
+
+func currentTimeSeconds() int64 {
+	return time.Now().Unix()
+}
+
+//第一次使用时加载, 调用方需要持有锁
+func (storage *singleStorage) ensureLoaded(loadFunc segmentLoadFunc) {
+	if storage.loaded {
+		return
+	}
+
+	currentId, bucketStep := loadFunc()
+
+	storage.CurrentId = currentId
+	storage.CurrentMaxId = currentId + bucketStep
+	storage.segmentStart = currentId
+	storage.step = bucketStep
+	storage.lastLoadTs = storage.now()
+	storage.loaded = true
+}
+
+//使用source 配置: 固定步长, 当前id 小于起始id 时直接跳到起始id, 调用方需要持有锁
+func (storage *singleStorage) applySourceConfig(sourceConfig *SourceConfig, incrFunc segmentIncrFunc) {
+	if sourceConfig == nil {
+		storage.fixedStep = 0
+		return
+	}
+
+	storage.fixedStep = sourceConfig.BucketStep
+
+	if sourceConfig.StartId <= storage.CurrentId+1 {
+		return
+	}
+
+	//等待期间可能已经被其他请求跳到起始id
+	storage.waitLoading()
+	if sourceConfig.StartId <= storage.CurrentId+1 {
+		return
+	}
+
+	storage.hasNext = false
+
+	newCurrentId, newMaxId := incrFunc(sourceConfig.StartId, storage.nextSegmentStep())
+
+	storage.CurrentId = newCurrentId - 1
+	storage.CurrentMaxId = newMaxId
+	storage.segmentStart = storage.CurrentId
+}
+
+//source 配置了最大id 时 剩余可用的数量, -1 表示不限制
+func (storage *singleStorage) leftCountToMax(sourceConfig *SourceConfig) int {
+	if sourceConfig == nil || sourceConfig.MaxId < 1 {
+		return -1
+	}
+
+	if sourceConfig.MaxId <= storage.CurrentId {
+		return 0
+	}
+
+	return sourceConfig.MaxId - storage.CurrentId
+}
+
+//获取下一个id
+func (storage *singleStorage) nextId(sourceConfig *SourceConfig, loadFunc segmentLoadFunc, incrFunc segmentIncrFunc) (int, error) {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	storage.ensureLoaded(loadFunc)
+	storage.applySourceConfig(sourceConfig, incrFunc)
+
+	if storage.leftCountToMax(sourceConfig) == 0 {
+		return 0, errors.New("已达到source 的最大id")
+	}
+
+	if storage.CurrentId+1 >= storage.CurrentMaxId {
+		storage.switchSegment(incrFunc)
+
+		if storage.leftCountToMax(sourceConfig) == 0 {
+			return 0, errors.New("已达到source 的最大id")
+		}
+	}
+
+	storage.CurrentId = storage.CurrentId + 1
+
+	storage.prefetch(incrFunc)
+
+	return storage.CurrentId, nil
+}
+
+//批量获取 count 个id, 当前号段和预加载号段都不够, 且剩余数量超过一个号段时 单独持久化剩余的id
+func (storage *singleStorage) nextIds(sourceConfig *SourceConfig, count int, loadFunc segmentLoadFunc, incrFunc segmentIncrFunc) ([]IdRange, error) {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	storage.ensureLoaded(loadFunc)
+	storage.applySourceConfig(sourceConfig, incrFunc)
+
+	if leftToMax := storage.leftCountToMax(sourceConfig); leftToMax >= 0 && leftToMax < count {
+		return nil, errors.New("剩余id 数量不足, 超过source 的最大id")
+	}
+
+	var result []IdRange
+
+	for count > 0 {
+		//当前号段剩余可用的id
+		leftCount := storage.CurrentMaxId - 1 - storage.CurrentId
+		if leftCount > count {
+			leftCount = count
+		}
+
+		if leftToMax := storage.leftCountToMax(sourceConfig); leftToMax == 0 {
+			return nil, errors.New("已达到source 的最大id")
+		} else if leftToMax > 0 && leftCount > leftToMax {
+			leftCount = leftToMax
+		}
+
+		if leftCount > 0 {
+			result = appendIdRange(result, storage.CurrentId+1, storage.CurrentId+leftCount)
+			storage.CurrentId = storage.CurrentId + leftCount
+			count = count - leftCount
+			continue
+		}
+
+		//等待期间其他请求可能已经切换了号段, 重新计算剩余
+		storage.waitLoading()
+		if storage.CurrentId+1 < storage.CurrentMaxId {
+			continue
+		}
+
+		if storage.hasNext {
+			storage.useNextSegment()
+			continue
+		}
+
+		//剩余数量不超过一个号段时 正常加载号段
+		bucketStep := storage.nextSegmentStep()
+		if count <= bucketStep {
+			newCurrentId, newMaxId := incrFunc(storage.CurrentId+1, bucketStep)
+
+			storage.CurrentId = newCurrentId - 1
+			storage.CurrentMaxId = newMaxId
+			storage.segmentStart = storage.CurrentId
+			continue
+		}
+
+		//超过一个号段时 单独持久化这批id, 再加载正常步长的号段, 持久化的步长不会被批量的数量放大
+		newCurrentId, newMaxId := incrFunc(storage.CurrentId+1, count)
+
+		lastId := newCurrentId + count - 1
+		if sourceConfig != nil && sourceConfig.MaxId > 0 && lastId > sourceConfig.MaxId {
+			storage.CurrentId = newCurrentId - 1
+			storage.CurrentMaxId = newMaxId
+			storage.segmentStart = storage.CurrentId
+
+			return nil, errors.New("剩余id 数量不足, 超过source 的最大id")
+		}
+
+		result = appendIdRange(result, newCurrentId, lastId)
+
+		newCurrentId, newMaxId = incrFunc(lastId+1, bucketStep)
+
+		storage.CurrentId = newCurrentId - 1
+		storage.CurrentMaxId = newMaxId
+		storage.segmentStart = storage.CurrentId
+		count = 0
+	}
+
+	storage.prefetch(incrFunc)
+
+	return result, nil
+}
+
+//当前号段用完, 切换到下一个号段, 没有预加载好的就同步加载
+func (storage *singleStorage) switchSegment(incrFunc segmentIncrFunc) {
+	//等待期间其他请求可能已经切换到了预加载的号段
+	storage.waitLoading()
+	if storage.CurrentId+1 < storage.CurrentMaxId {
+		return
+	}
+
+	if storage.hasNext {
+		storage.useNextSegment()
+		return
+	}
+
+	newCurrentId, newMaxId := incrFunc(storage.CurrentId+1, storage.nextSegmentStep())
+
+	storage.CurrentId = newCurrentId - 1
+	storage.CurrentMaxId = newMaxId
+	storage.segmentStart = storage.CurrentId
+}
+
+func (storage *singleStorage) useNextSegment() {
+	storage.CurrentId = storage.nextCurrentId
+	storage.CurrentMaxId = storage.nextMaxId
+	storage.segmentStart = storage.nextCurrentId
+	storage.hasNext = false
+}
+
+//等待正在进行的预加载完成, 调用方需要持有锁, 等待时会释放锁, 返回后需要重新检查号段
+func (storage *singleStorage) waitLoading() {
+	for storage.loading {
+		loadDone := storage.loadDone
+
+		storage.lock.Unlock()
+		<-loadDone
+		storage.lock.Lock()
+	}
+}
+
+//当前号段使用超过一定比例时 后台预加载下一个号段, 调用方需要持有锁
+func (storage *singleStorage) prefetch(incrFunc segmentIncrFunc) {
+	if storage.hasNext || storage.loading {
+		return
+	}
+
+	segmentSize := storage.CurrentMaxId - storage.segmentStart
+	used := storage.CurrentId - storage.segmentStart
+	if segmentSize < 1 || used*100 < segmentSize*SEGMENT_PREFETCH_PERCENT {
+		return
+	}
+
+	storage.loading = true
+	storage.loadDone = make(chan bool)
+	nextStart := storage.CurrentMaxId
+	bucketStep := storage.nextSegmentStep()
+
+	go func() {
+		var newCurrentId, newMaxId int
+		var loaded bool
+
+		defer func() {
+			err := recover()
+			if err != nil {
+				logger.AsyncInfo(fmt.Sprintf("预加载号段异常, %#v", err))
+			}
+
+			storage.lock.Lock()
+			if loaded {
+				storage.hasNext = true
+				storage.nextCurrentId = newCurrentId - 1
+				storage.nextMaxId = newMaxId
+			}
+			storage.loading = false
+			close(storage.loadDone)
+			storage.lock.Unlock()
+		}()
+
+		newCurrentId, newMaxId = incrFunc(nextStart, bucketStep)
+		loaded = true
+	}()
+}
+
+//加载新号段前 根据上一个号段的使用时长调整步长, 调用方需要持有锁
+func (storage *singleStorage) nextSegmentStep() int {
+	if storage.fixedStep > 0 {
+		return storage.fixedStep
+	}
+
+	now := storage.now()
+	duration := now - storage.lastLoadTs
+	storage.lastLoadTs = now
+
+	newStep := adaptBucketStep(storage.step, duration)
+	if newStep != storage.step {
+		logger.AsyncInfo(fmt.Sprintf("号段步长调整: %d => %d, 上一号段使用时长: %ds", storage.step, newStep, duration))
+	}
+
+	storage.step = newStep
+
+	return storage.step
+}
+
+//是否开启了自适应步长
+func isAdaptiveBucketStep() bool {
+	configData := GetApplication().ConfigData
+
+	return configData.MinBucketStep > 0 && configData.MaxBucketStep >= configData.MinBucketStep
+}
+
+//source 初次加载时的步长, 优先使用上次持久化的步长
+func initialBucketStep(storedStep int) int {
+	configData := GetApplication().ConfigData
+
+	if !isAdaptiveBucketStep() {
+		return configData.BucketStep
+	}
+
+	step := configData.BucketStep
+	if storedStep > 0 {
+		step = storedStep
+	}
+
+	return clampBucketStep(step)
+}
+
+//号段使用时长小于期望值 步长翻倍, 超过两倍期望值 步长减半
+func adaptBucketStep(step int, duration int64) int {
+	configData := GetApplication().ConfigData
+
+	if !isAdaptiveBucketStep() {
+		return configData.BucketStep
+	}
+
+	targetTs := int64(configData.BucketStepTargetTs)
+	if targetTs < 1 {
+		targetTs = DEFAULT_BUCKET_STEP_TARGET_TS
+	}
+
+	switch {
+	case duration < targetTs:
+		step = step * 2
+	case duration >= targetTs*2:
+		step = step / 2
+	}
+
+	return clampBucketStep(step)
+}
+
+func clampBucketStep(step int) int {
+	configData := GetApplication().ConfigData
+
+	if step < configData.MinBucketStep {
+		return configData.MinBucketStep
+	}
+
+	if step > configData.MaxBucketStep {
+		return configData.MaxBucketStep
+	}
+
+	return step
+}
+
+//追加一段id, 和上一段连续时合并
+func appendIdRange(result []IdRange, firstId int, lastId int) []IdRange {
+	if len(result) > 0 && result[len(result)-1].LastId+1 == firstId {
+		result[len(result)-1].LastId = lastId
+		return result
+	}
+
+	return append(result, IdRange{firstId, lastId})
+}
@@ -0,0 +1,340 @@
+package model
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+//记录加载次数的持久化层, block 不为nil 时 IncrSourceCurrentId 开始后等待 block 关闭
+type countingSegmentStore struct {
+	*memorySegmentStore
+
+	lock      sync.Mutex
+	incrCount int
+	incrSteps []int
+	started   chan bool
+	block     chan bool
+}
+
+func newCountingSegmentStore() *countingSegmentStore {
+	return &countingSegmentStore{memorySegmentStore: newMemorySegmentStore(), started: make(chan bool, 100)}
+}
+
+func (store *countingSegmentStore) IncrSourceCurrentId(source string, currentId int, bucketStep int) (int, int) {
+	store.lock.Lock()
+	store.incrCount++
+	store.incrSteps = append(store.incrSteps, bucketStep)
+	block := store.block
+	store.lock.Unlock()
+
+	store.started <- true
+	if block != nil {
+		<-block
+	}
+
+	return store.memorySegmentStore.IncrSourceCurrentId(source, currentId, bucketStep)
+}
+
+func (store *countingSegmentStore) counts() (int, int) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	return store.loadCount["source"], store.incrCount
+}
+
+func (store *countingSegmentStore) funcs(bucketStep int) (segmentLoadFunc, segmentIncrFunc) {
+	loadFunc := func() (int, int) {
+		return store.LoadCurrentIdFromDb("source", bucketStep), bucketStep
+	}
+
+	incrFunc := func(currentId int, bucketStep int) (int, int) {
+		return store.IncrSourceCurrentId("source", currentId, bucketStep)
+	}
+
+	return loadFunc, incrFunc
+}
+
+//测试中修改的全局配置, 结束后恢复
+func setTestBucketStepConfig(t *testing.T, bucketStep int, minBucketStep int, maxBucketStep int, targetTs int) {
+	configData := &GetApplication().ConfigData
+	old := [4]int{configData.BucketStep, configData.MinBucketStep, configData.MaxBucketStep, configData.BucketStepTargetTs}
+
+	configData.BucketStep, configData.MinBucketStep, configData.MaxBucketStep, configData.BucketStepTargetTs =
+		bucketStep, minBucketStep, maxBucketStep, targetTs
+
+	t.Cleanup(func() {
+		configData.BucketStep, configData.MinBucketStep, configData.MaxBucketStep, configData.BucketStepTargetTs =
+			old[0], old[1], old[2], old[3]
+	})
+}
+
+//使用超过 SEGMENT_PREFETCH_PERCENT 后在后台加载下一个号段, 加载期间当前号段继续发号, 切换后id 连续不重复
+func TestSingleStoragePrefetch(t *testing.T) {
+	setTestBucketStepConfig(t, 10, 0, 0, 0)
+
+	store := newCountingSegmentStore()
+	store.block = make(chan bool)
+	loadFunc, incrFunc := store.funcs(10)
+
+	storage := newSingleStorage()
+	var ids []int
+
+	next := func() int {
+		id, err := storage.nextId(nil, loadFunc, incrFunc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return id
+	}
+
+	//第一个号段 (0, 10), 使用2个后开始预加载
+	ids = append(ids, next(), next())
+
+	select {
+	case <-store.started:
+	case <-time.After(time.Second):
+		t.Fatal("prefetch not started")
+	}
+
+	//预加载阻塞时 当前号段的id 不受影响
+	for len(ids) < 9 {
+		ids = append(ids, next())
+	}
+
+	if loadCount, incrCount := store.counts(); loadCount != 1 || incrCount != 1 {
+		t.Fatalf("load: %d, incr: %d", loadCount, incrCount)
+	}
+
+	//当前号段用完, 等待预加载完成后切换, 不会再同步加载
+	result := make(chan int)
+	go func() {
+		result <- next()
+	}()
+
+	select {
+	case id := <-result:
+		t.Fatalf("got %d before prefetch finished", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(store.block)
+	ids = append(ids, <-result)
+
+	for len(ids) < 100 {
+		ids = append(ids, next())
+	}
+
+	for i, id := range ids {
+		if id != i+1 {
+			t.Fatalf("id at %d: %d, ids: %v", i, id, ids)
+		}
+	}
+
+	//每个号段只持久化一次
+	storage.lock.Lock()
+	storage.waitLoading()
+	storage.lock.Unlock()
+
+	if _, incrCount := store.counts(); incrCount != 10 {
+		t.Fatalf("incr: %d", incrCount)
+	}
+}
+
+//多个请求同时在号段边界等待预加载, 只有第一个切换号段, 其他的直接使用切换后的号段, 每个号段只持久化一次
+func TestSingleStorageConcurrentSwitch(t *testing.T) {
+	setTestBucketStepConfig(t, 10, 0, 0, 0)
+
+	for _, batch := range []bool{false, true} {
+		store := newCountingSegmentStore()
+		store.block = make(chan bool)
+		loadFunc, incrFunc := store.funcs(10)
+
+		storage := newSingleStorage()
+
+		//用完第一个号段 (0, 10), 预加载阻塞中
+		for i := 0; i < 9; i++ {
+			if _, err := storage.nextId(nil, loadFunc, incrFunc); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		<-store.started
+
+		//4个请求 各取2个id, 正好在第二个号段 [10, 19] 中
+		const waiters = 4
+		results := make(chan []int, waiters)
+		for i := 0; i < waiters; i++ {
+			go func() {
+				if !batch {
+					first, err1 := storage.nextId(nil, loadFunc, incrFunc)
+					second, err2 := storage.nextId(nil, loadFunc, incrFunc)
+					if err1 != nil || err2 != nil {
+						t.Error(err1, err2)
+					}
+
+					results <- []int{first, second}
+					return
+				}
+
+				ranges, err := storage.nextIds(nil, 2, loadFunc, incrFunc)
+				if err != nil {
+					t.Error(err)
+				}
+
+				ids := make([]int, 0, 2)
+				for _, idRange := range ranges {
+					for id := idRange.FirstId; id <= idRange.LastId; id++ {
+						ids = append(ids, id)
+					}
+				}
+
+				results <- ids
+			}()
+		}
+
+		//等所有请求都在等待预加载
+		time.Sleep(50 * time.Millisecond)
+		close(store.block)
+
+		seen := make(map[int]bool)
+		for i := 0; i < waiters; i++ {
+			for _, id := range <-results {
+				if id < 10 || id > 19 || seen[id] {
+					t.Fatalf("batch: %v, duplicated or out of segment id: %d", batch, id)
+				}
+
+				seen[id] = true
+			}
+		}
+
+		storage.lock.Lock()
+		storage.waitLoading()
+		storage.lock.Unlock()
+
+		//第二个号段的预加载, 以及使用超过比例后 第三个号段的预加载
+		if _, incrCount := store.counts(); incrCount != 2 {
+			t.Fatalf("batch: %v, incr: %d, steps: %v", batch, incrCount, store.incrSteps)
+		}
+	}
+}
+
+//批量超过一个号段时 单独持久化这批id, 最后一次持久化的步长仍然是正常的步长
+func TestSingleStorageBatchStep(t *testing.T) {
+	setTestBucketStepConfig(t, 10, 0, 0, 0)
+
+	store := newCountingSegmentStore()
+	loadFunc, incrFunc := store.funcs(10)
+
+	storage := newSingleStorage()
+
+	//第一个号段 (0, 10) 只有9个, 剩余26个单独持久化
+	idRanges, err := storage.nextIds(nil, 35, loadFunc, incrFunc)
+	if err != nil || len(idRanges) != 1 || idRanges[0] != (IdRange{1, 35}) {
+		t.Fatalf("batch: %v, %v", idRanges, err)
+	}
+
+	storage.lock.Lock()
+	storage.waitLoading()
+	storage.lock.Unlock()
+
+	store.lock.Lock()
+	steps := append([]int{}, store.incrSteps...)
+	store.lock.Unlock()
+
+	if len(steps) != 2 || steps[0] != 26 || steps[1] != 10 {
+		t.Fatalf("incr steps: %v", steps)
+	}
+
+	//剩余数量不超过一个号段时 按正常步长加载
+	idRanges, err = storage.nextIds(nil, 12, loadFunc, incrFunc)
+	if err != nil || len(idRanges) != 1 || idRanges[0] != (IdRange{36, 47}) {
+		t.Fatalf("second batch: %v, %v", idRanges, err)
+	}
+
+	storage.lock.Lock()
+	storage.waitLoading()
+	storage.lock.Unlock()
+
+	store.lock.Lock()
+	steps = append([]int{}, store.incrSteps[2:]...)
+	store.lock.Unlock()
+
+	for _, step := range steps {
+		if step != 10 {
+			t.Fatalf("incr steps after second batch: %v", store.incrSteps)
+		}
+	}
+}
+
+//自适应步长: 号段使用时长小于期望值时翻倍, 超过两倍期望值时减半, 限制在 minBucketStep 和 maxBucketStep 之间
+func TestSingleStorageAdaptiveStep(t *testing.T) {
+	setTestBucketStepConfig(t, 10, 10, 80, 100)
+
+	store := newCountingSegmentStore()
+	loadFunc, incrFunc := store.funcs(10)
+
+	var clock int64 = 1000
+	storage := newSingleStorage()
+	storage.now = func() int64 { return clock }
+
+	lastId := 0
+	cases := []struct {
+		duration int64
+		step     int
+	}{
+		{10, 20},
+		{10, 40},
+		{99, 80},
+		{10, 80}, //不超过 maxBucketStep
+		{250, 40},
+		{150, 40}, //在 1 到 2 倍期望值之间 不变
+		{200, 20},
+		{1000, 10},
+		{1000, 10}, //不小于 minBucketStep
+	}
+
+	for i, c := range cases {
+		clock += c.duration
+
+		//发号直到预加载了下一个号段, 预加载时按当前时间计算步长
+		for {
+			id, err := storage.nextId(nil, loadFunc, incrFunc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != lastId+1 {
+				t.Fatalf("case %d: id %d after %d", i, id, lastId)
+			}
+			lastId = id
+
+			storage.lock.Lock()
+			storage.waitLoading()
+			storage.lock.Unlock()
+
+			if _, incrCount := store.counts(); incrCount > i {
+				break
+			}
+		}
+
+		store.lock.Lock()
+		incrCount, step := store.incrCount, store.incrSteps[len(store.incrSteps)-1]
+		store.lock.Unlock()
+
+		if incrCount != i+1 || step != c.step {
+			t.Fatalf("case %d: duration %d, incr: %d, step: %d, expected %d", i, c.duration, incrCount, step, c.step)
+		}
+	}
+
+	//source 配置了固定步长时 不再自适应
+	clock += 10
+	storage.lock.Lock()
+	storage.fixedStep = 15
+	step := storage.nextSegmentStep()
+	storage.lock.Unlock()
+
+	if step != 15 {
+		t.Fatalf("fixed step: %d", step)
+	}
+}
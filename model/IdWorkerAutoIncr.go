@@ -3,135 +3,196 @@ package model
 import (
 	"errors"
 	"strconv"
+	"sync"
 	"idGenerator/model/cmap"
 	"idGenerator/model/logger"
 )
 
 const (
 	//BUCKET_STEP = 10000 //每次从db中拿到的递增量
-	PERSIST_TYPE_MYSQL = 1 //mysql持久化
-	PERSIST_TYPE_BOLTDB = 2 //boltdb持久化
+	MAX_BATCH_COUNT = 10000 //批量获取id 单次最大数量
 )
 
 //自增长的 id worker
 type AutoIncrIdWorker struct {
 	WorkerMap cmap.ConcurrentMap
-	PersistType int
+	PersistType string //持久化方式, 对应 RegisterSegmentStore 注册的名称
+	persistTypeLock sync.RWMutex //slave 提升为master 时修改 PersistType
 }
 
-type singleStorage struct {
-	ItemId    int
-	CurrentId    int
-	CurrentMaxId int
+//批量获取的一段连续id [FirstId, LastId]
+type IdRange struct {
+	FirstId int
+	LastId  int
 }
 
-//获取递增id
-func (worker *AutoIncrIdWorker) NextId(source string) (result int, err error) {
-	if worker.PersistType == PERSIST_TYPE_BOLTDB {
-		//Boltdb 持久化
-		result, err = worker.NextIdByBoltDb(source)
-
-	} else {
+//获取递增id, namespace 为空时使用默认namespace
+func (worker *AutoIncrIdWorker) NextId(namespace string, source string) (resultId int, resultErr error) {
+	defer func() {
+		if err := recoverMasterFenced(recover()); err != nil {
+			resultId, resultErr = 0, err
+		}
+	}()
 
-		//mysql 持久化
-		result, err = worker.NextIdWidthTx(source)
+	sourceConfig, err := worker.checkSource(namespace, source)
+	if err != nil {
+		return 0, err
 	}
-	return
-}
 
-//使用boltdb持久化
-func (worker *AutoIncrIdWorker) NextIdByBoltDb(source string) (int, error) {
-	if source == "" {
-		return 0, errors.New("来源错误")
+	storage, loadFunc, incrFunc, err := worker.prepare(namespace, source, sourceConfig)
+	if err != nil {
+		return 0, err
 	}
 
-	cachedStorage, hasOld := worker.WorkerMap.Get(source)
+	//当前号段用完时 需要增大最大值， 并持久化
+	id, err := storage.nextId(sourceConfig, loadFunc, incrFunc)
+	if err != nil {
+		return 0, err
+	}
 
-	var storage *singleStorage
+	//半同步时 在source 的锁之外等待slave 确认id 所在的号段
+	waitSemiSyncAck(NamespacedSource(namespace, source), id)
 
-	var boltDbUtil BoltDbUtil
+	return id, nil
+}
 
-	if GetApplication().ConfigData.ServerType == SERVER_SLAVE {
-		boltDbUtil = NewBoltDbRpcClient(GetApplication().RpcSocketClient) // slave 通过 rpc 方式
-	} else {
-		boltDbUtil = NewBoltDbService()  //master直接落地磁盘
+//批量获取递增id, 返回的区间按顺序排列, 只有一个区间时说明id是连续的
+func (worker *AutoIncrIdWorker) NextIds(namespace string, source string, count int) (resultRanges []IdRange, resultErr error) {
+	if count < 1 || count > MAX_BATCH_COUNT {
+		return nil, errors.New("批量获取数量错误, 范围 1-" + strconv.Itoa(MAX_BATCH_COUNT))
 	}
 
-	if hasOld {//内存中有
-		tempStorage, typeOk := cachedStorage.(*singleStorage)
-		if !typeOk {
-			return 0, errors.New("旧数据类型异常")
+	defer func() {
+		if err := recoverMasterFenced(recover()); err != nil {
+			resultRanges, resultErr = nil, err
 		}
+	}()
 
-		storage = tempStorage
-
-	} else {
-		//从db中load
-		currentId := boltDbUtil.LoadCurrentIdFromDb(source, GetApplication().ConfigData.BucketStep)
-		currentMaxId := currentId + GetApplication().ConfigData.BucketStep
+	sourceConfig, err := worker.checkSource(namespace, source)
+	if err != nil {
+		return nil, err
+	}
 
-		storage = &singleStorage{0, currentId, currentMaxId}
-		worker.WorkerMap.Set(source, storage)
+	storage, loadFunc, incrFunc, err := worker.prepare(namespace, source, sourceConfig)
+	if err != nil {
+		return nil, err
+	}
 
+	ranges, err := storage.nextIds(sourceConfig, count, loadFunc, incrFunc)
+	if err != nil {
+		return nil, err
 	}
 
-	storage.CurrentId = storage.CurrentId + 1
+	//最后一个id 所在号段的日志序号最大, 确认了它 之前的号段也已确认
+	waitSemiSyncAck(NamespacedSource(namespace, source), ranges[len(ranges)-1].LastId)
+
+	return ranges, nil
+}
 
-	//当前id超过内存中允许的最大值了 需要增大最大值， 并持久化到boltdb中
-	if storage.CurrentId >= storage.CurrentMaxId {
+//source 配置按 namespace/source 注册, source 中不能有分隔符; master 租约过期时不再发出id
+func (worker *AutoIncrIdWorker) checkSource(namespace string, source string) (*SourceConfig, error) {
+	if err := checkMasterLease(); err != nil {
+		return nil, err
+	}
 
-		newCurrentId, newMaxId := boltDbUtil.IncrSourceCurrentId(source, storage.CurrentId, GetApplication().ConfigData.BucketStep)
-		logger.AsyncInfo("boltdb after update:" + source + " => " + strconv.Itoa(newMaxId))
+	if err := ValidateNamespace(namespace); err != nil {
+		return nil, err
+	}
 
-		storage.CurrentId = newCurrentId
-		storage.CurrentMaxId = newMaxId
+	if err := ValidateSource(source); err != nil {
+		return nil, err
 	}
 
-	return storage.CurrentId, nil
+	return GetSourceRegistry().CheckSource(NamespacedSource(namespace, source), GENERATOR_TYPE_AUTOINCREMENT)
 }
 
-//使用mysql事务来持久化
-func (worker *AutoIncrIdWorker) NextIdWidthTx(source string) (int, error) {
+//获取source 的内存号段, 以及加载和持久化号段的方法
+func (worker *AutoIncrIdWorker) prepare(namespace string, source string, sourceConfig *SourceConfig) (*singleStorage, segmentLoadFunc, segmentIncrFunc, error) {
 	if source == "" {
-		return 0, errors.New("来源错误")
+		return nil, nil, nil, errors.New("来源错误")
 	}
 
-	cachedStorage, hasOld := worker.WorkerMap.Get(source)
+	store, err := GetSegmentStore(worker.getPersistType(), namespace)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
-	var storage *singleStorage
+	//不同namespace 的同名source 使用不同的号段
+	storage, err := worker.getStorage(NamespacedSource(namespace, source))
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
-	mysqlService := NewMysqlService()
+	loadFunc, incrFunc := worker.segmentFuncs(store, source, sourceConfig)
 
-	if hasOld {//内存中有
-		tempStorage, typeOk := cachedStorage.(*singleStorage)
-		if !typeOk {
-			return 0, errors.New("旧数据类型异常")
-		}
+	return storage, loadFunc, incrFunc, nil
+}
+
+func (worker *AutoIncrIdWorker) getPersistType() string {
+	worker.persistTypeLock.RLock()
+	defer worker.persistTypeLock.RUnlock()
+
+	return worker.PersistType
+}
+
+//切换持久化方式, 已加载的内存号段来自原来的持久化方式, 全部丢弃
+func (worker *AutoIncrIdWorker) switchPersistType(persistType string) {
+	worker.persistTypeLock.Lock()
+	worker.PersistType = persistType
+	worker.persistTypeLock.Unlock()
+
+	worker.clearStorages()
+}
+
+//丢弃所有内存号段, 下次获取时重新从持久化层加载
+func (worker *AutoIncrIdWorker) clearStorages() {
+	for _, source := range worker.WorkerMap.Keys() {
+		worker.WorkerMap.Remove(source)
+	}
+}
 
-		storage = tempStorage
+//获取source 对应的内存号段, 不存在时原子地放入一个未加载的号段, 保证同一个source 只有一个实例
+func (worker *AutoIncrIdWorker) getStorage(source string) (*singleStorage, error) {
+	cachedStorage := worker.WorkerMap.Upsert(source, nil, func(exist bool, valueInMap interface{}, newValue interface{}) interface{} {
+		if exist {
+			return valueInMap
+		}
 
-	} else {
-		//从db中load
-		itemId, currentId := mysqlService.loadCurrentIdFromDbTx(source, GetApplication().ConfigData.BucketStep)
-		currentMaxId := currentId + GetApplication().ConfigData.BucketStep
+		return newSingleStorage()
+	})
 
+	storage, typeOk := cachedStorage.(*singleStorage)
+	if !typeOk {
+		return nil, errors.New("旧数据类型异常")
+	}
 
-		storage = &singleStorage{itemId, currentId, currentMaxId}
-		worker.WorkerMap.Set(source, storage)
+	return storage, nil
+}
 
+//source 第一次加载时的步长, source 配置中指定了就使用配置的
+func sourceBucketStep(sourceConfig *SourceConfig, storedStepFunc func() int) int {
+	if sourceConfig != nil && sourceConfig.BucketStep > 0 {
+		return sourceConfig.BucketStep
 	}
 
-	storage.CurrentId = storage.CurrentId + 1
+	return initialBucketStep(storedStepFunc())
+}
+
+//加载和持久化号段的方法
+func (worker *AutoIncrIdWorker) segmentFuncs(store SegmentStore, source string, sourceConfig *SourceConfig) (segmentLoadFunc, segmentIncrFunc) {
+	loadFunc := func() (int, int) {
+		bucketStep := sourceBucketStep(sourceConfig, func() int { return store.LoadSourceStep(source) })
+		currentId := store.LoadCurrentIdFromDb(source, bucketStep)
 
-	//当前id超过内存中允许的最大值了 需要增大最大值， 并持久化到db中
-	if storage.CurrentId >= storage.CurrentMaxId {
+		return currentId, bucketStep
+	}
 
-		newCurrentId, newMaxId := mysqlService.updateCurrentIdTx(storage.ItemId, storage.CurrentId, GetApplication().ConfigData.BucketStep)
-		logger.AsyncInfo("mysql after update:" + source + " => " + strconv.Itoa(newMaxId))
+	incrFunc := func(currentId int, bucketStep int) (int, int) {
+		newCurrentId, newMaxId := store.IncrSourceCurrentId(source, currentId, bucketStep)
+		logger.AsyncInfo(worker.getPersistType() + " after update:" + source + " => " + strconv.Itoa(newMaxId))
 
-		storage.CurrentId = newCurrentId
-		storage.CurrentMaxId = newMaxId
+		return newCurrentId, newMaxId
 	}
 
-	return storage.CurrentId, nil
+	return loadFunc, incrFunc
 }
@@ -0,0 +1,240 @@
+package model
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"idGenerator/model/cmap"
+)
+
+//内存中的持久化层, 语义和 BoltDbService 一致
+type memorySegmentStore struct {
+	lock      sync.Mutex
+	values    map[string]int
+	loadCount map[string]int
+}
+
+func newMemorySegmentStore() *memorySegmentStore {
+	return &memorySegmentStore{values: make(map[string]int), loadCount: make(map[string]int)}
+}
+
+func (store *memorySegmentStore) LoadCurrentIdFromDb(source string, bucketStep int) int {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	currentId := store.values[source]
+	store.values[source] = currentId + bucketStep
+	store.loadCount[source]++
+
+	return currentId
+}
+
+func (store *memorySegmentStore) IncrSourceCurrentId(source string, currentId int, bucketStep int) (int, int) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	resultCurrentId := currentId
+	newDbCurrentId := currentId + bucketStep
+
+	if oldCurrentId := store.values[source]; oldCurrentId > currentId {
+		resultCurrentId = oldCurrentId + 1
+		newDbCurrentId = oldCurrentId + bucketStep
+	}
+
+	store.values[source] = newDbCurrentId
+
+	return resultCurrentId, newDbCurrentId
+}
+
+func (store *memorySegmentStore) LoadSourceStep(source string) int {
+	return 0
+}
+
+//测试用的持久化, 重复运行测试时覆盖之前的
+func setTestSegmentStore(name string, store SegmentStore) {
+	segmentStoreLock.Lock()
+	defer segmentStoreLock.Unlock()
+
+	segmentStoreFactories[name] = func(namespace string) SegmentStore { return withSourceNamespace(store, namespace) }
+}
+
+//大量goroutine 并发获取同一批source 的id, 不能有重复, 每个source 只从持久化层加载一次
+func TestAutoIncrIdWorkerConcurrentUnique(t *testing.T) {
+	store := newMemorySegmentStore()
+	setTestSegmentStore("memory_concurrent", store)
+
+	GetApplication().ConfigData.BucketStep = 7
+	GetApplication().ConfigData.PersistType = "memory_concurrent"
+
+	worker := &AutoIncrIdWorker{WorkerMap: cmap.New(), PersistType: currentPersistType()}
+
+	sources := []string{"source_a", "source_b", "source_c"}
+	goroutines := 2000
+	loops := 20
+
+	var lock sync.Mutex
+	seen := make(map[string]map[int]bool)
+	for _, source := range sources {
+		seen[source] = make(map[int]bool)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+
+		go func(index int) {
+			defer wg.Done()
+
+			source := sources[index%len(sources)]
+			var ids []int
+
+			for j := 0; j < loops; j++ {
+				if j%5 == 0 {
+					idRanges, err := worker.NextIds("", source, j%13+1)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+
+					for _, idRange := range idRanges {
+						for id := idRange.FirstId; id <= idRange.LastId; id++ {
+							ids = append(ids, id)
+						}
+					}
+				} else {
+					id, err := worker.NextId("", source)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+
+					ids = append(ids, id)
+				}
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			for _, id := range ids {
+				if seen[source][id] {
+					t.Errorf("duplicate id, source:%s, id:%d", source, id)
+				}
+				seen[source][id] = true
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	for _, source := range sources {
+		if store.loadCount[source] != 1 {
+			t.Errorf("source:%s loaded %d times", source, store.loadCount[source])
+		}
+
+		if len(seen[source]) == 0 {
+			t.Errorf("source:%s got no id", source)
+		}
+
+		t.Log(source + " ids: " + strconv.Itoa(len(seen[source])))
+	}
+}
+
+//worker 中不同namespace 的同名source 使用不同的号段
+func TestAutoIncrIdWorkerNamespace(t *testing.T) {
+	store := newMemorySegmentStore()
+	setTestSegmentStore("namespace_memory", store)
+
+	GetApplication().ConfigData.BucketStep = 10
+
+	worker := &AutoIncrIdWorker{WorkerMap: cmap.New(), PersistType: "namespace_memory"}
+
+	for i := 1; i <= 3; i++ {
+		if id, err := worker.NextId("", "order"); err != nil || id != i {
+			t.Errorf("default namespace: %d, %v", id, err)
+		}
+	}
+
+	if id, err := worker.NextId("tenant_a", "order"); err != nil || id != 1 {
+		t.Errorf("tenant_a: %d, %v", id, err)
+	}
+
+	//号段可能在后台预取, 只检查加载次数
+	store.lock.Lock()
+	if store.loadCount["tenant_a/order"] != 1 || store.loadCount["order"] != 1 {
+		t.Errorf("load count: %v", store.loadCount)
+	}
+	store.lock.Unlock()
+
+	if _, err := worker.NextId("bad/namespace", "order"); err == nil {
+		t.Error("invalid namespace accepted")
+	}
+}
+
+//默认namespace 的 "t/orders" 和namespace t 的 "orders" 不能共用号段
+func TestAutoIncrIdWorkerNamespaceSourceCollision(t *testing.T) {
+	store := newMemorySegmentStore()
+	setTestSegmentStore("collision_memory", store)
+
+	GetApplication().ConfigData.BucketStep = 10
+
+	worker := &AutoIncrIdWorker{WorkerMap: cmap.New(), PersistType: "collision_memory"}
+
+	if id, err := worker.NextId("t", "orders"); err != nil || id != 1 {
+		t.Fatalf("t/orders: %d, %v", id, err)
+	}
+
+	if id, err := worker.NextId("", "t/orders"); err == nil {
+		t.Errorf("source with separator accepted, id: %d", id)
+	}
+
+	if _, err := worker.NextIds("", "t/orders", 2); err == nil {
+		t.Error("batch source with separator accepted")
+	}
+
+	if _, ok := worker.WorkerMap.Get("t/orders"); !ok || worker.WorkerMap.Count() != 1 {
+		t.Errorf("worker map: %v", worker.WorkerMap.Keys())
+	}
+
+	if id, err := worker.NextId("t", "orders"); err != nil || id != 2 {
+		t.Errorf("t/orders after rejected source: %d, %v", id, err)
+	}
+
+	if err := validateSourceCounter(&SourceCounter{Source: "t/orders", CurrentId: 1}); err == nil {
+		t.Error("import source with separator accepted")
+	}
+}
+
+//批量获取跨越号段边界时 返回的id 连续, 数量正确, 之后的单个id 接着往后
+func TestAutoIncrIdWorkerNextIdsAcrossSegment(t *testing.T) {
+	store := newMemorySegmentStore()
+	setTestSegmentStore("batch_memory", store)
+
+	GetApplication().ConfigData.BucketStep = 10
+	GetApplication().ConfigData.MinBucketStep = 0
+
+	worker := &AutoIncrIdWorker{WorkerMap: cmap.New(), PersistType: "batch_memory"}
+
+	idRanges, err := worker.NextIds("", "order", 5)
+	if err != nil || len(idRanges) != 1 || idRanges[0] != (IdRange{1, 5}) {
+		t.Fatalf("first batch: %v, %v", idRanges, err)
+	}
+
+	//当前号段剩余4个, 预加载的号段10个, 其余一次性持久化
+	idRanges, err = worker.NextIds("", "order", 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := 0
+	for _, idRange := range idRanges {
+		count += idRange.LastId - idRange.FirstId + 1
+	}
+
+	if count != 25 || len(idRanges) != 1 || idRanges[0] != (IdRange{6, 30}) {
+		t.Fatalf("batch across segment: %v, count: %d", idRanges, count)
+	}
+
+	if id, err := worker.NextId("", "order"); err != nil || id != 31 {
+		t.Errorf("next id after batch: %d, %v", id, err)
+	}
+}
@@ -1,18 +1,20 @@
 package model
 
 import (
+	"sync"
 	"idGenerator/model/cmap"
 )
 
 var autoincrIdWorkerInstance *AutoIncrIdWorker
+var autoincrIdWorkerOnce sync.Once
 
-//单例获取 递增方式的 id worker
+//单例获取 递增方式的 id worker, 并发请求下只初始化一次
 func GetAutoIncrIdWorker() *AutoIncrIdWorker {
-	if autoincrIdWorkerInstance == nil {
+	autoincrIdWorkerOnce.Do(func() {
 		autoincrIdWorkerInstance = new(AutoIncrIdWorker)
 		autoincrIdWorkerInstance.WorkerMap = cmap.New()
-		autoincrIdWorkerInstance.PersistType = GetApplication().ConfigData.PersistType
-	}
+		autoincrIdWorkerInstance.PersistType = currentPersistType()
+	})
 
 	return autoincrIdWorkerInstance
 }
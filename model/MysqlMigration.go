@@ -0,0 +1,213 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"idGenerator/model/logger"
+	"time"
+)
+
+const (
+	SCHEMA_MIGRATION_TABLE_NAME = "idGeneratorSchemaMigration" //记录已执行的表结构版本
+
+	SCHEMA_MIGRATION_LOCK_NAME    = "idGenerator_schema_migration" //多个实例同时启动时 只有一个执行
+	SCHEMA_MIGRATION_LOCK_TIMEOUT = 60                             //等待锁的时间 单位秒
+)
+
+//一个版本的表结构修改
+//mysql 的 DDL 会隐式提交, 不能放在一个事务中, 所以每个版本都要可以重复执行
+type mysqlMigration struct {
+	Version     int
+	Description string
+	Up          func(conn *sql.Conn) error
+}
+
+//只能追加, 不能修改已发布的版本
+var mysqlMigrations = []mysqlMigration{
+	{1, "create idGenerator table", func(conn *sql.Conn) error {
+		return mysqlExec(conn, "CREATE TABLE IF NOT EXISTS `idGenerator` ("+
+			" `id` int(10) unsigned NOT NULL AUTO_INCREMENT COMMENT '主键',"+
+			" `worker_source` varchar(255) NOT NULL DEFAULT '' COMMENT '业务类型',"+
+			" `current_id` bigint(20) unsigned NOT NULL DEFAULT 0 COMMENT '业务当前的递增id',"+
+			" PRIMARY KEY (`id`),"+
+			" KEY `idx_worker_source` (`worker_source`)"+
+			") ENGINE=InnoDB DEFAULT CHARSET=utf8 COMMENT='递增id保持表'")
+	}},
+
+	{2, "add idGenerator.bucket_step", func(conn *sql.Conn) error {
+		return mysqlAddColumn(conn, "idGenerator", "bucket_step",
+			"int(10) unsigned NOT NULL DEFAULT 0 COMMENT '最近一次使用的步长' AFTER `current_id`")
+	}},
+
+	{3, "unique key on idGenerator.worker_source", func(conn *sql.Conn) error {
+		exist, err := mysqlIndexExists(conn, "idGenerator", "uk_worker_source")
+		if err != nil || exist {
+			return err
+		}
+
+		//重复的记录只保留 current_id 最大的, 保证已发出的id 不会再次分配
+		err = mysqlExec(conn, "DELETE t1 FROM `idGenerator` t1 JOIN `idGenerator` t2"+
+			" ON t1.worker_source = t2.worker_source"+
+			" AND (t1.current_id < t2.current_id OR (t1.current_id = t2.current_id AND t1.id < t2.id))")
+		if err != nil {
+			return err
+		}
+
+		if err = mysqlExec(conn, "ALTER TABLE `idGenerator` ADD UNIQUE KEY `uk_worker_source` (`worker_source`)"); err != nil {
+			return err
+		}
+
+		if exist, err = mysqlIndexExists(conn, "idGenerator", "idx_worker_source"); err != nil || !exist {
+			return err
+		}
+
+		return mysqlExec(conn, "ALTER TABLE `idGenerator` DROP KEY `idx_worker_source`")
+	}},
+
+	{4, "add idGenerator.max_id and updated_at", func(conn *sql.Conn) error {
+		err := mysqlAddColumn(conn, "idGenerator", "max_id",
+			"bigint(20) unsigned NOT NULL DEFAULT 0 COMMENT '最大id, 0 不限制, 和source 配置同步' AFTER `bucket_step`")
+		if err != nil {
+			return err
+		}
+
+		return mysqlAddColumn(conn, "idGenerator", "updated_at",
+			"timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT '更新时间' AFTER `max_id`")
+	}},
+
+	{5, "create worker lease and source tables", func(conn *sql.Conn) error {
+		err := mysqlExec(conn, "CREATE TABLE IF NOT EXISTS `"+WORKER_LEASE_TABLE_NAME+"` ("+
+			" `worker_id` int(10) unsigned NOT NULL COMMENT 'snowflake worker id',"+
+			" `owner` varchar(255) NOT NULL DEFAULT '' COMMENT '租约持有者',"+
+			" `expire_at` bigint(20) unsigned NOT NULL DEFAULT 0 COMMENT '租约过期时间戳 单位秒',"+
+			" PRIMARY KEY (`worker_id`)"+
+			") ENGINE=InnoDB DEFAULT CHARSET=utf8 COMMENT='snowflake worker id 租约表'")
+		if err != nil {
+			return err
+		}
+
+		return mysqlExec(conn, "CREATE TABLE IF NOT EXISTS `"+SOURCE_TABLE_NAME+"` ("+
+			" `worker_source` varchar(255) NOT NULL DEFAULT '' COMMENT '业务类型',"+
+			" `start_id` bigint(20) unsigned NOT NULL DEFAULT 0 COMMENT '起始id',"+
+			" `bucket_step` int(10) unsigned NOT NULL DEFAULT 0 COMMENT '步长, 0 使用全局配置',"+
+			" `max_id` bigint(20) unsigned NOT NULL DEFAULT 0 COMMENT '最大id, 0 不限制',"+
+			" `generator_type` varchar(32) NOT NULL DEFAULT '' COMMENT '允许的生成方式, 空不限制',"+
+			" `description` varchar(1024) NOT NULL DEFAULT '' COMMENT '描述',"+
+			" `owner` varchar(255) NOT NULL DEFAULT '' COMMENT '负责人',"+
+			" `created_at` bigint(20) unsigned NOT NULL DEFAULT 0 COMMENT '创建时间戳',"+
+			" `updated_at` bigint(20) unsigned NOT NULL DEFAULT 0 COMMENT '更新时间戳',"+
+			" PRIMARY KEY (`worker_source`)"+
+			") ENGINE=InnoDB DEFAULT CHARSET=utf8 COMMENT='source 配置表'")
+	}},
+}
+
+//执行还没有执行过的版本, 返回本次执行的版本号
+func MigrateMysql(db *sql.DB) (applied []int, err error) {
+	ctx := context.Background()
+
+	//同一个连接上加锁和执行, GET_LOCK 是连接级别的
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var locked sql.NullInt64
+	err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", SCHEMA_MIGRATION_LOCK_NAME, SCHEMA_MIGRATION_LOCK_TIMEOUT).Scan(&locked)
+	if err != nil {
+		return nil, err
+	}
+	if locked.Int64 != 1 {
+		return nil, errors.New("等待表结构升级锁超时")
+	}
+	defer conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", SCHEMA_MIGRATION_LOCK_NAME)
+
+	err = mysqlExec(conn, "CREATE TABLE IF NOT EXISTS `"+SCHEMA_MIGRATION_TABLE_NAME+"` ("+
+		" `version` int(10) unsigned NOT NULL COMMENT '版本号',"+
+		" `description` varchar(255) NOT NULL DEFAULT '' COMMENT '描述',"+
+		" `applied_at` bigint(20) unsigned NOT NULL DEFAULT 0 COMMENT '执行时间戳',"+
+		" PRIMARY KEY (`version`)"+
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8 COMMENT='表结构版本'")
+	if err != nil {
+		return nil, err
+	}
+
+	appliedVersions, err := mysqlAppliedVersions(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, migration := range mysqlMigrations {
+		if appliedVersions[migration.Version] {
+			continue
+		}
+
+		logger.AsyncInfo(fmt.Sprintf("mysql schema migrate to version %d: %s", migration.Version, migration.Description))
+
+		if err = migration.Up(conn); err != nil {
+			return applied, errors.New(fmt.Sprintf("mysql schema version %d 执行失败: %s", migration.Version, err.Error()))
+		}
+
+		err = mysqlExec(conn, "INSERT INTO `"+SCHEMA_MIGRATION_TABLE_NAME+"` (version, description, applied_at) VALUES (?, ?, ?)",
+			migration.Version, migration.Description, time.Now().Unix())
+		if err != nil {
+			return applied, err
+		}
+
+		applied = append(applied, migration.Version)
+	}
+
+	return applied, nil
+}
+
+//已执行的版本
+func mysqlAppliedVersions(conn *sql.Conn) (map[int]bool, error) {
+	rows, err := conn.QueryContext(context.Background(), "SELECT version FROM `"+SCHEMA_MIGRATION_TABLE_NAME+"`")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		versions[version] = true
+	}
+
+	return versions, rows.Err()
+}
+
+func mysqlExec(conn *sql.Conn, query string, args ...interface{}) error {
+	_, err := conn.ExecContext(context.Background(), query, args...)
+
+	return err
+}
+
+//字段不存在时添加
+func mysqlAddColumn(conn *sql.Conn, table string, column string, definition string) error {
+	var count int
+
+	err := conn.QueryRowContext(context.Background(),
+		"SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?",
+		table, column).Scan(&count)
+	if err != nil || count > 0 {
+		return err
+	}
+
+	return mysqlExec(conn, "ALTER TABLE `"+table+"` ADD COLUMN `"+column+"` "+definition)
+}
+
+func mysqlIndexExists(conn *sql.Conn, table string, index string) (bool, error) {
+	var count int
+
+	err := conn.QueryRowContext(context.Background(),
+		"SELECT COUNT(*) FROM information_schema.STATISTICS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND INDEX_NAME = ?",
+		table, index).Scan(&count)
+
+	return count > 0, err
+}
@@ -0,0 +1,349 @@
+package model
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//mysql 替身中的表结构, 只记录表, 字段, 索引, 以及已执行的版本
+//和 mysql 一样 重复添加字段, 索引时报错, 所以每个版本都要先检查
+type mysqlStandInSchema struct {
+	tables     map[string]*mysqlStandInTable
+	versions   map[int]string //版本号 => 描述
+	order      []int          //版本的执行顺序
+	ddlCount   int            //执行过的 DDL 数量
+	namedLocks map[string]*mysqlStandInConn
+}
+
+type mysqlStandInTable struct {
+	columns map[string]bool
+	indexes map[string]bool
+}
+
+func newMysqlStandInSchema() *mysqlStandInSchema {
+	return &mysqlStandInSchema{
+		tables:     make(map[string]*mysqlStandInTable),
+		versions:   make(map[int]string),
+		namedLocks: make(map[string]*mysqlStandInConn),
+	}
+}
+
+var (
+	standInCreateTablePattern = regexp.MustCompile("^create table if not exists `(\\w+)` \\((.*)\\) engine=innodb default charset=utf8 comment='[^']*'$")
+	standInColumnPattern      = regexp.MustCompile("`(\\w+)` (?:int\\(|bigint\\(|varchar\\(|timestamp )")
+	standInIndexPattern       = regexp.MustCompile("(?:unique )?key `(\\w+)` \\(`\\w+`\\)")
+	standInAddColumnPattern   = regexp.MustCompile("^alter table `(\\w+)` add column `(\\w+)` .+$")
+	standInAddIndexPattern    = regexp.MustCompile("^alter table `(\\w+)` add unique key `(\\w+)` \\(`\\w+`\\)$")
+	standInDropIndexPattern   = regexp.MustCompile("^alter table `(\\w+)` drop key `(\\w+)`$")
+)
+
+//表结构升级的语句, 不是这些语句时 handled 为false, 调用方需要持有 server.lock
+func (server *mysqlStandIn) executeSchema(conn *mysqlStandInConn, query string, args []driver.Value) (*mysqlStandInRows, bool, error) {
+	schema := server.schema
+
+	switch query {
+	//连接级别的锁, 被其他连接持有时 最多等待 timeout 秒
+	case "select get_lock(?, ?)":
+		name := standInString(args[0])
+		deadline := time.Now().Add(time.Duration(standInInt(args[1])) * time.Second)
+		timer := time.AfterFunc(time.Until(deadline), func() {
+			server.lock.Lock()
+			server.cond.Broadcast()
+			server.lock.Unlock()
+		})
+		defer timer.Stop()
+
+		for schema.namedLocks[name] != nil && schema.namedLocks[name] != conn && time.Now().Before(deadline) {
+			server.cond.Wait()
+		}
+
+		locked := int64(0)
+		if schema.namedLocks[name] == nil || schema.namedLocks[name] == conn {
+			schema.namedLocks[name] = conn
+			locked = 1
+		}
+
+		return &mysqlStandInRows{[]string{"locked"}, [][]driver.Value{{locked}}}, true, nil
+
+	case "select release_lock(?)":
+		name := standInString(args[0])
+		if schema.namedLocks[name] == conn {
+			delete(schema.namedLocks, name)
+			server.cond.Broadcast()
+		}
+
+		return &mysqlStandInRows{[]string{"released"}, [][]driver.Value{{int64(1)}}}, true, nil
+
+	case "select count(*) from information_schema.columns where table_schema = database() and table_name = ? and column_name = ?",
+		"select count(*) from information_schema.statistics where table_schema = database() and table_name = ? and index_name = ?":
+		count := int64(0)
+		if table, exist := schema.tables[strings.ToLower(standInString(args[0]))]; exist {
+			name := strings.ToLower(standInString(args[1]))
+			if (strings.Contains(query, ".columns ") && table.columns[name]) || (strings.Contains(query, ".statistics ") && table.indexes[name]) {
+				count = 1
+			}
+		}
+
+		return &mysqlStandInRows{[]string{"count"}, [][]driver.Value{{count}}}, true, nil
+
+	//worker_source 上的唯一索引保证替身中没有重复的记录
+	case "delete t1 from `idgenerator` t1 join `idgenerator` t2 on t1.worker_source = t2.worker_source" +
+		" and (t1.current_id < t2.current_id or (t1.current_id = t2.current_id and t1.id < t2.id))":
+		return nil, true, nil
+
+	case "insert into `idgeneratorschemamigration` (version, description, applied_at) values (?, ?, ?)":
+		if schema.tables["idgeneratorschemamigration"] == nil {
+			return nil, true, errors.New("table idGeneratorSchemaMigration doesn't exist")
+		}
+
+		version := standInInt(args[0])
+		if _, exist := schema.versions[version]; exist {
+			return nil, true, errors.New("duplicate entry for key 'PRIMARY'")
+		}
+
+		schema.versions[version] = standInString(args[1])
+		schema.order = append(schema.order, version)
+
+		return nil, true, nil
+
+	case "select version from `idgeneratorschemamigration`":
+		if schema.tables["idgeneratorschemamigration"] == nil {
+			return nil, true, errors.New("table idGeneratorSchemaMigration doesn't exist")
+		}
+
+		rows := &mysqlStandInRows{columns: []string{"version"}}
+		for version := range schema.versions {
+			rows.values = append(rows.values, []driver.Value{int64(version)})
+		}
+
+		return rows, true, nil
+	}
+
+	if match := standInCreateTablePattern.FindStringSubmatch(query); match != nil {
+		schema.ddlCount++
+
+		if schema.tables[match[1]] == nil {
+			table := &mysqlStandInTable{columns: make(map[string]bool), indexes: make(map[string]bool)}
+			for _, column := range standInColumnPattern.FindAllStringSubmatch(match[2], -1) {
+				table.columns[column[1]] = true
+			}
+			for _, index := range standInIndexPattern.FindAllStringSubmatch(match[2], -1) {
+				table.indexes[index[1]] = true
+			}
+			if strings.Contains(match[2], "primary key (") {
+				table.indexes["primary"] = true
+			}
+
+			schema.tables[match[1]] = table
+		}
+
+		return nil, true, nil
+	}
+
+	if match := standInAddColumnPattern.FindStringSubmatch(query); match != nil {
+		schema.ddlCount++
+
+		table, err := schema.table(match[1])
+		if err == nil && table.columns[match[2]] {
+			err = errors.New("duplicate column name '" + match[2] + "'")
+		}
+		if err == nil {
+			table.columns[match[2]] = true
+		}
+
+		return nil, true, err
+	}
+
+	if match := standInAddIndexPattern.FindStringSubmatch(query); match != nil {
+		schema.ddlCount++
+
+		table, err := schema.table(match[1])
+		if err == nil && table.indexes[match[2]] {
+			err = errors.New("duplicate key name '" + match[2] + "'")
+		}
+		if err == nil {
+			table.indexes[match[2]] = true
+		}
+
+		return nil, true, err
+	}
+
+	if match := standInDropIndexPattern.FindStringSubmatch(query); match != nil {
+		schema.ddlCount++
+
+		table, err := schema.table(match[1])
+		if err == nil && !table.indexes[match[2]] {
+			err = errors.New("can't drop '" + match[2] + "'; check that column/key exists")
+		}
+		if err == nil {
+			delete(table.indexes, match[2])
+		}
+
+		return nil, true, err
+	}
+
+	return nil, false, nil
+}
+
+func (schema *mysqlStandInSchema) table(name string) (*mysqlStandInTable, error) {
+	table, exist := schema.tables[name]
+	if !exist {
+		return nil, errors.New("table " + name + " doesn't exist")
+	}
+
+	return table, nil
+}
+
+func (server *mysqlStandIn) appliedVersions() []int {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	return append([]int{}, server.schema.order...)
+}
+
+func allMysqlMigrationVersions() []int {
+	versions := make([]int, 0, len(mysqlMigrations))
+	for _, migration := range mysqlMigrations {
+		versions = append(versions, migration.Version)
+	}
+
+	return versions
+}
+
+//空库按版本顺序执行, 记录每个版本, 最终的表结构和 sql/mysql.sql 一致
+func TestMigrateMysqlInOrder(t *testing.T) {
+	db, server := newMysqlStandInDB(t, "migrate_order")
+	defer db.Close()
+
+	applied, err := MigrateMysql(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versions := allMysqlMigrationVersions()
+	if !reflect.DeepEqual(applied, versions) || !reflect.DeepEqual(server.appliedVersions(), versions) {
+		t.Fatalf("applied: %v, recorded: %v", applied, server.appliedVersions())
+	}
+
+	for _, migration := range mysqlMigrations {
+		if description := server.schema.versions[migration.Version]; description != migration.Description {
+			t.Errorf("version %d description: %s", migration.Version, description)
+		}
+	}
+
+	table := server.schema.tables["idgenerator"]
+	for _, column := range []string{"id", "worker_source", "current_id", "bucket_step", "max_id", "updated_at"} {
+		if !table.columns[column] {
+			t.Errorf("column %s missing", column)
+		}
+	}
+
+	if !table.indexes["uk_worker_source"] || table.indexes["idx_worker_source"] {
+		t.Errorf("indexes: %v", table.indexes)
+	}
+
+	for _, name := range []string{"idgeneratorworkerlease", "idgeneratorsource", "idgeneratorschemamigration"} {
+		if server.schema.tables[name] == nil {
+			t.Errorf("table %s missing", name)
+		}
+	}
+}
+
+//重复执行时 已记录的版本不再执行; 没有版本记录的旧库 每个版本都可以重复执行
+func TestMigrateMysqlIdempotent(t *testing.T) {
+	db, server := newMysqlStandInDB(t, "migrate_idempotent")
+	defer db.Close()
+
+	if _, err := MigrateMysql(db); err != nil {
+		t.Fatal(err)
+	}
+
+	ddlCount := server.schema.ddlCount
+
+	applied, err := MigrateMysql(db)
+	if err != nil || len(applied) != 0 {
+		t.Fatalf("second run: %v, %v", applied, err)
+	}
+
+	//只会创建版本表
+	if server.schema.ddlCount != ddlCount+1 || len(server.appliedVersions()) != len(mysqlMigrations) {
+		t.Errorf("ddl: %d -> %d, versions: %v", ddlCount, server.schema.ddlCount, server.appliedVersions())
+	}
+
+	//丢掉版本记录, 模拟表已经升级过 但没有版本表的旧库
+	server.lock.Lock()
+	delete(server.schema.tables, "idgeneratorschemamigration")
+	server.schema.versions = make(map[int]string)
+	server.schema.order = nil
+	server.lock.Unlock()
+
+	applied, err = MigrateMysql(db)
+	if err != nil || !reflect.DeepEqual(applied, allMysqlMigrationVersions()) {
+		t.Fatalf("run on migrated schema without versions: %v, %v", applied, err)
+	}
+}
+
+//GET_LOCK 被其他连接持有时等待, 多个实例同时执行时 每个版本只执行一次
+func TestMigrateMysqlUnderLock(t *testing.T) {
+	db, server := newMysqlStandInDB(t, "migrate_lock")
+	defer db.Close()
+
+	ctx := context.Background()
+	holder, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer holder.Close()
+
+	var locked int
+	if err := holder.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", SCHEMA_MIGRATION_LOCK_NAME, 1).Scan(&locked); err != nil || locked != 1 {
+		t.Fatalf("hold lock: %d, %v", locked, err)
+	}
+
+	const instances = 5
+	var lock sync.Mutex
+	var applied []int
+
+	var wg sync.WaitGroup
+	for i := 0; i < instances; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			versions, err := MigrateMysql(db)
+			if err != nil {
+				t.Error(err)
+			}
+
+			lock.Lock()
+			applied = append(applied, versions...)
+			lock.Unlock()
+		}()
+	}
+
+	//锁被持有时 不能执行任何版本
+	time.Sleep(50 * time.Millisecond)
+	if versions := server.appliedVersions(); len(versions) != 0 {
+		t.Fatalf("migrated without lock: %v", versions)
+	}
+
+	if _, err := holder.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", SCHEMA_MIGRATION_LOCK_NAME); err != nil {
+		t.Fatal(err)
+	}
+
+	wg.Wait()
+
+	sort.Ints(applied)
+	if !reflect.DeepEqual(applied, allMysqlMigrationVersions()) || !reflect.DeepEqual(server.appliedVersions(), allMysqlMigrationVersions()) {
+		t.Errorf("applied: %v, recorded: %v", applied, server.appliedVersions())
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"idGenerator/model/logger"
 	"strconv"
+	"time"
 	//"fmt"
 )
 
@@ -12,6 +13,12 @@ type MysqlService struct {
 	TableName string
 }
 
+func init() {
+	RegisterSegmentStore(PERSIST_TYPE_MYSQL, func(namespace string) SegmentStore {
+		return withSourceNamespace(NewMysqlService(), namespace)
+	})
+}
+
 func NewMysqlService() *MysqlService {
 	var serviceInstance = new(MysqlService)
 
@@ -86,129 +93,332 @@ func (serviceInstance *MysqlService) getIdBySource(source string) int {
 	}
 }
 
-/****************************************************/
-/*数据更新相关*/
+//获取source 最近一次使用的步长, 没有记录时返回0
+func (serviceInstance *MysqlService) getBucketStepBySource(source string) int {
+	if source == "" {
+		panic("source is empty")
+	}
 
-//使用事务 从db中load当前的current_id ，并增大库中的id
-func (serviceInstance *MysqlService) loadCurrentIdFromDbTx(source string, bucket_step int) (int, int) {
-	if source == "" || bucket_step < 1 {
-		panic("业务参数错误，或者id递增步长错误")
+	var bucketStep int
+	err := serviceInstance.DB.QueryRow(
+		"select bucket_step from "+serviceInstance.TableName+" where worker_source = ? limit 1",
+		source).Scan(&bucketStep)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return 0
+	case err != nil:
+		panic(err)
+	default:
+		return bucketStep
 	}
+}
 
-	logger.AsyncInfo("load current id from mysql, source: " + source + " , bucket_step: " + strconv.Itoa(bucket_step))
+/****************************************************/
+/*数据更新相关*/
 
-	var err error
-	var dbTx *sql.Tx
-	var itemId, currentId int
+//在事务中执行, panic 时回滚, 否则提交
+func (serviceInstance *MysqlService) withTx(handler func(dbTx *sql.Tx)) {
+	dbTx, err := serviceInstance.DB.Begin()
+	checkErr(err)
 
 	defer func() {
 		err := recover()
 
-		if dbTx != nil {
-			if err != nil {
-				dbTx.Rollback() //回滚事务
-			} else {
-				dbTx.Commit() //提交事务
-			}
+		if err != nil {
+			dbTx.Rollback() //回滚事务
+		} else {
+			err = dbTx.Commit() //提交事务
 		}
 
 		checkErr(err)
 	}()
 
-	//开启事务
-	dbTx, err = serviceInstance.DB.Begin()
-	checkErr(err)
-
-	oldItemId, oldCurrentId := serviceInstance.getItemInfoBySource(source)
-
-	if oldItemId < 1 {//还没有记录
-		currentId = 0
+	handler(dbTx)
+}
 
-		stmt, err1 := serviceInstance.DB.Prepare("INSERT " + serviceInstance.TableName + " SET worker_source=?, current_id=?")
-		defer stmt.Close()
-		checkErr(err1)
+//锁住source 对应的一行, 返回记录id, 当前的 current_id 和最大id, 需要在事务中调用
+func (serviceInstance *MysqlService) lockSourceTx(dbTx *sql.Tx, source string) (itemId int, currentId int, maxId int, err error) {
+	err = dbTx.QueryRow(
+		"select id, current_id, max_id from "+serviceInstance.TableName+" where worker_source = ? limit 1 for update",
+		source).Scan(&itemId, &currentId, &maxId)
 
-		 res, err2 := stmt.Exec(source, bucket_step)
-		 checkErr(err2)
+	return itemId, currentId, maxId, err
+}
 
-		itemIdNew, err3 := res.LastInsertId()
-		checkErr(err3)
+//使用事务 从db中load当前的current_id ，并增大库中的id
+//worker_source 有唯一索引, 新source 通过 upsert 插入, 并发第一次加载时不会产生两条记录
+func (serviceInstance *MysqlService) loadCurrentIdFromDbTx(source string, bucket_step int) (itemId int, currentId int) {
+	if source == "" || bucket_step < 1 {
+		panic("业务参数错误，或者id递增步长错误")
+	}
 
-		itemId = int(itemIdNew)
+	logger.AsyncInfo("load current id from mysql, source: " + source + " , bucket_step: " + strconv.Itoa(bucket_step))
 
-	} else {//更新记录
-		currentId = oldCurrentId
-		itemId = oldItemId
+	serviceInstance.withTx(func(dbTx *sql.Tx) {
+		//还没有记录时插入, 已有记录时不修改
+		_, err := dbTx.Exec(
+			"insert into "+serviceInstance.TableName+" (worker_source, current_id, bucket_step) values (?, 0, ?)"+
+				" on duplicate key update worker_source = worker_source",
+			source, bucket_step)
+		checkErr(err)
 
 		//锁住一行
-		serviceInstance.DB.QueryRow("select id from " + serviceInstance.TableName + " where id = ?  from update limit 1", oldItemId)
+		var maxId int
+		itemId, currentId, maxId, err = serviceInstance.lockSourceTx(dbTx, source)
+		checkErr(err)
 
-		stmt, err4 := serviceInstance.DB.Prepare("update " + serviceInstance.TableName + " set current_id = ? where id = ?")
-		defer stmt.Close()
-		checkErr(err4)
+		if maxId > 0 && currentId >= maxId {
+			panic("已达到source 的最大id: " + source)
+		}
 
-		_, err5 := stmt.Exec(int(oldCurrentId + bucket_step), oldItemId)
-		checkErr(err5)
-	}
+		_, err = dbTx.Exec(
+			"update "+serviceInstance.TableName+" set current_id = ?, bucket_step = ? where id = ?",
+			currentId+bucket_step, bucket_step, itemId)
+		checkErr(err)
+	})
 
 	return itemId, currentId
 }
 
 //使用事务更新数据
-func (serviceInstance *MysqlService) updateCurrentIdTx(itemId int, currentId int, bucketStep int) (resultCurrentId int, newDbCurrentId int){
-	if itemId < 1 || currentId < 1 {
+func (serviceInstance *MysqlService) updateCurrentIdTx(source string, currentId int, bucketStep int) (resultCurrentId int, newDbCurrentId int) {
+	if source == "" || currentId < 1 || bucketStep < 1 {
 		panic("parameter error")
 	}
 
-	var dbTx *sql.Tx
-	var err error
+	var itemId int
 
-	defer func() {
-		err := recover()
+	serviceInstance.withTx(func(dbTx *sql.Tx) {
+		//锁住一行
+		var dbCurrentId, maxId int
+		var err error
+
+		itemId, dbCurrentId, maxId, err = serviceInstance.lockSourceTx(dbTx, source)
+		if err == sql.ErrNoRows {
+			panic("source 还没有加载: " + source)
+		}
+		checkErr(err)
 
-		if dbTx != nil {
-			if err != nil {
-				//err = dbTx.Rollback() //回滚事务
-				dbTx.Rollback() //回滚事务
-			} else {
-				dbTx.Commit() //提交事务
-			}
+		resultCurrentId = currentId
+		newDbCurrentId = currentId + bucketStep
+
+		if dbCurrentId > currentId {
+			resultCurrentId = dbCurrentId + 1
+			newDbCurrentId = dbCurrentId + bucketStep
+		}
+
+		//库中的最大id 由source 配置同步, 多个实例之间也不会超出
+		if maxId > 0 && resultCurrentId > maxId {
+			panic("已达到source 的最大id: " + source)
 		}
 
+		_, err = dbTx.Exec(
+			"update "+serviceInstance.TableName+" set current_id = ?, bucket_step = ? where id = ?",
+			newDbCurrentId, bucketStep, itemId)
 		checkErr(err)
-	}()
+	})
 
-	//开启事务
-	dbTx, err = serviceInstance.DB.Begin()
-	checkErr(err)
+	logger.AsyncInfo("itemId: " + strconv.Itoa(itemId) + " update current_id to " + strconv.Itoa(newDbCurrentId))
+
+	return resultCurrentId, newDbCurrentId
+}
+
+/****************************************************/
+/*SegmentStore 接口*/
+
+func (serviceInstance *MysqlService) LoadCurrentIdFromDb(source string, bucketStep int) int {
+	_, currentId := serviceInstance.loadCurrentIdFromDbTx(source, bucketStep)
+
+	return currentId
+}
+
+func (serviceInstance *MysqlService) IncrSourceCurrentId(source string, currentId int, bucketStep int) (int, int) {
+	return serviceInstance.updateCurrentIdTx(source, currentId, bucketStep)
+}
+
+func (serviceInstance *MysqlService) LoadSourceStep(source string) int {
+	return serviceInstance.getBucketStepBySource(source)
+}
+
+/****************************************************/
+/*snowflake worker id 租约*/
 
-	//锁住一行
-	var dbCurrentId int
+//申请一个空闲或已过期的 worker id, 通过条件更新保证只有一个实例能拿到
+func (serviceInstance *MysqlService) AcquireWorkerLease(owner string, maxWorkerId int64, ttl int) (int64, error) {
+	now := time.Now().Unix()
+	expireAt := now + int64(ttl)
 
-	err1 := serviceInstance.DB.QueryRow(
-			"select current_id from " + serviceInstance.TableName + " where id = ? limit 1 for update ", 
-			itemId).Scan(&dbCurrentId)
+	rows, err := serviceInstance.DB.Query(
+		"select worker_id, owner, expire_at from "+WORKER_LEASE_TABLE_NAME+" where worker_id <= ?", maxWorkerId)
+	if err != nil {
+		return -1, err
+	}
+
+	leased := make(map[int64]workerLeaseRecord)
+	for rows.Next() {
+		var workerId int64
+		var record workerLeaseRecord
+		if err := rows.Scan(&workerId, &record.Owner, &record.ExpireAt); err != nil {
+			rows.Close()
+			return -1, err
+		}
+		leased[workerId] = record
+	}
+	rows.Close()
+
+	for workerId := int64(0); workerId <= maxWorkerId; workerId++ {
+		var res sql.Result
+
+		record, hasOld := leased[workerId]
+		if !hasOld {
+			res, err = serviceInstance.DB.Exec(
+				"insert ignore into "+WORKER_LEASE_TABLE_NAME+" (worker_id, owner, expire_at) values (?, ?, ?)",
+				workerId, owner, expireAt)
+
+		} else if record.Owner == owner || record.ExpireAt < now {
+			res, err = serviceInstance.DB.Exec(
+				"update "+WORKER_LEASE_TABLE_NAME+" set owner = ?, expire_at = ? where worker_id = ? and owner = ? and expire_at = ?",
+				owner, expireAt, workerId, record.Owner, record.ExpireAt)
 
-	checkErr(err1)
+		} else {
+			continue //别人持有 还没过期
+		}
 
-	resultCurrentId = currentId
-	newDbCurrentId = currentId + bucketStep
+		if err != nil {
+			return -1, err
+		}
 
-	if dbCurrentId > currentId {
-		resultCurrentId = dbCurrentId + 1
-		newDbCurrentId = dbCurrentId + bucketStep;
+		if affected, _ := res.RowsAffected(); affected == 1 {
+			return workerId, nil
+		}
 	}
 
-	stmt, err2 := serviceInstance.DB.Prepare("update " + serviceInstance.TableName + " set current_id = ? where id = ?")
-	defer stmt.Close()
-	checkErr(err2)
+	return -1, ErrNoFreeWorkerId
+}
 
-	_, err3 := stmt.Exec(newDbCurrentId, itemId)
-	checkErr(err3)
+//续约, 租约已被别人持有时返回 ErrWorkerLeaseLost
+func (serviceInstance *MysqlService) RenewWorkerLease(owner string, workerId int64, ttl int) error {
+	_, err := serviceInstance.DB.Exec(
+		"update "+WORKER_LEASE_TABLE_NAME+" set expire_at = ? where worker_id = ? and owner = ?",
+		time.Now().Unix()+int64(ttl), workerId, owner)
+	if err != nil {
+		return err
+	}
 
-	logger.AsyncInfo("itemId: " + strconv.Itoa(itemId) + " update current_id to " + strconv.Itoa(newDbCurrentId))
+	//同一秒内续约 affected rows 为0, 需要再查一次持有者
+	var currentOwner string
+	err = serviceInstance.DB.QueryRow(
+		"select owner from "+WORKER_LEASE_TABLE_NAME+" where worker_id = ? limit 1", workerId).Scan(&currentOwner)
 
-	return resultCurrentId, newDbCurrentId
+	switch {
+	case err == sql.ErrNoRows:
+		return ErrWorkerLeaseLost
+	case err != nil:
+		return err
+	case currentOwner != owner:
+		return ErrWorkerLeaseLost
+	default:
+		return nil
+	}
+}
+
+//释放租约, 只删除自己持有的
+func (serviceInstance *MysqlService) ReleaseWorkerLease(owner string, workerId int64) error {
+	_, err := serviceInstance.DB.Exec(
+		"delete from "+WORKER_LEASE_TABLE_NAME+" where worker_id = ? and owner = ?", workerId, owner)
+
+	return err
+}
+
+/****************************************************/
+/*source 配置*/
+
+const sourceConfigColumns = "worker_source, start_id, bucket_step, max_id, generator_type, description, owner, created_at, updated_at"
+
+type sqlScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSourceConfig(scanner sqlScanner) (*SourceConfig, error) {
+	sourceConfig := new(SourceConfig)
+
+	err := scanner.Scan(&sourceConfig.Source, &sourceConfig.StartId, &sourceConfig.BucketStep, &sourceConfig.MaxId,
+		&sourceConfig.GeneratorType, &sourceConfig.Description, &sourceConfig.Owner,
+		&sourceConfig.CreatedAt, &sourceConfig.UpdatedAt)
+
+	return sourceConfig, err
+}
+
+func (serviceInstance *MysqlService) GetSourceConfig(source string) (*SourceConfig, error) {
+	row := serviceInstance.DB.QueryRow(
+		"select "+sourceConfigColumns+" from "+SOURCE_TABLE_NAME+" where worker_source = ? limit 1", source)
+
+	sourceConfig, err := scanSourceConfig(row)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	default:
+		return sourceConfig, nil
+	}
+}
+
+func (serviceInstance *MysqlService) SaveSourceConfig(sourceConfig *SourceConfig) error {
+	_, err := serviceInstance.DB.Exec(
+		"insert into "+SOURCE_TABLE_NAME+" ("+sourceConfigColumns+") values (?, ?, ?, ?, ?, ?, ?, ?, ?)"+
+			" on duplicate key update start_id = values(start_id), bucket_step = values(bucket_step),"+
+			" max_id = values(max_id), generator_type = values(generator_type), description = values(description),"+
+			" owner = values(owner), updated_at = values(updated_at)",
+		sourceConfig.Source, sourceConfig.StartId, sourceConfig.BucketStep, sourceConfig.MaxId,
+		sourceConfig.GeneratorType, sourceConfig.Description, sourceConfig.Owner,
+		sourceConfig.CreatedAt, sourceConfig.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	return serviceInstance.syncSourceMaxId(sourceConfig.Source, sourceConfig.MaxId)
+}
+
+func (serviceInstance *MysqlService) DeleteSourceConfig(source string) error {
+	_, err := serviceInstance.DB.Exec("delete from "+SOURCE_TABLE_NAME+" where worker_source = ?", source)
+	if err != nil {
+		return err
+	}
+
+	return serviceInstance.syncSourceMaxId(source, 0)
+}
+
+//source 配置的最大id 同步到 idGenerator 表, 还没有记录时插入一条 current_id 为0 的
+func (serviceInstance *MysqlService) syncSourceMaxId(source string, maxId int) error {
+	_, err := serviceInstance.DB.Exec(
+		"insert into "+serviceInstance.TableName+" (worker_source, max_id) values (?, ?)"+
+			" on duplicate key update max_id = values(max_id)",
+		source, maxId)
+
+	return err
+}
+
+func (serviceInstance *MysqlService) ListSourceConfigs() ([]*SourceConfig, error) {
+	rows, err := serviceInstance.DB.Query("select " + sourceConfigColumns + " from " + SOURCE_TABLE_NAME + " order by worker_source")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]*SourceConfig, 0)
+	for rows.Next() {
+		sourceConfig, err := scanSourceConfig(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, sourceConfig)
+	}
+
+	return result, rows.Err()
 }
 
 func checkErr(err interface{}) {
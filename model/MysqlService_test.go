@@ -0,0 +1,457 @@
+package model
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"idGenerator/model/cmap"
+)
+
+//进程内的 mysql 替身, 以 database/sql 驱动的方式实现 MysqlService 用到的语句, 只接受和代码中完全一致的语句(忽略大小写和空白)
+//事务中加的行锁持有到提交或回滚, 不在事务中的语句执行完立即释放, worker_source 上有唯一索引
+type mysqlStandIn struct {
+	lock *sync.Mutex
+	cond *sync.Cond
+
+	nextId   int
+	rows     map[int]*mysqlStandInRow
+	bySource map[string]*mysqlStandInRow
+	locks    map[int]*mysqlStandInTx
+
+	schema *mysqlStandInSchema //表结构升级用到的语句, 见 MysqlMigration_test.go
+}
+
+type mysqlStandInRow struct {
+	id         int
+	source     string
+	currentId  int
+	bucketStep int
+	maxId      int
+}
+
+type mysqlStandInTx struct {
+	conn   *mysqlStandInConn
+	undo   []func()
+	locked []int
+}
+
+type mysqlStandInConn struct {
+	server *mysqlStandIn
+	tx     *mysqlStandInTx
+}
+
+type mysqlStandInStmt struct {
+	conn  *mysqlStandInConn
+	query string
+}
+
+type mysqlStandInRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+type mysqlStandInDriver struct{}
+
+var mysqlStandIns = make(map[string]*mysqlStandIn)
+var mysqlStandInLock sync.Mutex
+var mysqlStandInRegister sync.Once
+
+func newMysqlStandInDB(t *testing.T, name string) (*sql.DB, *mysqlStandIn) {
+	mysqlStandInRegister.Do(func() {
+		sql.Register("mysql_stand_in", mysqlStandInDriver{})
+	})
+
+	lock := new(sync.Mutex)
+	server := &mysqlStandIn{
+		lock:     lock,
+		cond:     sync.NewCond(lock),
+		rows:     make(map[int]*mysqlStandInRow),
+		bySource: make(map[string]*mysqlStandInRow),
+		locks:    make(map[int]*mysqlStandInTx),
+		schema:   newMysqlStandInSchema(),
+	}
+
+	mysqlStandInLock.Lock()
+	mysqlStandIns[name] = server
+	mysqlStandInLock.Unlock()
+
+	db, err := sql.Open("mysql_stand_in", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(64)
+
+	return db, server
+}
+
+func (mysqlStandInDriver) Open(name string) (driver.Conn, error) {
+	mysqlStandInLock.Lock()
+	defer mysqlStandInLock.Unlock()
+
+	server, exist := mysqlStandIns[name]
+	if !exist {
+		return nil, errors.New("unknown stand-in: " + name)
+	}
+
+	return &mysqlStandInConn{server: server}, nil
+}
+
+func (conn *mysqlStandInConn) Prepare(query string) (driver.Stmt, error) {
+	return &mysqlStandInStmt{conn, query}, nil
+}
+
+func (conn *mysqlStandInConn) Close() error {
+	return nil
+}
+
+func (conn *mysqlStandInConn) Begin() (driver.Tx, error) {
+	conn.tx = &mysqlStandInTx{conn: conn}
+	return conn.tx, nil
+}
+
+func (tx *mysqlStandInTx) Commit() error {
+	tx.finish(false)
+	return nil
+}
+
+func (tx *mysqlStandInTx) Rollback() error {
+	tx.finish(true)
+	return nil
+}
+
+func (tx *mysqlStandInTx) finish(rollback bool) {
+	server := tx.conn.server
+
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	if rollback {
+		for i := len(tx.undo) - 1; i >= 0; i-- {
+			tx.undo[i]()
+		}
+	}
+
+	server.releaseLocks(tx)
+
+	if tx.conn.tx == tx {
+		tx.conn.tx = nil
+	}
+}
+
+func (stmt *mysqlStandInStmt) Close() error {
+	return nil
+}
+
+func (stmt *mysqlStandInStmt) NumInput() int {
+	return -1
+}
+
+func (stmt *mysqlStandInStmt) Exec(args []driver.Value) (driver.Result, error) {
+	rowsAffected, lastInsertId, _, err := stmt.conn.execute(stmt.query, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return mysqlStandInResult{lastInsertId, rowsAffected}, nil
+}
+
+func (stmt *mysqlStandInStmt) Query(args []driver.Value) (driver.Rows, error) {
+	_, _, rows, err := stmt.conn.execute(stmt.query, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+type mysqlStandInResult struct {
+	lastInsertId int64
+	rowsAffected int64
+}
+
+func (result mysqlStandInResult) LastInsertId() (int64, error) {
+	return result.lastInsertId, nil
+}
+
+func (result mysqlStandInResult) RowsAffected() (int64, error) {
+	return result.rowsAffected, nil
+}
+
+func (rows *mysqlStandInRows) Columns() []string {
+	return rows.columns
+}
+
+func (rows *mysqlStandInRows) Close() error {
+	return nil
+}
+
+func (rows *mysqlStandInRows) Next(dest []driver.Value) error {
+	if len(rows.values) == 0 {
+		return io.EOF
+	}
+
+	copy(dest, rows.values[0])
+	rows.values = rows.values[1:]
+
+	return nil
+}
+
+//加行锁, 被其他事务持有时等待
+func (server *mysqlStandIn) lockRow(tx *mysqlStandInTx, id int) {
+	for server.locks[id] != nil && server.locks[id] != tx {
+		server.cond.Wait()
+	}
+
+	if server.locks[id] == nil {
+		server.locks[id] = tx
+		tx.locked = append(tx.locked, id)
+	}
+}
+
+func (server *mysqlStandIn) releaseLocks(tx *mysqlStandInTx) {
+	for _, id := range tx.locked {
+		delete(server.locks, id)
+	}
+	tx.locked = nil
+
+	server.cond.Broadcast()
+}
+
+//执行一条语句, 不在事务中时 执行完立即释放锁
+func (conn *mysqlStandInConn) execute(query string, args []driver.Value) (int64, int64, *mysqlStandInRows, error) {
+	server := conn.server
+
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	tx := conn.tx
+	if tx == nil {
+		tx = &mysqlStandInTx{conn: conn}
+		defer server.releaseLocks(tx)
+	}
+
+	query = strings.Join(strings.Fields(strings.ToLower(query)), " ")
+
+	switch query {
+	case "insert into idgenerator (worker_source, current_id, bucket_step) values (?, 0, ?) on duplicate key update worker_source = worker_source",
+		"insert into idgenerator (worker_source, max_id) values (?, ?) on duplicate key update max_id = values(max_id)":
+		source := standInString(args[0])
+		syncMaxId := strings.HasSuffix(query, "max_id = values(max_id)")
+
+		if row, exist := server.bySource[source]; exist {
+			server.lockRow(tx, row.id)
+
+			if syncMaxId {
+				oldMaxId := row.maxId
+				tx.undo = append(tx.undo, func() { row.maxId = oldMaxId })
+				row.maxId = standInInt(args[1])
+			}
+
+			return 0, int64(row.id), nil, nil
+		}
+
+		server.nextId++
+		row := &mysqlStandInRow{id: server.nextId, source: source}
+		if syncMaxId {
+			row.maxId = standInInt(args[1])
+		} else {
+			row.bucketStep = standInInt(args[1])
+		}
+		server.rows[row.id] = row
+		server.bySource[source] = row
+		server.lockRow(tx, row.id)
+
+		tx.undo = append(tx.undo, func() {
+			delete(server.rows, row.id)
+			delete(server.bySource, row.source)
+		})
+
+		return 1, int64(row.id), nil, nil
+
+	case "select id, current_id, max_id from idgenerator where worker_source = ? limit 1 for update":
+		rows := &mysqlStandInRows{columns: []string{"id", "current_id", "max_id"}}
+
+		if row, exist := server.bySource[standInString(args[0])]; exist {
+			server.lockRow(tx, row.id)
+			rows.values = append(rows.values, []driver.Value{int64(row.id), int64(row.currentId), int64(row.maxId)})
+		}
+
+		return 0, 0, rows, nil
+
+	case "update idgenerator set current_id = ?, bucket_step = ? where id = ?":
+		row, exist := server.rows[standInInt(args[2])]
+		if !exist {
+			return 0, 0, nil, nil
+		}
+
+		server.lockRow(tx, row.id)
+
+		oldCurrentId, oldBucketStep := row.currentId, row.bucketStep
+		tx.undo = append(tx.undo, func() {
+			row.currentId, row.bucketStep = oldCurrentId, oldBucketStep
+		})
+
+		row.currentId, row.bucketStep = standInInt(args[0]), standInInt(args[1])
+
+		return 1, 0, nil, nil
+
+	case "select bucket_step from idgenerator where worker_source = ? limit 1":
+		rows := &mysqlStandInRows{columns: []string{"bucket_step"}}
+
+		if row, exist := server.bySource[standInString(args[0])]; exist {
+			rows.values = append(rows.values, []driver.Value{int64(row.bucketStep)})
+		}
+
+		return 0, 0, rows, nil
+
+	//source 配置不保存, 每次都是未注册的source
+	case "select worker_source, start_id, bucket_step, max_id, generator_type, description, owner, created_at, updated_at from idgeneratorsource where worker_source = ? limit 1":
+		return 0, 0, &mysqlStandInRows{columns: strings.Split(sourceConfigColumns, ", ")}, nil
+
+	case "insert into idgeneratorsource (worker_source, start_id, bucket_step, max_id, generator_type, description, owner, created_at, updated_at)" +
+		" values (?, ?, ?, ?, ?, ?, ?, ?, ?) on duplicate key update start_id = values(start_id), bucket_step = values(bucket_step)," +
+		" max_id = values(max_id), generator_type = values(generator_type), description = values(description)," +
+		" owner = values(owner), updated_at = values(updated_at)":
+		return 1, 0, nil, nil
+	}
+
+	if rows, handled, err := server.executeSchema(conn, query, args); handled {
+		return 0, 0, rows, err
+	}
+
+	return 0, 0, nil, errors.New("stand-in does not support: " + query)
+}
+
+//并发第一次加载同一个新source, 只能有一条记录, 每次加载的号段不能重叠
+func TestMysqlServiceConcurrentFirstLoad(t *testing.T) {
+	db, server := newMysqlStandInDB(t, "first_load")
+	defer db.Close()
+
+	goroutines := 50
+	bucketStep := 10
+
+	var lock sync.Mutex
+	seen := make(map[int]bool)
+
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			service := &MysqlService{db, "idGenerator"}
+			currentId := service.LoadCurrentIdFromDb("new_source", bucketStep)
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			if seen[currentId] {
+				t.Errorf("duplicate segment: %d", currentId)
+			}
+			seen[currentId] = true
+		}()
+	}
+
+	wg.Wait()
+
+	if len(server.rows) != 1 {
+		t.Fatalf("rows of new_source: %d", len(server.rows))
+	}
+
+	if currentId := server.bySource["new_source"].currentId; currentId != goroutines*bucketStep {
+		t.Errorf("current_id: %d", currentId)
+	}
+}
+
+//两个 worker 模拟两个实例 共用一个库并发获取id, 不能有重复
+func TestMysqlServiceConcurrentUnique(t *testing.T) {
+	db, _ := newMysqlStandInDB(t, "concurrent_unique")
+	defer db.Close()
+
+	setTestSegmentStore("mysql_concurrent", &MysqlService{db, "idGenerator"})
+
+	GetApplication().ConfigData.BucketStep = 5
+	GetApplication().ConfigData.PersistType = "mysql_concurrent"
+
+	workers := []*AutoIncrIdWorker{
+		{WorkerMap: cmap.New(), PersistType: "mysql_concurrent"},
+		{WorkerMap: cmap.New(), PersistType: "mysql_concurrent"},
+	}
+
+	var lock sync.Mutex
+	seen := make(map[int]bool)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+
+		go func(index int) {
+			defer wg.Done()
+
+			worker := workers[index%len(workers)]
+			var ids []int
+
+			for j := 0; j < 20; j++ {
+				id, err := worker.NextId("", "mysql_source")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				ids = append(ids, id)
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			for _, id := range ids {
+				if seen[id] {
+					t.Errorf("duplicate id: %d", id)
+				}
+				seen[id] = true
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if len(seen) != 100*20 {
+		t.Errorf("got %d ids", len(seen))
+	}
+}
+
+//source 配置的最大id 同步到库中后, 超出时不再分配号段
+func TestMysqlServiceMaxId(t *testing.T) {
+	db, _ := newMysqlStandInDB(t, "max_id")
+	defer db.Close()
+
+	service := &MysqlService{db, "idGenerator"}
+	if err := service.syncSourceMaxId("capped", 25); err != nil {
+		t.Fatal(err)
+	}
+
+	if currentId := service.LoadCurrentIdFromDb("capped", 10); currentId != 0 {
+		t.Errorf("first load: %d", currentId)
+	}
+
+	if currentId, maxId := service.IncrSourceCurrentId("capped", 10, 10); currentId != 10 || maxId != 20 {
+		t.Errorf("incr: %d, %d", currentId, maxId)
+	}
+
+	if currentId, maxId := service.IncrSourceCurrentId("capped", 20, 10); currentId != 20 || maxId != 30 {
+		t.Errorf("incr below max: %d, %d", currentId, maxId)
+	}
+
+	defer func() {
+		if err := recover(); err == nil {
+			t.Error("segment over max_id allocated")
+		}
+	}()
+
+	service.IncrSourceCurrentId("capped", 30, 10)
+}
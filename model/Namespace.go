@@ -0,0 +1,70 @@
+package model
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+const (
+	NAMESPACE_PARAM  = "namespace"      //请求参数中的namespace
+	NAMESPACE_HEADER = "X-Id-Namespace" //没有参数时使用请求头
+
+	NAMESPACE_SEPARATOR = "/" //namespace 和source 之间的分隔符
+)
+
+//namespace 只能包含字母, 数字, 下划线, 中划线
+var namespacePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+//空字符串表示默认的namespace
+func ValidateNamespace(namespace string) error {
+	if namespace != "" && !namespacePattern.MatchString(namespace) {
+		return errors.New("namespace 只能包含字母, 数字, _, -, 最长64个字符")
+	}
+
+	return nil
+}
+
+//source 不能包含namespace 分隔符, 否则默认namespace 的 "t/orders" 和namespace t 的 "orders" 会使用同一个号段
+func ValidateSource(source string) error {
+	if strings.Contains(source, NAMESPACE_SEPARATOR) {
+		return errors.New("source 不能包含 " + NAMESPACE_SEPARATOR)
+	}
+
+	return nil
+}
+
+//带namespace 的source, 用于内存中的号段和source 配置, 默认namespace 时就是source 本身
+func NamespacedSource(namespace string, source string) string {
+	if namespace == "" {
+		return source
+	}
+
+	return namespace + NAMESPACE_SEPARATOR + source
+}
+
+//不能按namespace 分开存储的持久化, 通过给source 加前缀区分
+type namespacedSegmentStore struct {
+	store     SegmentStore
+	namespace string
+}
+
+func withSourceNamespace(store SegmentStore, namespace string) SegmentStore {
+	if namespace == "" {
+		return store
+	}
+
+	return &namespacedSegmentStore{store, namespace}
+}
+
+func (this *namespacedSegmentStore) LoadCurrentIdFromDb(source string, bucketStep int) int {
+	return this.store.LoadCurrentIdFromDb(NamespacedSource(this.namespace, source), bucketStep)
+}
+
+func (this *namespacedSegmentStore) IncrSourceCurrentId(source string, currentId int, bucketStep int) (int, int) {
+	return this.store.IncrSourceCurrentId(NamespacedSource(this.namespace, source), currentId, bucketStep)
+}
+
+func (this *namespacedSegmentStore) LoadSourceStep(source string) int {
+	return this.store.LoadSourceStep(NamespacedSource(this.namespace, source))
+}
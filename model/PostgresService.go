@@ -0,0 +1,94 @@
+package model
+
+import (
+	"database/sql"
+	"idGenerator/model/logger"
+	"strconv"
+)
+
+const (
+	PERSIST_TYPE_POSTGRESQL = "postgresql" //postgresql持久化
+)
+
+//使用 postgresql 保存每个source 已分配的最大值, 表结构见 sql/postgresql.sql
+//每次分配都是一条语句, 由行锁保证原子性, 不需要显式事务
+type PostgresService struct {
+	DB        *sql.DB
+	TableName string
+}
+
+func init() {
+	RegisterSegmentStore(PERSIST_TYPE_POSTGRESQL, func(namespace string) SegmentStore {
+		return withSourceNamespace(NewPostgresService(), namespace)
+	})
+}
+
+func NewPostgresService() *PostgresService {
+	db, err := GetApplication().GetPostgresDB()
+	checkErr(err)
+
+	return &PostgresService{db, "idGenerator"}
+}
+
+//从db中load当前的current_id ，并增大库中的id, 还没有记录时插入
+func (serviceInstance *PostgresService) LoadCurrentIdFromDb(source string, bucketStep int) int {
+	if source == "" || bucketStep < 1 {
+		panic("业务参数错误，或者id递增步长错误")
+	}
+
+	var newDbCurrentId int
+
+	err := serviceInstance.DB.QueryRow(
+		"INSERT INTO "+serviceInstance.TableName+" (worker_source, current_id, bucket_step) VALUES ($1, $2, $2)"+
+			" ON CONFLICT (worker_source) DO UPDATE"+
+			" SET current_id = "+serviceInstance.TableName+".current_id + EXCLUDED.bucket_step, bucket_step = EXCLUDED.bucket_step"+
+			" RETURNING current_id",
+		source, bucketStep).Scan(&newDbCurrentId)
+	checkErr(err)
+
+	currentId := newDbCurrentId - bucketStep
+	logger.AsyncInfo("load current id from postgresql, source: " + source + " , currentId: " + strconv.Itoa(currentId))
+
+	return currentId
+}
+
+//持久化一个新号段, 库中的值大于 currentId 时(其他实例已分配) 从库中的值开始
+func (serviceInstance *PostgresService) IncrSourceCurrentId(source string, currentId int, bucketStep int) (resultCurrentId int, newDbCurrentId int) {
+	if source == "" || currentId < 1 || bucketStep < 1 {
+		panic("parameter error")
+	}
+
+	err := serviceInstance.DB.QueryRow(
+		"UPDATE "+serviceInstance.TableName+" SET current_id = GREATEST(current_id, $2) + $3, bucket_step = $3"+
+			" WHERE worker_source = $1 RETURNING current_id",
+		source, currentId, bucketStep).Scan(&newDbCurrentId)
+
+	if err == sql.ErrNoRows {
+		panic("source 还没有加载: " + source)
+	}
+	checkErr(err)
+
+	resultCurrentId = newDbCurrentId - bucketStep
+
+	logger.AsyncInfo("source: " + source + " update postgresql current_id to " + strconv.Itoa(newDbCurrentId))
+
+	return resultCurrentId, newDbCurrentId
+}
+
+//source 最近一次使用的步长, 没有记录时返回0
+func (serviceInstance *PostgresService) LoadSourceStep(source string) int {
+	var bucketStep int
+
+	err := serviceInstance.DB.QueryRow(
+		"SELECT bucket_step FROM "+serviceInstance.TableName+" WHERE worker_source = $1 LIMIT 1",
+		source).Scan(&bucketStep)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return 0
+	case err != nil:
+		panic(err)
+	default:
+		return bucketStep
+	}
+}
@@ -0,0 +1,328 @@
+package model
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"idGenerator/model/cmap"
+)
+
+//进程内的 postgresql 替身, 以 database/sql 驱动的方式实现 PostgresService 用到的语句
+//每条语句在锁内执行, 和 postgresql 单条语句的行锁一样是原子的
+type postgresStandIn struct {
+	lock sync.Mutex
+	rows map[string]*postgresStandInRow
+}
+
+type postgresStandInRow struct {
+	currentId  int
+	bucketStep int
+}
+
+type postgresStandInConn struct {
+	server *postgresStandIn
+}
+
+type postgresStandInStmt struct {
+	conn  *postgresStandInConn
+	query string
+}
+
+type postgresStandInRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+type postgresStandInDriver struct{}
+
+var postgresStandIns = make(map[string]*postgresStandIn)
+var postgresStandInLock sync.Mutex
+var postgresStandInRegister sync.Once
+
+func newPostgresStandInDB(t *testing.T, name string) (*sql.DB, *postgresStandIn) {
+	postgresStandInRegister.Do(func() {
+		sql.Register("postgres_stand_in", postgresStandInDriver{})
+	})
+
+	server := &postgresStandIn{rows: make(map[string]*postgresStandInRow)}
+
+	postgresStandInLock.Lock()
+	postgresStandIns[name] = server
+	postgresStandInLock.Unlock()
+
+	db, err := sql.Open("postgres_stand_in", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(64)
+
+	return db, server
+}
+
+func (postgresStandInDriver) Open(name string) (driver.Conn, error) {
+	postgresStandInLock.Lock()
+	defer postgresStandInLock.Unlock()
+
+	server, exist := postgresStandIns[name]
+	if !exist {
+		return nil, errors.New("unknown stand-in: " + name)
+	}
+
+	return &postgresStandInConn{server}, nil
+}
+
+func (conn *postgresStandInConn) Prepare(query string) (driver.Stmt, error) {
+	return &postgresStandInStmt{conn, query}, nil
+}
+
+func (conn *postgresStandInConn) Close() error {
+	return nil
+}
+
+func (conn *postgresStandInConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("stand-in does not support transactions")
+}
+
+func (stmt *postgresStandInStmt) Close() error {
+	return nil
+}
+
+func (stmt *postgresStandInStmt) NumInput() int {
+	return -1
+}
+
+func (stmt *postgresStandInStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("stand-in does not support exec: " + stmt.query)
+}
+
+func (stmt *postgresStandInStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return stmt.conn.server.query(stmt.query, args)
+}
+
+func (rows *postgresStandInRows) Columns() []string {
+	return rows.columns
+}
+
+func (rows *postgresStandInRows) Close() error {
+	return nil
+}
+
+func (rows *postgresStandInRows) Next(dest []driver.Value) error {
+	if len(rows.values) == 0 {
+		return io.EOF
+	}
+
+	copy(dest, rows.values[0])
+	rows.values = rows.values[1:]
+
+	return nil
+}
+
+func standInInt(value driver.Value) int {
+	switch v := value.(type) {
+	case int64:
+		return int(v)
+	case []byte:
+		n, _ := strconv.Atoi(string(v))
+		return n
+	case string:
+		n, _ := strconv.Atoi(v)
+		return n
+	}
+
+	return 0
+}
+
+func standInString(value driver.Value) string {
+	switch v := value.(type) {
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	}
+
+	return ""
+}
+
+func (server *postgresStandIn) query(query string, args []driver.Value) (driver.Rows, error) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	query = strings.Join(strings.Fields(strings.ToLower(query)), " ")
+
+	switch query {
+	case "insert into idgenerator (worker_source, current_id, bucket_step) values ($1, $2, $2)" +
+		" on conflict (worker_source) do update" +
+		" set current_id = idgenerator.current_id + excluded.bucket_step, bucket_step = excluded.bucket_step returning current_id":
+		source, bucketStep := standInString(args[0]), standInInt(args[1])
+
+		row, exist := server.rows[source]
+		if !exist {
+			row = &postgresStandInRow{}
+			server.rows[source] = row
+		}
+
+		row.currentId, row.bucketStep = row.currentId+bucketStep, bucketStep
+
+		return &postgresStandInRows{[]string{"current_id"}, [][]driver.Value{{int64(row.currentId)}}}, nil
+
+	case "update idgenerator set current_id = greatest(current_id, $2) + $3, bucket_step = $3 where worker_source = $1 returning current_id":
+		rows := &postgresStandInRows{columns: []string{"current_id"}}
+
+		row, exist := server.rows[standInString(args[0])]
+		if !exist {
+			return rows, nil
+		}
+
+		currentId, bucketStep := standInInt(args[1]), standInInt(args[2])
+		if row.currentId > currentId {
+			currentId = row.currentId
+		}
+
+		row.currentId, row.bucketStep = currentId+bucketStep, bucketStep
+		rows.values = append(rows.values, []driver.Value{int64(row.currentId)})
+
+		return rows, nil
+
+	case "select bucket_step from idgenerator where worker_source = $1 limit 1":
+		rows := &postgresStandInRows{columns: []string{"bucket_step"}}
+
+		if row, exist := server.rows[standInString(args[0])]; exist {
+			rows.values = append(rows.values, []driver.Value{int64(row.bucketStep)})
+		}
+
+		return rows, nil
+	}
+
+	return nil, errors.New("stand-in does not support: " + query)
+}
+
+//库中的值只增不减: 其他实例已经分配到更大的值时 从库中的值开始, 传入更大的 currentId 时跳过中间的id
+func TestPostgresServiceRaiseOnly(t *testing.T) {
+	db, server := newPostgresStandInDB(t, "raise_only")
+	defer db.Close()
+
+	service := &PostgresService{db, "idGenerator"}
+
+	if currentId := service.LoadCurrentIdFromDb("order", 10); currentId != 0 {
+		t.Errorf("first load: %d", currentId)
+	}
+	if currentId := service.LoadCurrentIdFromDb("order", 10); currentId != 10 {
+		t.Errorf("second load: %d", currentId)
+	}
+
+	cases := []struct {
+		currentId       int
+		bucketStep      int
+		resultCurrentId int
+		newDbCurrentId  int
+	}{
+		{5, 10, 20, 30},     //库中的值更大
+		{30, 10, 30, 40},    //正好接上
+		{100, 20, 100, 120}, //跳到更大的 currentId
+		{50, 5, 120, 125},   //不会减小
+	}
+
+	for _, c := range cases {
+		resultCurrentId, newDbCurrentId := service.IncrSourceCurrentId("order", c.currentId, c.bucketStep)
+		if resultCurrentId != c.resultCurrentId || newDbCurrentId != c.newDbCurrentId {
+			t.Errorf("incr(%d, %d): %d, %d", c.currentId, c.bucketStep, resultCurrentId, newDbCurrentId)
+		}
+	}
+
+	if row := server.rows["order"]; row.currentId != 125 {
+		t.Errorf("current_id: %d", row.currentId)
+	}
+
+	if step := service.LoadSourceStep("order"); step != 5 {
+		t.Errorf("step: %d", step)
+	}
+	if step := service.LoadSourceStep("missing"); step != 0 {
+		t.Errorf("missing step: %d", step)
+	}
+
+	defer func() {
+		if err := recover(); err == nil {
+			t.Error("incr of a source never loaded")
+		}
+	}()
+
+	service.IncrSourceCurrentId("missing", 1, 10)
+}
+
+//两个 worker 模拟两个实例 共用一个库并发获取id, 号段不重叠, 不能有重复
+func TestPostgresServiceConcurrentUnique(t *testing.T) {
+	db, _ := newPostgresStandInDB(t, "concurrent_unique")
+	defer db.Close()
+
+	setTestSegmentStore("postgres_concurrent", &PostgresService{db, "idGenerator"})
+
+	GetApplication().ConfigData.BucketStep = 5
+	GetApplication().ConfigData.PersistType = "postgres_concurrent"
+
+	workers := []*AutoIncrIdWorker{
+		{WorkerMap: cmap.New(), PersistType: "postgres_concurrent"},
+		{WorkerMap: cmap.New(), PersistType: "postgres_concurrent"},
+	}
+
+	var lock sync.Mutex
+	seen := make(map[int]bool)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+
+		go func(index int) {
+			defer wg.Done()
+
+			worker := workers[index%len(workers)]
+			var ids []int
+
+			for j := 0; j < 20; j++ {
+				if j%5 == 0 {
+					ranges, err := worker.NextIds("", "postgres_source", 7)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+
+					for _, idRange := range ranges {
+						for id := idRange.FirstId; id <= idRange.LastId; id++ {
+							ids = append(ids, id)
+						}
+					}
+					continue
+				}
+
+				id, err := worker.NextId("", "postgres_source")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				ids = append(ids, id)
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			for _, id := range ids {
+				if seen[id] {
+					t.Errorf("duplicate id: %d", id)
+				}
+				seen[id] = true
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if len(seen) != 100*(16+4*7) {
+		t.Errorf("got %d ids", len(seen))
+	}
+}
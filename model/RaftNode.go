@@ -0,0 +1,1156 @@
+package model
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"idGenerator/model/logger"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	RAFT_ROLE_FOLLOWER  = 0
+	RAFT_ROLE_CANDIDATE = 1
+	RAFT_ROLE_LEADER    = 2
+
+	RAFT_OP_LOAD  = "load"  //第一次加载source, 返回原来的最大值, 最大值增加 bucketStep
+	RAFT_OP_INCR  = "incr"  //持久化一个新号段, 和 IncrSourceCurrentId 相同
+	RAFT_OP_RAISE = "raise" //导入, 最大值只增不减, 和 ImportBoltCounters 相同
+
+	RAFT_META_BUCKET_NAME = "RaftMeta" //当前任期, 投票对象 和 快照
+	RAFT_LOG_BUCKET_NAME  = "RaftLog"  //raft 日志, key 为大端的序号
+
+	DEFAULT_RAFT_ELECTION_TIMEOUT_MS = 1000
+	DEFAULT_RAFT_HEARTBEAT_MS        = 100
+	DEFAULT_RAFT_PROPOSE_TIMEOUT_MS  = 3000
+
+	RAFT_MAX_APPEND_ENTRIES = 500 //一次 AppendEntries 最多发送的日志条数
+
+	DEFAULT_RAFT_SNAPSHOT_LOGS = 10000 //已执行的日志超过这个条数时 生成快照 并删除快照之前的日志
+)
+
+var ErrRaftNotLeader = errors.New("当前节点不是leader")
+var ErrRaftProposeTimeout = errors.New("等待多数节点确认超时")
+var ErrRaftLeadershipLost = errors.New("提交前 leader 已变化")
+var ErrRaftStopped = errors.New("raft 节点已停止")
+
+var raftTermKey = []byte("term")
+var raftVotedForKey = []byte("votedFor")
+var raftSnapshotKey = []byte("snapshot")
+
+//修改source 最大值的命令, 所有节点按日志顺序执行, 结果相同
+type RaftCommand struct {
+	Op         string `json:"op"`
+	Source     string `json:"source"`
+	CurrentId  int    `json:"currentId"`
+	BucketStep int    `json:"bucketStep"`
+}
+
+//load, raise: CurrentId 为原来的最大值; incr: CurrentId 为实际的起始id; NewCurrentId 为新的最大值
+type RaftCommandResult struct {
+	CurrentId    int
+	NewCurrentId int
+	Created      bool //raise: 之前没有这个source
+}
+
+//Command 为nil 时是leader 当选时写入的空日志, 用来提交之前任期的日志
+type RaftLogEntry struct {
+	Index   uint64       `json:"index"`
+	Term    uint64       `json:"term"`
+	Command *RaftCommand `json:"command"`
+}
+
+//已执行日志的结果: 每个source 的最大值, Index 之前(包含)的日志已删除
+type RaftSnapshot struct {
+	Index    uint64                  `json:"index"`
+	Term     uint64                  `json:"term"`
+	Counters map[string]*raftCounter `json:"counters"`
+}
+
+type RaftRequestVoteArgs struct {
+	Term         uint64
+	CandidateId  int
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+type RaftRequestVoteReply struct {
+	Term        uint64
+	VoteGranted bool
+}
+
+type RaftAppendEntriesArgs struct {
+	Term         uint64
+	LeaderId     int
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []*RaftLogEntry
+	LeaderCommit uint64
+}
+
+//失败时 LastLogIndex 为leader 下次可以尝试的 PrevLogIndex
+type RaftAppendEntriesReply struct {
+	Term         uint64
+	Success      bool
+	LastLogIndex uint64
+}
+
+//follower 需要的日志已被删除时 leader 发送快照
+type RaftInstallSnapshotArgs struct {
+	Term     uint64
+	LeaderId int
+	Snapshot *RaftSnapshot
+}
+
+type RaftInstallSnapshotReply struct {
+	Term uint64
+}
+
+type RaftNodeConfig struct {
+	Id                int                 //在 Peers 中的序号, 从1开始
+	Peers             []string            //所有节点的地址, 包含自己
+	FilePath          string
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	ProposeTimeout    time.Duration
+	SnapshotLogs      int                 //已执行的日志超过这个条数时 生成快照
+	OnRaise           func(source string) //source 的最大值被导入 或 安装快照后增大时调用, 丢弃本节点的内存号段
+}
+
+type raftCounter struct {
+	CurrentId  int
+	BucketStep int
+}
+
+type raftApplyResult struct {
+	result *RaftCommandResult
+	err    error
+}
+
+//等待日志提交的请求, 日志被其他任期的日志覆盖时失败
+type raftWaiter struct {
+	term   uint64
+	result chan *raftApplyResult
+}
+
+//raft 节点, 复制每个source 已分配的最大值, 多数节点写入日志后才返回, 少数节点宕机不会重复分配
+type RaftNode struct {
+	Config RaftNodeConfig
+
+	lock      sync.Mutex
+	applyCond *sync.Cond
+	db        *bolt.DB
+	transport *raftTransport
+	stopped   bool
+
+	role          int
+	currentTerm   uint64
+	votedFor      int
+	leaderId      int
+	logs          []*RaftLogEntry //logs[i] 的序号为 snapshotIndex+i+1
+	snapshotIndex uint64          //快照包含的最后一条日志
+	snapshotTerm  uint64
+	commitIndex   uint64
+	lastApplied   uint64
+	nextIndex     map[int]uint64
+	matchIndex    map[int]uint64
+
+	electionDeadline time.Time
+	heartbeatAt      time.Time
+
+	counters map[string]*raftCounter //key 为带namespace 的source
+	snapshot *RaftSnapshot           //最近的快照, 发送给落后的follower
+	waiters  map[uint64]*raftWaiter
+}
+
+//打开raft 日志文件, 恢复任期, 快照 和 日志, 快照之后已提交的日志在 leader 通知提交后重新执行
+func NewRaftNode(config RaftNodeConfig) (*RaftNode, error) {
+	if len(config.Peers)%2 == 0 {
+		return nil, errors.New(fmt.Sprintf("raft 节点数需要是奇数, 当前: %d", len(config.Peers)))
+	}
+
+	if config.Id < 1 || config.Id > len(config.Peers) {
+		return nil, errors.New(fmt.Sprintf("raft nodeId 超出范围: %d", config.Id))
+	}
+
+	if config.ElectionTimeout <= 0 {
+		config.ElectionTimeout = DEFAULT_RAFT_ELECTION_TIMEOUT_MS * time.Millisecond
+	}
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = DEFAULT_RAFT_HEARTBEAT_MS * time.Millisecond
+	}
+	if config.ProposeTimeout <= 0 {
+		config.ProposeTimeout = DEFAULT_RAFT_PROPOSE_TIMEOUT_MS * time.Millisecond
+	}
+	if config.SnapshotLogs <= 0 {
+		config.SnapshotLogs = DEFAULT_RAFT_SNAPSHOT_LOGS
+	}
+
+	db, err := bolt.Open(config.FilePath, 0644, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	node := &RaftNode{
+		Config:     config,
+		db:         db,
+		logs:       make([]*RaftLogEntry, 0),
+		nextIndex:  make(map[int]uint64),
+		matchIndex: make(map[int]uint64),
+		counters:   make(map[string]*raftCounter),
+		waiters:    make(map[uint64]*raftWaiter),
+	}
+	node.applyCond = sync.NewCond(&node.lock)
+
+	if err := node.loadState(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return node, nil
+}
+
+func (node *RaftNode) loadState() error {
+	return node.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists([]byte(RAFT_META_BUCKET_NAME))
+		if err != nil {
+			return err
+		}
+
+		if value := meta.Get(raftTermKey); len(value) == 8 {
+			node.currentTerm = binary.BigEndian.Uint64(value)
+		}
+		if value := meta.Get(raftVotedForKey); len(value) == 8 {
+			node.votedFor = int(binary.BigEndian.Uint64(value))
+		}
+
+		if value := meta.Get(raftSnapshotKey); value != nil {
+			snapshot := new(RaftSnapshot)
+			if err := json.Unmarshal(value, snapshot); err != nil {
+				return err
+			}
+
+			node.restoreSnapshot(snapshot)
+		}
+
+		logBucket, err := tx.CreateBucketIfNotExists([]byte(RAFT_LOG_BUCKET_NAME))
+		if err != nil {
+			return err
+		}
+
+		return logBucket.ForEach(func(key []byte, value []byte) error {
+			entry := new(RaftLogEntry)
+			if err := json.Unmarshal(value, entry); err != nil {
+				return err
+			}
+
+			if entry.Index != node.lastIndex()+1 {
+				return errors.New(fmt.Sprintf("raft 日志不连续: %d", entry.Index))
+			}
+
+			node.logs = append(node.logs, entry)
+			return nil
+		})
+	})
+}
+
+//开始处理 raft 请求, 选举 和 执行已提交的日志
+func (node *RaftNode) Start(listener net.Listener) {
+	node.lock.Lock()
+	node.transport = newRaftTransport(node, listener)
+	node.resetElectionDeadline()
+	node.lock.Unlock()
+
+	go node.transport.serve()
+	go node.tickLoop()
+	go node.applyLoop()
+
+	logger.AsyncInfo(fmt.Sprintf("raft 节点启动, id: %d, address: %s, term: %d, snapshot: %d, logs: %d", node.Config.Id, listener.Addr(), node.currentTerm, node.snapshotIndex, len(node.logs)))
+}
+
+//停止节点, 等待中的请求返回 ErrRaftStopped
+func (node *RaftNode) Stop() {
+	node.lock.Lock()
+	if node.stopped {
+		node.lock.Unlock()
+		return
+	}
+
+	node.stopped = true
+	node.failWaiters(ErrRaftStopped)
+	node.applyCond.Broadcast()
+	transport := node.transport
+	node.lock.Unlock()
+
+	if transport != nil {
+		transport.close()
+	}
+
+	node.db.Close()
+}
+
+//当前节点是否为leader, 以及已知的leader
+func (node *RaftNode) Leader() (isLeader bool, leaderId int) {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	return node.role == RAFT_ROLE_LEADER, node.leaderId
+}
+
+//本节点已执行的source 最近一次使用的步长, 没有记录时返回0
+func (node *RaftNode) SourceStep(source string) int {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	if counter, exist := node.counters[source]; exist {
+		return counter.BucketStep
+	}
+
+	return 0
+}
+
+//提交一个命令, 多数节点写入日志 并在本节点执行后返回结果; 不是leader 时转发给leader
+//超时的命令之后仍可能被提交, 只会浪费这个号段, 不会重复分配
+func (node *RaftNode) Propose(command *RaftCommand) (*RaftCommandResult, error) {
+	if command == nil || command.Source == "" || (command.BucketStep < 1 && command.Op != RAFT_OP_RAISE) {
+		return nil, errors.New("业务参数错误，或者id递增步长错误")
+	}
+
+	deadline := time.Now().Add(node.Config.ProposeTimeout)
+
+	for {
+		result, leaderId, err := node.proposeLocal(command, deadline)
+		if err != ErrRaftNotLeader {
+			return result, err
+		}
+
+		if leaderId > 0 {
+			result = new(RaftCommandResult)
+			if err = node.transport.call(leaderId, "RaftRpcService.Propose", command, result, time.Until(deadline)); err == nil {
+				return result, nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return nil, ErrRaftProposeTimeout
+		}
+
+		time.Sleep(node.Config.HeartbeatInterval / 2)
+	}
+}
+
+func (node *RaftNode) proposeLocal(command *RaftCommand, deadline time.Time) (*RaftCommandResult, int, error) {
+	node.lock.Lock()
+
+	if node.stopped {
+		node.lock.Unlock()
+		return nil, 0, ErrRaftStopped
+	}
+
+	if node.role != RAFT_ROLE_LEADER {
+		leaderId := node.leaderId
+		node.lock.Unlock()
+		return nil, leaderId, ErrRaftNotLeader
+	}
+
+	entry, err := node.appendLocal(command)
+	if err != nil {
+		node.lock.Unlock()
+		return nil, 0, err
+	}
+
+	waiter := &raftWaiter{entry.Term, make(chan *raftApplyResult, 1)}
+	node.waiters[entry.Index] = waiter
+
+	node.broadcastAppendEntries()
+	node.advanceCommit()
+	node.lock.Unlock()
+
+	select {
+	case applied := <-waiter.result:
+		return applied.result, 0, applied.err
+
+	case <-time.After(time.Until(deadline)):
+		node.lock.Lock()
+		delete(node.waiters, entry.Index)
+		node.lock.Unlock()
+
+		return nil, 0, ErrRaftProposeTimeout
+	}
+}
+
+/****************************************************/
+/*选举*/
+
+func (node *RaftNode) tickLoop() {
+	for {
+		time.Sleep(10 * time.Millisecond)
+
+		node.lock.Lock()
+		if node.stopped {
+			node.lock.Unlock()
+			return
+		}
+
+		now := time.Now()
+		if node.role == RAFT_ROLE_LEADER {
+			if !now.Before(node.heartbeatAt) {
+				node.broadcastAppendEntries()
+			}
+		} else if now.After(node.electionDeadline) {
+			node.startElection()
+		}
+
+		node.lock.Unlock()
+	}
+}
+
+//随机的选举超时 [ElectionTimeout, 2 * ElectionTimeout), 避免同时发起选举
+func (node *RaftNode) resetElectionDeadline() {
+	timeout := node.Config.ElectionTimeout + time.Duration(rand.Int63n(int64(node.Config.ElectionTimeout)))
+	node.electionDeadline = time.Now().Add(timeout)
+}
+
+func (node *RaftNode) majority() int {
+	return len(node.Config.Peers)/2 + 1
+}
+
+func (node *RaftNode) lastIndex() uint64 {
+	return node.snapshotIndex + uint64(len(node.logs))
+}
+
+//快照之前的日志已删除, 返回0
+func (node *RaftNode) termAt(index uint64) uint64 {
+	if index == node.snapshotIndex {
+		return node.snapshotTerm
+	}
+
+	if index < node.snapshotIndex || index > node.lastIndex() {
+		return 0
+	}
+
+	return node.entryAt(index).Term
+}
+
+//index 需要在快照之后
+func (node *RaftNode) entryAt(index uint64) *RaftLogEntry {
+	return node.logs[index-node.snapshotIndex-1]
+}
+
+func (node *RaftNode) startElection() {
+	node.role = RAFT_ROLE_CANDIDATE
+	node.currentTerm++
+	node.votedFor = node.Config.Id
+	node.leaderId = 0
+	node.resetElectionDeadline()
+
+	if err := node.persistState(); err != nil {
+		logger.AsyncInfo(fmt.Sprintf("raft 保存任期异常: %v", err))
+		return
+	}
+
+	term := node.currentTerm
+	args := &RaftRequestVoteArgs{term, node.Config.Id, node.lastIndex(), node.termAt(node.lastIndex())}
+
+	votes := 1
+	if votes >= node.majority() {
+		node.becomeLeader()
+		return
+	}
+
+	for peerId := range node.Config.Peers {
+		peerId++
+		if peerId == node.Config.Id {
+			continue
+		}
+
+		go func(peerId int) {
+			reply := new(RaftRequestVoteReply)
+			if err := node.transport.call(peerId, "RaftRpcService.RequestVote", args, reply, node.Config.ElectionTimeout/2); err != nil {
+				return
+			}
+
+			node.lock.Lock()
+			defer node.lock.Unlock()
+
+			if node.stopped {
+				return
+			}
+
+			if reply.Term > node.currentTerm {
+				node.becomeFollower(reply.Term)
+				return
+			}
+
+			if node.role != RAFT_ROLE_CANDIDATE || node.currentTerm != term || !reply.VoteGranted {
+				return
+			}
+
+			votes++
+			if votes >= node.majority() {
+				node.becomeLeader()
+			}
+		}(peerId)
+	}
+}
+
+func (node *RaftNode) becomeFollower(term uint64) {
+	if term > node.currentTerm {
+		node.currentTerm = term
+		node.votedFor = 0
+
+		if err := node.persistState(); err != nil {
+			logger.AsyncInfo(fmt.Sprintf("raft 保存任期异常: %v", err))
+		}
+	}
+
+	if node.role == RAFT_ROLE_LEADER {
+		node.failWaiters(ErrRaftLeadershipLost)
+	}
+
+	node.role = RAFT_ROLE_FOLLOWER
+}
+
+//当选后写入一条空日志, 提交之后之前任期的日志也一起提交
+func (node *RaftNode) becomeLeader() {
+	node.role = RAFT_ROLE_LEADER
+	node.leaderId = node.Config.Id
+
+	for peerId := range node.Config.Peers {
+		node.nextIndex[peerId+1] = node.lastIndex() + 1
+		node.matchIndex[peerId+1] = 0
+	}
+
+	if _, err := node.appendLocal(nil); err != nil {
+		logger.AsyncInfo(fmt.Sprintf("raft 写入日志异常: %v", err))
+		node.role = RAFT_ROLE_FOLLOWER
+		return
+	}
+
+	logger.AsyncInfo(fmt.Sprintf("raft 节点 %d 成为leader, term: %d", node.Config.Id, node.currentTerm))
+
+	node.broadcastAppendEntries()
+	node.advanceCommit()
+}
+
+func (node *RaftNode) handleRequestVote(args *RaftRequestVoteArgs, reply *RaftRequestVoteReply) error {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	if node.stopped {
+		return ErrRaftStopped
+	}
+
+	if args.Term > node.currentTerm {
+		node.becomeFollower(args.Term)
+	}
+
+	reply.Term = node.currentTerm
+	if args.Term < node.currentTerm {
+		return nil
+	}
+
+	//候选人的日志至少和自己一样新
+	lastIndex := node.lastIndex()
+	lastTerm := node.termAt(lastIndex)
+	upToDate := args.LastLogTerm > lastTerm || (args.LastLogTerm == lastTerm && args.LastLogIndex >= lastIndex)
+
+	if (node.votedFor == 0 || node.votedFor == args.CandidateId) && upToDate {
+		node.votedFor = args.CandidateId
+		if err := node.persistState(); err != nil {
+			return err
+		}
+
+		reply.VoteGranted = true
+		node.resetElectionDeadline()
+	}
+
+	return nil
+}
+
+/****************************************************/
+/*日志复制*/
+
+func (node *RaftNode) broadcastAppendEntries() {
+	node.heartbeatAt = time.Now().Add(node.Config.HeartbeatInterval)
+
+	for peerId := range node.Config.Peers {
+		if peerId+1 != node.Config.Id {
+			go node.replicateTo(peerId + 1)
+		}
+	}
+}
+
+func (node *RaftNode) replicateTo(peerId int) {
+	node.lock.Lock()
+	if node.stopped || node.role != RAFT_ROLE_LEADER {
+		node.lock.Unlock()
+		return
+	}
+
+	term := node.currentTerm
+	prevIndex := node.nextIndex[peerId] - 1
+	if prevIndex < node.snapshotIndex {
+		node.lock.Unlock()
+		node.installSnapshotTo(peerId)
+		return
+	}
+
+	end := node.lastIndex()
+	if end > prevIndex+RAFT_MAX_APPEND_ENTRIES {
+		end = prevIndex + RAFT_MAX_APPEND_ENTRIES
+	}
+
+	args := &RaftAppendEntriesArgs{
+		Term:         term,
+		LeaderId:     node.Config.Id,
+		PrevLogIndex: prevIndex,
+		PrevLogTerm:  node.termAt(prevIndex),
+		Entries:      append([]*RaftLogEntry(nil), node.logs[prevIndex-node.snapshotIndex:end-node.snapshotIndex]...),
+		LeaderCommit: node.commitIndex,
+	}
+	node.lock.Unlock()
+
+	reply := new(RaftAppendEntriesReply)
+	if err := node.transport.call(peerId, "RaftRpcService.AppendEntries", args, reply, node.Config.ElectionTimeout/2); err != nil {
+		return
+	}
+
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	if node.stopped {
+		return
+	}
+
+	if reply.Term > node.currentTerm {
+		node.becomeFollower(reply.Term)
+		return
+	}
+
+	if node.role != RAFT_ROLE_LEADER || node.currentTerm != term {
+		return
+	}
+
+	if reply.Success {
+		if match := prevIndex + uint64(len(args.Entries)); match > node.matchIndex[peerId] {
+			node.matchIndex[peerId] = match
+		}
+		node.nextIndex[peerId] = node.matchIndex[peerId] + 1
+		node.advanceCommit()
+
+		if node.nextIndex[peerId] <= node.lastIndex() {
+			go node.replicateTo(peerId)
+		}
+
+		return
+	}
+
+	//日志不一致, 往前回退后重试
+	next := prevIndex
+	if reply.LastLogIndex+1 < next {
+		next = reply.LastLogIndex + 1
+	}
+	if next < 1 {
+		next = 1
+	}
+
+	node.nextIndex[peerId] = next
+	go node.replicateTo(peerId)
+}
+
+//发送快照, follower 安装后从快照之后的日志继续复制
+func (node *RaftNode) installSnapshotTo(peerId int) {
+	node.lock.Lock()
+	if node.stopped || node.role != RAFT_ROLE_LEADER {
+		node.lock.Unlock()
+		return
+	}
+
+	term := node.currentTerm
+	args := &RaftInstallSnapshotArgs{Term: term, LeaderId: node.Config.Id, Snapshot: node.snapshot}
+	node.lock.Unlock()
+
+	reply := new(RaftInstallSnapshotReply)
+	if err := node.transport.call(peerId, "RaftRpcService.InstallSnapshot", args, reply, node.Config.ElectionTimeout); err != nil {
+		return
+	}
+
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	if node.stopped {
+		return
+	}
+
+	if reply.Term > node.currentTerm {
+		node.becomeFollower(reply.Term)
+		return
+	}
+
+	if node.role != RAFT_ROLE_LEADER || node.currentTerm != term {
+		return
+	}
+
+	if match := args.Snapshot.Index; match > node.matchIndex[peerId] {
+		node.matchIndex[peerId] = match
+	}
+	node.nextIndex[peerId] = node.matchIndex[peerId] + 1
+	node.advanceCommit()
+
+	if node.nextIndex[peerId] <= node.lastIndex() {
+		go node.replicateTo(peerId)
+	}
+}
+
+//当前任期的日志被多数节点写入后提交
+func (node *RaftNode) advanceCommit() {
+	for index := node.lastIndex(); index > node.commitIndex; index-- {
+		if node.termAt(index) != node.currentTerm {
+			return
+		}
+
+		count := 1
+		for peerId, match := range node.matchIndex {
+			if peerId != node.Config.Id && match >= index {
+				count++
+			}
+		}
+
+		if count >= node.majority() {
+			node.commitIndex = index
+			node.applyCond.Broadcast()
+			return
+		}
+	}
+}
+
+func (node *RaftNode) handleAppendEntries(args *RaftAppendEntriesArgs, reply *RaftAppendEntriesReply) error {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	if node.stopped {
+		return ErrRaftStopped
+	}
+
+	reply.Term = node.currentTerm
+	reply.LastLogIndex = node.lastIndex()
+	if args.Term < node.currentTerm {
+		return nil
+	}
+
+	if args.Term > node.currentTerm || node.role != RAFT_ROLE_FOLLOWER {
+		node.becomeFollower(args.Term)
+	}
+
+	node.leaderId = args.LeaderId
+	node.resetElectionDeadline()
+	reply.Term = node.currentTerm
+
+	if args.PrevLogIndex > node.lastIndex() {
+		return nil
+	}
+
+	entries := args.Entries
+	if args.PrevLogIndex < node.snapshotIndex {
+		//快照包含的日志都已提交, 和leader 一致, 跳过
+		skip := node.snapshotIndex - args.PrevLogIndex
+		if skip >= uint64(len(entries)) {
+			entries = nil
+		} else {
+			entries = entries[skip:]
+		}
+	} else if node.termAt(args.PrevLogIndex) != args.PrevLogTerm {
+		reply.LastLogIndex = args.PrevLogIndex - 1
+		return nil
+	}
+
+	//跳过已有的日志, 从第一条不一致的日志开始覆盖
+	var truncateFrom uint64 = 0
+	var newEntries []*RaftLogEntry
+	for i, entry := range entries {
+		if entry.Index > node.lastIndex() {
+			newEntries = entries[i:]
+			break
+		}
+
+		if node.termAt(entry.Index) != entry.Term {
+			truncateFrom = entry.Index
+			newEntries = entries[i:]
+			break
+		}
+	}
+
+	if len(newEntries) > 0 {
+		if truncateFrom > 0 && truncateFrom <= node.commitIndex {
+			return errors.New(fmt.Sprintf("raft 不能覆盖已提交的日志: %d", truncateFrom))
+		}
+
+		if err := node.storeEntries(truncateFrom, newEntries); err != nil {
+			return err
+		}
+	}
+
+	reply.Success = true
+	reply.LastLogIndex = node.lastIndex()
+
+	lastNewIndex := args.PrevLogIndex + uint64(len(args.Entries))
+	if args.LeaderCommit > node.commitIndex {
+		commitIndex := args.LeaderCommit
+		if commitIndex > lastNewIndex {
+			commitIndex = lastNewIndex
+		}
+
+		if commitIndex > node.commitIndex {
+			node.commitIndex = commitIndex
+			node.applyCond.Broadcast()
+		}
+	}
+
+	return nil
+}
+
+//安装leader 的快照, 快照之后和快照一致的日志保留
+func (node *RaftNode) handleInstallSnapshot(args *RaftInstallSnapshotArgs, reply *RaftInstallSnapshotReply) error {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	if node.stopped {
+		return ErrRaftStopped
+	}
+
+	reply.Term = node.currentTerm
+	if args.Term < node.currentTerm {
+		return nil
+	}
+
+	if args.Term > node.currentTerm || node.role != RAFT_ROLE_FOLLOWER {
+		node.becomeFollower(args.Term)
+	}
+
+	node.leaderId = args.LeaderId
+	node.resetElectionDeadline()
+	reply.Term = node.currentTerm
+
+	snapshot := args.Snapshot
+	if snapshot == nil || snapshot.Index <= node.lastApplied {
+		//已执行到快照之后
+		return nil
+	}
+
+	//和快照一致时 保留之后的日志, 否则全部删除
+	var logs []*RaftLogEntry
+	deleteTo := node.lastIndex()
+	if snapshot.Index < node.lastIndex() && node.termAt(snapshot.Index) == snapshot.Term {
+		logs = append(logs, node.logs[snapshot.Index-node.snapshotIndex:]...)
+		deleteTo = snapshot.Index
+	}
+
+	if err := node.saveSnapshot(snapshot, deleteTo); err != nil {
+		return err
+	}
+
+	//快照中增大的source 可能包含导入的值, 丢弃本节点的内存号段
+	for source, counter := range snapshot.Counters {
+		if current, exist := node.counters[source]; !exist || current.CurrentId < counter.CurrentId {
+			node.onRaise(source)
+		}
+	}
+
+	node.restoreSnapshot(snapshot)
+	node.logs = logs
+
+	return nil
+}
+
+/****************************************************/
+/*执行已提交的日志*/
+
+func (node *RaftNode) applyLoop() {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	for {
+		for !node.stopped && node.lastApplied >= node.commitIndex {
+			node.applyCond.Wait()
+		}
+
+		if node.stopped {
+			return
+		}
+
+		for node.lastApplied < node.commitIndex {
+			node.lastApplied++
+			entry := node.entryAt(node.lastApplied)
+
+			result := node.applyCommand(entry.Command)
+
+			if waiter, exist := node.waiters[entry.Index]; exist {
+				delete(node.waiters, entry.Index)
+
+				if waiter.term != entry.Term {
+					waiter.result <- &raftApplyResult{nil, ErrRaftLeadershipLost}
+				} else {
+					waiter.result <- &raftApplyResult{result, nil}
+				}
+			}
+		}
+
+		if node.lastApplied-node.snapshotIndex >= uint64(node.Config.SnapshotLogs) {
+			if err := node.compact(); err != nil {
+				logger.AsyncInfo(fmt.Sprintf("raft 生成快照异常: %v", err))
+			}
+		}
+	}
+}
+
+//已执行的日志生成快照, 删除快照之前的日志
+func (node *RaftNode) compact() error {
+	snapshot := &RaftSnapshot{
+		Index:    node.lastApplied,
+		Term:     node.termAt(node.lastApplied),
+		Counters: make(map[string]*raftCounter, len(node.counters)),
+	}
+
+	for source, counter := range node.counters {
+		copied := *counter
+		snapshot.Counters[source] = &copied
+	}
+
+	if err := node.saveSnapshot(snapshot, snapshot.Index); err != nil {
+		return err
+	}
+
+	node.logs = append([]*RaftLogEntry(nil), node.logs[snapshot.Index-node.snapshotIndex:]...)
+	node.snapshotIndex, node.snapshotTerm = snapshot.Index, snapshot.Term
+	node.snapshot = snapshot
+
+	return nil
+}
+
+//使用快照的结果, 快照之前的日志都已提交 并执行
+func (node *RaftNode) restoreSnapshot(snapshot *RaftSnapshot) {
+	node.counters = make(map[string]*raftCounter, len(snapshot.Counters))
+	for source, counter := range snapshot.Counters {
+		copied := *counter
+		node.counters[source] = &copied
+	}
+
+	node.snapshot = snapshot
+	node.snapshotIndex, node.snapshotTerm = snapshot.Index, snapshot.Term
+	node.logs = nil
+
+	if node.commitIndex < snapshot.Index {
+		node.commitIndex = snapshot.Index
+	}
+	node.lastApplied = snapshot.Index
+}
+
+//和 BoltDbService 的 LoadCurrentIdFromDb, IncrSourceCurrentId 相同的规则
+func (node *RaftNode) applyCommand(command *RaftCommand) *RaftCommandResult {
+	if command == nil {
+		return nil
+	}
+
+	counter, exist := node.counters[command.Source]
+	if !exist {
+		counter = new(raftCounter)
+		node.counters[command.Source] = counter
+	}
+
+	result := new(RaftCommandResult)
+
+	switch command.Op {
+	case RAFT_OP_LOAD:
+		result.CurrentId = counter.CurrentId
+		result.NewCurrentId = counter.CurrentId + command.BucketStep
+
+	case RAFT_OP_INCR:
+		result.CurrentId = command.CurrentId
+		result.NewCurrentId = command.CurrentId + command.BucketStep
+
+		if counter.CurrentId > command.CurrentId {
+			result.CurrentId = counter.CurrentId + 1
+			result.NewCurrentId = counter.CurrentId + command.BucketStep
+		}
+
+	case RAFT_OP_RAISE:
+		result.CurrentId = counter.CurrentId
+		result.NewCurrentId = counter.CurrentId
+		result.Created = !exist
+
+		if command.CurrentId > counter.CurrentId {
+			result.NewCurrentId = command.CurrentId
+			counter.CurrentId = command.CurrentId
+			node.onRaise(command.Source)
+		}
+
+		//已有的步长不修改
+		if counter.BucketStep == 0 {
+			counter.BucketStep = command.BucketStep
+		}
+
+		return result
+
+	default:
+		return nil
+	}
+
+	counter.CurrentId = result.NewCurrentId
+	counter.BucketStep = command.BucketStep
+
+	return result
+}
+
+func (node *RaftNode) onRaise(source string) {
+	if node.Config.OnRaise != nil {
+		node.Config.OnRaise(source)
+	}
+}
+
+//导入每个source 的最大值, 每个source 提交一条 raise 命令, 只会增大, 重复导入是安全的
+func (node *RaftNode) ImportCounters(counters []*SourceCounter) (*CounterImportResult, error) {
+	for _, counter := range counters {
+		if err := validateSourceCounter(counter); err != nil {
+			return nil, err
+		}
+	}
+
+	result := new(CounterImportResult)
+
+	for _, counter := range counters {
+		command := &RaftCommand{
+			Op:         RAFT_OP_RAISE,
+			Source:     NamespacedSource(counter.Namespace, counter.Source),
+			CurrentId:  counter.CurrentId,
+			BucketStep: counter.BucketStep,
+		}
+
+		applied, err := node.Propose(command)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("导入 %s 失败, 之前的source 已导入, 可以重新导入: %v", command.Source, err))
+		}
+
+		switch {
+		case applied.Created:
+			result.Created++
+		case applied.NewCurrentId > applied.CurrentId:
+			result.Raised++
+		default:
+			result.Skipped++
+		}
+	}
+
+	return result, nil
+}
+
+func (node *RaftNode) failWaiters(err error) {
+	for index, waiter := range node.waiters {
+		delete(node.waiters, index)
+		waiter.result <- &raftApplyResult{nil, err}
+	}
+}
+
+/****************************************************/
+/*持久化*/
+
+func raftUint64Bytes(value uint64) []byte {
+	result := make([]byte, 8)
+	binary.BigEndian.PutUint64(result, value)
+
+	return result
+}
+
+//保存快照 并删除 (node.snapshotIndex, deleteTo] 的日志
+func (node *RaftNode) saveSnapshot(snapshot *RaftSnapshot, deleteTo uint64) error {
+	value, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	return node.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte(RAFT_META_BUCKET_NAME)).Put(raftSnapshotKey, value); err != nil {
+			return err
+		}
+
+		logBucket := tx.Bucket([]byte(RAFT_LOG_BUCKET_NAME))
+		for index := node.snapshotIndex + 1; index <= deleteTo; index++ {
+			if err := logBucket.Delete(raftUint64Bytes(index)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+//投票 和 回复之前 保存任期 和 投票对象
+func (node *RaftNode) persistState() error {
+	return node.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte(RAFT_META_BUCKET_NAME))
+
+		if err := meta.Put(raftTermKey, raftUint64Bytes(node.currentTerm)); err != nil {
+			return err
+		}
+
+		return meta.Put(raftVotedForKey, raftUint64Bytes(uint64(node.votedFor)))
+	})
+}
+
+func (node *RaftNode) appendLocal(command *RaftCommand) (*RaftLogEntry, error) {
+	entry := &RaftLogEntry{Index: node.lastIndex() + 1, Term: node.currentTerm, Command: command}
+
+	if err := node.storeEntries(0, []*RaftLogEntry{entry}); err != nil {
+		return nil, err
+	}
+
+	if match, exist := node.matchIndex[node.Config.Id]; exist && match < entry.Index {
+		node.matchIndex[node.Config.Id] = entry.Index
+	}
+
+	return entry, nil
+}
+
+//truncateFrom 大于0 时先删除这个序号之后的日志
+func (node *RaftNode) storeEntries(truncateFrom uint64, entries []*RaftLogEntry) error {
+	err := node.db.Update(func(tx *bolt.Tx) error {
+		logBucket := tx.Bucket([]byte(RAFT_LOG_BUCKET_NAME))
+
+		if truncateFrom > 0 {
+			for index := truncateFrom; index <= node.lastIndex(); index++ {
+				if err := logBucket.Delete(raftUint64Bytes(index)); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, entry := range entries {
+			value, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+
+			if err := logBucket.Put(raftUint64Bytes(entry.Index), value); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if truncateFrom > 0 {
+		node.logs = node.logs[:truncateFrom-node.snapshotIndex-1]
+	}
+	node.logs = append(node.logs, entries...)
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package model
+
+const (
+	PERSIST_TYPE_RAFT = "raft" //cluster 模式, 多数raft 节点确认后分配号段
+)
+
+//使用 raft 节点之间复制的最大值, 任意节点都可以分配id
+type RaftService struct {
+	Node *RaftNode
+}
+
+func init() {
+	RegisterSegmentStore(PERSIST_TYPE_RAFT, func(namespace string) SegmentStore {
+		return withSourceNamespace(NewRaftService(), namespace)
+	})
+}
+
+func NewRaftService() *RaftService {
+	node := GetApplication().RaftNode
+	if node == nil {
+		panic("raft 节点没有启动")
+	}
+
+	return NewRaftServiceWithNode(node)
+}
+
+func NewRaftServiceWithNode(node *RaftNode) *RaftService {
+	return &RaftService{node}
+}
+
+//提交 load 命令, 多数节点确认后返回原来的最大值
+func (this *RaftService) LoadCurrentIdFromDb(source string, bucketStep int) int {
+	result, err := this.Node.Propose(&RaftCommand{Op: RAFT_OP_LOAD, Source: source, BucketStep: bucketStep})
+	CheckErr(err)
+
+	return result.CurrentId
+}
+
+//提交 incr 命令, 多数节点确认后返回实际的起始id 和新的最大值
+func (this *RaftService) IncrSourceCurrentId(source string, currentId int, bucketStep int) (int, int) {
+	result, err := this.Node.Propose(&RaftCommand{Op: RAFT_OP_INCR, Source: source, CurrentId: currentId, BucketStep: bucketStep})
+	CheckErr(err)
+
+	return result.CurrentId, result.NewCurrentId
+}
+
+//本节点已执行的日志中 source 的步长
+func (this *RaftService) LoadSourceStep(source string) int {
+	return this.Node.SourceStep(source)
+}
@@ -0,0 +1,225 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+//raft 节点之间的 rpc 方法, 通过 net/rpc 注册
+type RaftRpcService struct {
+	node *RaftNode
+}
+
+func (this *RaftRpcService) RequestVote(args *RaftRequestVoteArgs, reply *RaftRequestVoteReply) error {
+	return this.node.handleRequestVote(args, reply)
+}
+
+func (this *RaftRpcService) AppendEntries(args *RaftAppendEntriesArgs, reply *RaftAppendEntriesReply) error {
+	return this.node.handleAppendEntries(args, reply)
+}
+
+func (this *RaftRpcService) InstallSnapshot(args *RaftInstallSnapshotArgs, reply *RaftInstallSnapshotReply) error {
+	return this.node.handleInstallSnapshot(args, reply)
+}
+
+//import 子命令 -raft 时调用, 可以连接任意节点, follower 把命令转发给leader
+func (this *RaftRpcService) ImportCounters(args []*SourceCounter, result *CounterImportResult) error {
+	importResult, err := this.node.ImportCounters(args)
+	if err != nil {
+		return err
+	}
+
+	*result = *importResult
+
+	return nil
+}
+
+//follower 转发过来的命令, 只在leader 上执行, 不再转发
+func (this *RaftRpcService) Propose(command *RaftCommand, result *RaftCommandResult) error {
+	deadline := time.Now().Add(this.node.Config.ProposeTimeout)
+
+	applied, _, err := this.node.proposeLocal(command, deadline)
+	if err != nil {
+		return err
+	}
+
+	if applied != nil {
+		*result = *applied
+	}
+
+	return nil
+}
+
+type raftTransport struct {
+	node     *RaftNode
+	server   *rpc.Server
+	listener net.Listener
+
+	lock        sync.Mutex
+	closed      bool
+	connections map[net.Conn]bool
+	clients     map[int]*rpc.Client
+}
+
+func newRaftTransport(node *RaftNode, listener net.Listener) *raftTransport {
+	server := rpc.NewServer()
+	if err := server.Register(&RaftRpcService{node}); err != nil {
+		panic(err)
+	}
+
+	return &raftTransport{
+		node:        node,
+		server:      server,
+		listener:    listener,
+		connections: make(map[net.Conn]bool),
+		clients:     make(map[int]*rpc.Client),
+	}
+}
+
+func (this *raftTransport) serve() {
+	for {
+		connection, err := this.listener.Accept()
+		if err != nil {
+			if this.isClosed() {
+				return
+			}
+
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+
+		this.lock.Lock()
+		if this.closed {
+			this.lock.Unlock()
+			connection.Close()
+			return
+		}
+		this.connections[connection] = true
+		this.lock.Unlock()
+
+		go func() {
+			this.server.ServeConn(connection)
+
+			this.lock.Lock()
+			delete(this.connections, connection)
+			this.lock.Unlock()
+		}()
+	}
+}
+
+func (this *raftTransport) isClosed() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.closed
+}
+
+//关闭监听, 已接受的连接 和 到其他节点的连接
+func (this *raftTransport) close() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.closed {
+		return
+	}
+
+	this.closed = true
+	this.listener.Close()
+
+	for connection := range this.connections {
+		connection.Close()
+	}
+
+	for peerId, client := range this.clients {
+		client.Close()
+		delete(this.clients, peerId)
+	}
+}
+
+//到其他节点的连接, 第一次使用时建立
+func (this *raftTransport) getClient(peerId int, timeout time.Duration) (*rpc.Client, error) {
+	this.lock.Lock()
+	client, exist := this.clients[peerId]
+	closed := this.closed
+	this.lock.Unlock()
+
+	if closed {
+		return nil, ErrRaftStopped
+	}
+
+	if exist {
+		return client, nil
+	}
+
+	//连接时不加锁, 一个节点连不上不影响给其他节点发送心跳
+	connection, err := net.DialTimeout("tcp", this.node.Config.Peers[peerId-1], timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.closed {
+		connection.Close()
+		return nil, ErrRaftStopped
+	}
+
+	//同时建立了多个连接时 使用先建立的
+	if existClient, exist := this.clients[peerId]; exist {
+		connection.Close()
+		return existClient, nil
+	}
+
+	client = rpc.NewClient(connection)
+	this.clients[peerId] = client
+
+	return client, nil
+}
+
+//连接出错时丢弃, 下次调用重新建立
+func (this *raftTransport) resetClient(peerId int, client *rpc.Client) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.clients[peerId] == client {
+		delete(this.clients, peerId)
+	}
+
+	client.Close()
+}
+
+//调用其他节点的方法, 超时或连接出错时返回错误
+func (this *raftTransport) call(peerId int, method string, args interface{}, reply interface{}, timeout time.Duration) error {
+	if peerId < 1 || peerId > len(this.node.Config.Peers) {
+		return errors.New(fmt.Sprintf("raft nodeId 超出范围: %d", peerId))
+	}
+
+	if timeout <= 0 {
+		return ErrRaftProposeTimeout
+	}
+
+	client, err := this.getClient(peerId, timeout)
+	if err != nil {
+		return err
+	}
+
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+
+	select {
+	case <-call.Done:
+		if _, ok := call.Error.(rpc.ServerError); !ok && call.Error != nil {
+			this.resetClient(peerId, client)
+		}
+
+		return call.Error
+
+	case <-time.After(timeout):
+		this.resetClient(peerId, client)
+		return errors.New(fmt.Sprintf("raft 调用 %s 超时, nodeId: %d", method, peerId))
+	}
+}
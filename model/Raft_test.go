@@ -0,0 +1,400 @@
+package model
+
+import (
+	"net"
+	"net/rpc"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testRaftCluster struct {
+	t     *testing.T
+	dir   string
+	peers []string
+	nodes []*RaftNode
+
+	snapshotLogs int
+
+	raisedLock sync.Mutex
+	raised     map[string]int //各节点 OnRaise 的次数
+}
+
+//在本机启动 size 个节点, 使用随机端口
+func newTestRaftCluster(t *testing.T, size int) *testRaftCluster {
+	return newTestRaftClusterWithSnapshot(t, size, 0)
+}
+
+//snapshotLogs 为0 时使用默认值
+func newTestRaftClusterWithSnapshot(t *testing.T, size int, snapshotLogs int) *testRaftCluster {
+	cluster := &testRaftCluster{t: t, dir: t.TempDir(), nodes: make([]*RaftNode, size), snapshotLogs: snapshotLogs, raised: make(map[string]int)}
+
+	listeners := make([]net.Listener, size)
+	for i := range listeners {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		listeners[i] = listener
+		cluster.peers = append(cluster.peers, listener.Addr().String())
+	}
+
+	for i, listener := range listeners {
+		cluster.startNode(i+1, listener)
+	}
+
+	t.Cleanup(func() {
+		for _, node := range cluster.nodes {
+			if node != nil {
+				node.Stop()
+			}
+		}
+	})
+
+	return cluster
+}
+
+func (cluster *testRaftCluster) startNode(id int, listener net.Listener) {
+	if listener == nil {
+		var err error
+		if listener, err = net.Listen("tcp", cluster.peers[id-1]); err != nil {
+			cluster.t.Fatal(err)
+		}
+	}
+
+	node, err := NewRaftNode(RaftNodeConfig{
+		Id:                id,
+		Peers:             cluster.peers,
+		FilePath:          filepath.Join(cluster.dir, "raft"+listener.Addr().String()+".db"),
+		ElectionTimeout:   150 * time.Millisecond,
+		HeartbeatInterval: 30 * time.Millisecond,
+		ProposeTimeout:    2 * time.Second,
+		SnapshotLogs:      cluster.snapshotLogs,
+		OnRaise: func(source string) {
+			cluster.raisedLock.Lock()
+			cluster.raised[source]++
+			cluster.raisedLock.Unlock()
+		},
+	})
+	if err != nil {
+		cluster.t.Fatal(err)
+	}
+
+	node.Start(listener)
+	cluster.nodes[id-1] = node
+}
+
+func (cluster *testRaftCluster) stopNode(id int) {
+	cluster.nodes[id-1].Stop()
+	cluster.nodes[id-1] = nil
+}
+
+//等待选出leader, 返回leader 的 id
+func (cluster *testRaftCluster) waitLeader() int {
+	deadline := time.Now().Add(5 * time.Second)
+
+	for time.Now().Before(deadline) {
+		for _, node := range cluster.nodes {
+			if node == nil {
+				continue
+			}
+
+			if isLeader, _ := node.Leader(); isLeader {
+				return node.Config.Id
+			}
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	cluster.t.Fatal("没有选出leader")
+	return 0
+}
+
+type testIdRange struct {
+	start int
+	end   int
+}
+
+//检查分配的号段 (start, end] 没有重叠, 和 IdWorkerAutoIncr 使用号段的方式相同
+func checkRangesUnique(t *testing.T, ranges []testIdRange) {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].start < ranges[j].start
+	})
+
+	for i := 1; i < len(ranges); i++ {
+		if ranges[i].start < ranges[i-1].end {
+			t.Fatalf("号段重叠: %+v, %+v", ranges[i-1], ranges[i])
+		}
+	}
+}
+
+func TestRaftClusterConcurrentUnique(t *testing.T) {
+	cluster := newTestRaftCluster(t, 3)
+	cluster.waitLeader()
+
+	var lock sync.Mutex
+	ranges := make([]testIdRange, 0)
+
+	var wg sync.WaitGroup
+	for _, node := range cluster.nodes {
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+
+			//每个节点都可以分配id, follower 转发给leader
+			go func(service SegmentStore) {
+				defer wg.Done()
+
+				currentId := service.LoadCurrentIdFromDb("order", 10)
+				local := []testIdRange{{currentId, currentId + 10}}
+
+				for j := 0; j < 20; j++ {
+					start, end := service.IncrSourceCurrentId("order", currentId, 10)
+					local = append(local, testIdRange{start, end})
+					currentId = end
+				}
+
+				lock.Lock()
+				ranges = append(ranges, local...)
+				lock.Unlock()
+			}(withSourceNamespace(NewRaftServiceWithNode(node), "raft"))
+		}
+	}
+	wg.Wait()
+
+	checkRangesUnique(t, ranges)
+
+	for _, node := range cluster.nodes {
+		if step := NewRaftServiceWithNode(node).LoadSourceStep(NamespacedSource("raft", "order")); step != 10 {
+			t.Errorf("node %d step: %d", node.Config.Id, step)
+		}
+	}
+}
+
+func TestRaftClusterFailover(t *testing.T) {
+	cluster := newTestRaftCluster(t, 3)
+	leaderId := cluster.waitLeader()
+
+	ranges := make([]testIdRange, 0)
+	allocate := func(node *RaftNode) error {
+		result, err := node.Propose(&RaftCommand{Op: RAFT_OP_LOAD, Source: "order", BucketStep: 100})
+		if err == nil {
+			ranges = append(ranges, testIdRange{result.CurrentId, result.NewCurrentId})
+		}
+
+		return err
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := allocate(cluster.nodes[leaderId-1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//leader 宕机后选出新的leader, 已分配的号段不会再分配
+	cluster.stopNode(leaderId)
+	newLeaderId := cluster.waitLeader()
+
+	if err := allocate(cluster.nodes[newLeaderId-1]); err != nil {
+		t.Fatal(err)
+	}
+
+	//只剩一个节点时 不能分配
+	cluster.stopNode(newLeaderId)
+
+	for _, node := range cluster.nodes {
+		if node == nil {
+			continue
+		}
+
+		if err := allocate(node); err != ErrRaftProposeTimeout {
+			t.Fatalf("minority allocate: %v", err)
+		}
+	}
+
+	//重启的节点从日志恢复, 并追上其他节点
+	cluster.startNode(leaderId, nil)
+	cluster.waitLeader()
+
+	for _, node := range cluster.nodes {
+		if node == nil {
+			continue
+		}
+
+		if err := allocate(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkRangesUnique(t, ranges)
+}
+
+//cluster 是运行时的角色, 热加载后配置文件中的 serverType 不影响持久化方式
+func TestClusterRolePersistType(t *testing.T) {
+	application := GetApplication()
+
+	serverType, role := application.ConfigData.ServerType, application.Role
+	defer func() { application.ConfigData.ServerType, application.Role = serverType, role }()
+
+	application.Role = SERVER_CLUSTER
+	application.ConfigData.ServerType = SERVER_MASTER
+
+	if persistType := currentPersistType(); persistType != PERSIST_TYPE_RAFT {
+		t.Errorf("cluster persist type: %s", persistType)
+	}
+}
+
+//节点的快照位置, 内存中的日志条数 和 source 的最大值
+func raftNodeState(node *RaftNode, source string) (uint64, int, int) {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	currentId := 0
+	if counter, exist := node.counters[source]; exist {
+		currentId = counter.CurrentId
+	}
+
+	return node.snapshotIndex, len(node.logs), currentId
+}
+
+//等待节点执行到 currentId
+func waitRaftCurrentId(t *testing.T, node *RaftNode, source string, currentId int) {
+	deadline := time.Now().Add(5 * time.Second)
+
+	for time.Now().Before(deadline) {
+		if _, _, nodeCurrentId := raftNodeState(node, source); nodeCurrentId == currentId {
+			return
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	_, _, nodeCurrentId := raftNodeState(node, source)
+	t.Fatalf("node %d current id: %d, expected: %d", node.Config.Id, nodeCurrentId, currentId)
+}
+
+//日志超过 snapshotLogs 时生成快照, 落后的节点安装快照, 重启后从快照恢复
+func TestRaftClusterSnapshot(t *testing.T) {
+	cluster := newTestRaftClusterWithSnapshot(t, 3, 10)
+	leaderId := cluster.waitLeader()
+
+	followerId := leaderId%3 + 1
+	cluster.stopNode(followerId)
+
+	ranges := make([]testIdRange, 0)
+	allocate := func(node *RaftNode) int {
+		result, err := node.Propose(&RaftCommand{Op: RAFT_OP_LOAD, Source: "order", BucketStep: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ranges = append(ranges, testIdRange{result.CurrentId, result.NewCurrentId})
+		return result.NewCurrentId
+	}
+
+	var currentId int
+	for i := 0; i < 35; i++ {
+		currentId = allocate(cluster.nodes[leaderId-1])
+	}
+
+	snapshotIndex, logs, _ := raftNodeState(cluster.nodes[leaderId-1], "order")
+	if snapshotIndex < 30 || logs >= 10 {
+		t.Fatalf("leader snapshot: %d, logs: %d", snapshotIndex, logs)
+	}
+
+	//停止的节点需要的日志已删除, 通过快照追上
+	cluster.startNode(followerId, nil)
+	waitRaftCurrentId(t, cluster.nodes[followerId-1], "order", currentId)
+
+	if snapshotIndex, _, _ := raftNodeState(cluster.nodes[followerId-1], "order"); snapshotIndex == 0 {
+		t.Error("follower did not install snapshot")
+	}
+
+	//全部重启后 从快照和之后的日志恢复
+	for id := 1; id <= 3; id++ {
+		cluster.stopNode(id)
+	}
+	for id := 1; id <= 3; id++ {
+		cluster.startNode(id, nil)
+	}
+
+	leaderId = cluster.waitLeader()
+	currentId = allocate(cluster.nodes[leaderId-1])
+
+	for _, node := range cluster.nodes {
+		waitRaftCurrentId(t, node, "order", currentId)
+	}
+
+	checkRangesUnique(t, ranges)
+	if ranges[len(ranges)-1].start != 35*10 {
+		t.Errorf("after restart: %+v", ranges[len(ranges)-1])
+	}
+}
+
+//导入只增大最大值, 通过任意节点提交, 所有节点丢弃导入的source 的内存号段
+func TestRaftClusterImport(t *testing.T) {
+	cluster := newTestRaftCluster(t, 3)
+	leaderId := cluster.waitLeader()
+
+	leader := cluster.nodes[leaderId-1]
+	if _, err := leader.Propose(&RaftCommand{Op: RAFT_OP_LOAD, Source: "order", BucketStep: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := leader.Propose(&RaftCommand{Op: RAFT_OP_LOAD, Source: "user", BucketStep: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	counters := []*SourceCounter{
+		{Source: "order", CurrentId: 1000, BucketStep: 50}, //增大, 已有的步长不变
+		{Source: "user", CurrentId: 5},                     //已有的值更大
+		{Namespace: "tenant", Source: "pay", CurrentId: 300, BucketStep: 20},
+	}
+
+	//连接follower, 转发给leader
+	client, err := rpc.Dial("tcp", cluster.peers[leaderId%3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	result := new(CounterImportResult)
+	if err := client.Call("RaftRpcService.ImportCounters", counters, result); err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Created != 1 || result.Raised != 1 || result.Skipped != 1 {
+		t.Errorf("import result: %+v", result)
+	}
+
+	for _, node := range cluster.nodes {
+		waitRaftCurrentId(t, node, "order", 1000)
+		waitRaftCurrentId(t, node, NamespacedSource("tenant", "pay"), 300)
+
+		if step := node.SourceStep("order"); step != 10 {
+			t.Errorf("node %d order step: %d", node.Config.Id, step)
+		}
+	}
+
+	//重复导入不改变
+	if result, err := leader.ImportCounters(counters); err != nil || result.Raised != 0 || result.Skipped != 3 {
+		t.Errorf("import again: %+v, %v", result, err)
+	}
+
+	cluster.raisedLock.Lock()
+	if cluster.raised["order"] != 3 || cluster.raised[NamespacedSource("tenant", "pay")] != 3 || cluster.raised["user"] != 0 {
+		t.Errorf("raised: %v", cluster.raised)
+	}
+	cluster.raisedLock.Unlock()
+
+	applied, err := leader.Propose(&RaftCommand{Op: RAFT_OP_LOAD, Source: "order", BucketStep: 10})
+	if err != nil || applied.CurrentId != 1000 {
+		t.Errorf("load after import: %+v, %v", applied, err)
+	}
+
+	if _, err := leader.ImportCounters([]*SourceCounter{{Source: "order", CurrentId: -1}}); err == nil {
+		t.Error("negative current id imported")
+	}
+}
@@ -0,0 +1,123 @@
+package model
+
+import (
+	"idGenerator/model/logger"
+	"idGenerator/model/persistent"
+	"strconv"
+)
+
+const (
+	PERSIST_TYPE_REDIS = "redis" //redis持久化
+
+	DEFAULT_REDIS_KEY_PREFIX = "idGenerator:"
+)
+
+//使用 redis 保存每个source 已分配的最大值, 通过 INCRBY 保证多个实例之间不重复
+type RedisService struct {
+	Pool      *persistent.RedisPool
+	KeyPrefix string
+}
+
+func init() {
+	RegisterSegmentStore(PERSIST_TYPE_REDIS, func(namespace string) SegmentStore {
+		return withSourceNamespace(NewRedisService(), namespace)
+	})
+}
+
+func NewRedisService() *RedisService {
+	pool, err := GetApplication().GetRedisPool()
+	CheckErr(err)
+
+	return NewRedisServiceWithPool(pool, GetApplication().ConfigData.Redis.KeyPrefix)
+}
+
+func NewRedisServiceWithPool(pool *persistent.RedisPool, keyPrefix string) *RedisService {
+	if keyPrefix == "" {
+		keyPrefix = DEFAULT_REDIS_KEY_PREFIX
+	}
+
+	return &RedisService{pool, keyPrefix}
+}
+
+func (this *RedisService) currentIdKey(source string) string {
+	return this.KeyPrefix + "current:" + source
+}
+
+func (this *RedisService) stepKey(source string) string {
+	return this.KeyPrefix + "step:" + source
+}
+
+//从redis 中load当前的最大值 ，并增大 bucketStep
+func (this *RedisService) LoadCurrentIdFromDb(source string, bucketStep int) int {
+	if source == "" || bucketStep < 1 {
+		panic("业务参数错误，或者id递增步长错误")
+	}
+
+	newDbCurrentId, err := this.Pool.DoInt("INCRBY", this.currentIdKey(source), strconv.Itoa(bucketStep))
+	CheckErr(err)
+
+	this.saveSourceStep(source, bucketStep)
+
+	currentId := int(newDbCurrentId) - bucketStep
+	logger.AsyncInfo("load current id from redis, source: " + source + " , currentId: " + strconv.Itoa(currentId))
+
+	return currentId
+}
+
+//持久化一个新号段, currentId 大于redis 中的值时(source 配置了更大的起始id) 一次性增加到 currentId + bucketStep
+//INCRBY 返回之前的 bucketStep 个值一定只属于当前调用, 其他实例并发修改时 起始id 往后顺延
+func (this *RedisService) IncrSourceCurrentId(source string, currentId int, bucketStep int) (resultCurrentId int, newDbCurrentId int) {
+	if source == "" || currentId < 1 || bucketStep < 1 {
+		panic("parameter error")
+	}
+
+	value, _, err := this.Pool.DoString("GET", this.currentIdKey(source))
+	CheckErr(err)
+
+	oldDbCurrentId := 0
+	if value != "" {
+		oldDbCurrentId, err = strconv.Atoi(value)
+		CheckErr(err)
+	}
+
+	incr := bucketStep
+	if currentId > oldDbCurrentId {
+		incr = bucketStep + currentId - oldDbCurrentId
+	}
+
+	newValue, err := this.Pool.DoInt("INCRBY", this.currentIdKey(source), strconv.Itoa(incr))
+	CheckErr(err)
+
+	newDbCurrentId = int(newValue)
+
+	resultCurrentId = newDbCurrentId - incr
+	if resultCurrentId < currentId {
+		resultCurrentId = currentId
+	}
+
+	this.saveSourceStep(source, bucketStep)
+
+	logger.AsyncInfo("source: " + source + " update redis current_id to " + strconv.Itoa(newDbCurrentId))
+
+	return resultCurrentId, newDbCurrentId
+}
+
+//source 最近一次使用的步长, 没有记录时返回0
+func (this *RedisService) LoadSourceStep(source string) int {
+	value, exist, err := this.Pool.DoString("GET", this.stepKey(source))
+	CheckErr(err)
+
+	if !exist {
+		return 0
+	}
+
+	bucketStep, err := strconv.Atoi(value)
+	CheckErr(err)
+
+	return bucketStep
+}
+
+func (this *RedisService) saveSourceStep(source string, bucketStep int) {
+	_, err := this.Pool.Do("SET", this.stepKey(source), strconv.Itoa(bucketStep))
+	CheckErr(err)
+}
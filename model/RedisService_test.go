@@ -0,0 +1,244 @@
+package model
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+	"idGenerator/model/cmap"
+	"idGenerator/model/persistent"
+)
+
+//进程内的 RESP 服务, 只实现了 RedisService 用到的命令
+type fakeRedisServer struct {
+	listener net.Listener
+	password string
+
+	lock   sync.Mutex
+	values map[string]string
+}
+
+func newFakeRedisServer(t *testing.T, password string) *fakeRedisServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &fakeRedisServer{listener: listener, password: password, values: make(map[string]string)}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go server.serve(conn)
+		}
+	}()
+
+	return server
+}
+
+func (server *fakeRedisServer) Address() string {
+	return server.listener.Addr().String()
+}
+
+func (server *fakeRedisServer) Close() {
+	server.listener.Close()
+}
+
+func (server *fakeRedisServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	authed := server.password == ""
+
+	for {
+		request, err := persistent.ReadRedisReply(reader)
+		if err != nil {
+			return
+		}
+
+		items, _ := request.([]interface{})
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i], _ = item.(string)
+		}
+
+		if len(args) == 0 {
+			writer.WriteString("-ERR empty command\r\n")
+		} else if args[0] == "AUTH" {
+			authed = len(args) == 2 && args[1] == server.password
+			if authed {
+				writer.WriteString("+OK\r\n")
+			} else {
+				writer.WriteString("-ERR invalid password\r\n")
+			}
+		} else if !authed {
+			writer.WriteString("-NOAUTH Authentication required.\r\n")
+		} else {
+			writer.WriteString(server.execute(args))
+		}
+
+		if err := writer.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (server *fakeRedisServer) execute(args []string) string {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	switch {
+	case args[0] == "PING":
+		return "+PONG\r\n"
+	case args[0] == "SELECT" && len(args) == 2:
+		return "+OK\r\n"
+	case args[0] == "SET" && len(args) == 3:
+		server.values[args[1]] = args[2]
+		return "+OK\r\n"
+	case args[0] == "GET" && len(args) == 2:
+		value, exist := server.values[args[1]]
+		if !exist {
+			return "$-1\r\n"
+		}
+		return "$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+	case args[0] == "INCRBY" && len(args) == 3:
+		incr, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+
+		var value int64
+		if oldValue, exist := server.values[args[1]]; exist {
+			if value, err = strconv.ParseInt(oldValue, 10, 64); err != nil {
+				return "-ERR value is not an integer or out of range\r\n"
+			}
+		}
+
+		value += incr
+		server.values[args[1]] = strconv.FormatInt(value, 10)
+		return ":" + strconv.FormatInt(value, 10) + "\r\n"
+	}
+
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+func TestRedisServiceSegment(t *testing.T) {
+	server := newFakeRedisServer(t, "secret")
+	defer server.Close()
+
+	pool := persistent.NewRedisPool(server.Address(), "secret", 1, 2, time.Second)
+	defer pool.Close()
+
+	GetApplication().ConfigData.BucketStep = 10
+	store := NewRedisServiceWithPool(pool, "")
+
+	if step := store.LoadSourceStep("order"); step != 0 {
+		t.Errorf("step of new source: %d", step)
+	}
+
+	if currentId := store.LoadCurrentIdFromDb("order", 10); currentId != 0 {
+		t.Errorf("first load: %d", currentId)
+	}
+
+	if currentId, maxId := store.IncrSourceCurrentId("order", 10, 10); currentId != 10 || maxId != 20 {
+		t.Errorf("incr: %d, %d", currentId, maxId)
+	}
+
+	//source 配置了更大的起始id
+	if currentId, maxId := store.IncrSourceCurrentId("order", 1000, 5); currentId != 1000 || maxId != 1005 {
+		t.Errorf("incr to start id: %d, %d", currentId, maxId)
+	}
+
+	//其他实例已经分配过了, 起始id 往后顺延
+	if currentId, maxId := store.IncrSourceCurrentId("order", 20, 5); currentId != 1005 || maxId != 1010 {
+		t.Errorf("incr after other instance: %d, %d", currentId, maxId)
+	}
+
+	if step := store.LoadSourceStep("order"); step != 5 {
+		t.Errorf("stored step: %d", step)
+	}
+
+	badPool := persistent.NewRedisPool(server.Address(), "wrong", 0, 1, time.Second)
+	if _, err := badPool.Do("PING"); err == nil {
+		t.Error("wrong password accepted")
+	}
+}
+
+//两个 worker 模拟两个实例 共用一个redis 并发获取id, 不能有重复
+func TestRedisServiceConcurrentUnique(t *testing.T) {
+	server := newFakeRedisServer(t, "")
+	defer server.Close()
+
+	pool := persistent.NewRedisPool(server.Address(), "", 0, 8, time.Second)
+	defer pool.Close()
+
+	setTestSegmentStore("redis_concurrent", NewRedisServiceWithPool(pool, "test:"))
+
+	GetApplication().ConfigData.BucketStep = 5
+	GetApplication().ConfigData.PersistType = "redis_concurrent"
+
+	workers := []*AutoIncrIdWorker{
+		{WorkerMap: cmap.New(), PersistType: currentPersistType()},
+		{WorkerMap: cmap.New(), PersistType: currentPersistType()},
+	}
+
+	var lock sync.Mutex
+	seen := make(map[int]bool)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+
+		go func(index int) {
+			defer wg.Done()
+
+			worker := workers[index%len(workers)]
+			var ids []int
+
+			for j := 0; j < 20; j++ {
+				if j%4 == 0 {
+					idRanges, err := worker.NextIds("", "redis_source", j%7+1)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+
+					for _, idRange := range idRanges {
+						for id := idRange.FirstId; id <= idRange.LastId; id++ {
+							ids = append(ids, id)
+						}
+					}
+				} else {
+					id, err := worker.NextId("", "redis_source")
+					if err != nil {
+						t.Error(err)
+						return
+					}
+
+					ids = append(ids, id)
+				}
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			for _, id := range ids {
+				if seen[id] {
+					t.Errorf("duplicate id: %d", id)
+				}
+				seen[id] = true
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	t.Log("ids: " + strconv.Itoa(len(seen)))
+}
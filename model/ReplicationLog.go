@@ -0,0 +1,423 @@
+package model
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"sync"
+	"time"
+)
+
+const (
+	REPLICATION_LOG_BUCKET_NAME  = "IdGeneratorReplicationLog"  //主从同步日志, key 为大端的序号
+	REPLICATION_META_BUCKET_NAME = "IdGeneratorReplicationMeta" //同步日志的标识
+
+	DEFAULT_REPLICATION_LOG_SIZE = 100000 //默认保留的日志条数
+	REPLICATION_LOG_BATCH_SIZE   = 1000   //一个同步包最多包含的日志条数
+
+	REPLICATION_OP_PUT    = "put"    //写入其他bucket 的一个key, 例如 source 配置, worker id 租约
+	REPLICATION_OP_DELETE = "delete" //删除其他bucket 的一个key
+)
+
+var replicationLogIdKey = []byte("logId")
+var replicationTxIdKey = []byte("txId") //slave 最近一次全量同步的快照对应的master 事务id
+
+//slave 需要全量同步: 日志标识不一致(master 数据文件被替换), 需要的日志已被清理, 或 slave 的序号比master 大
+var ErrReplicationSnapshotRequired = errors.New("需要全量同步")
+
+//一次修改, Op 为空时是计数变化, CurrentId 为变化后已分配的最大值
+//Op 为 REPLICATION_OP_PUT/REPLICATION_OP_DELETE 时 是其他bucket 的写入, slave 按原样写入 Bucket 的 Key
+type ReplicationLogEntry struct {
+	Seq        uint64 `json:"seq"`
+	Namespace  string `json:"namespace"`
+	Source     string `json:"source"`
+	CurrentId  int    `json:"currentId"`
+	BucketStep int    `json:"bucketStep"`
+	Time       int64  `json:"time"`
+	Op         string `json:"op,omitempty"`
+	Bucket     string `json:"bucket,omitempty"`
+	Key        []byte `json:"key,omitempty"`
+	Value      []byte `json:"value,omitempty"`
+}
+
+//一个同步包, LogId 为master 的日志标识, 增量日志只按序号同步, 不带master 的事务id
+type ReplicationLogBatch struct {
+	LogId   string                 `json:"logId"`
+	Entries []*ReplicationLogEntry `json:"entries"`
+}
+
+//slave 发起的同步请求, Seq 为slave 已应用的最大序号, TxId 为slave 最近一次全量同步的快照对应的master 事务id, Epoch 为slave 见过的主从切换代数
+//SlaveId 为slave 的标识, master 按标识记录每个slave 的同步进度
+type ReplicationSyncRequest struct {
+	LogId   string `json:"logId"`
+	Seq     uint64 `json:"seq"`
+	TxId    int    `json:"txId"`
+	Epoch   uint64 `json:"epoch"`
+	SlaveId string `json:"slaveId"`
+	WaitMs  int    `json:"waitMs"` //已是最新时 master 最多等待新日志的毫秒数, 有新日志追加时立即回复, 0 时立即回复
+}
+
+func replicationLogKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+
+	return key
+}
+
+func replicationLogSize() uint64 {
+	if size := GetApplication().ConfigData.Bolt.ReplicationLogSize; size > 0 {
+		return uint64(size)
+	}
+
+	return DEFAULT_REPLICATION_LOG_SIZE
+}
+
+//日志标识, 第一次写日志时生成, 全量同步时随数据文件复制到slave
+func ensureReplicationLogId(tx *bolt.Tx) (string, error) {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(REPLICATION_META_BUCKET_NAME))
+	if err != nil {
+		return "", err
+	}
+
+	if logId := bucket.Get(replicationLogIdKey); logId != nil {
+		return string(logId), nil
+	}
+
+	randomBytes := make([]byte, 16)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+
+	logId := hex.EncodeToString(randomBytes)
+
+	return logId, bucket.Put(replicationLogIdKey, []byte(logId))
+}
+
+//日志标识 和 最大序号, 还没有日志时为空
+func replicationState(tx *bolt.Tx) (logId string, lastSeq uint64) {
+	if bucket := tx.Bucket([]byte(REPLICATION_META_BUCKET_NAME)); bucket != nil {
+		logId = string(bucket.Get(replicationLogIdKey))
+	}
+
+	if bucket := tx.Bucket([]byte(REPLICATION_LOG_BUCKET_NAME)); bucket != nil {
+		lastSeq = bucket.Sequence()
+	}
+
+	return logId, lastSeq
+}
+
+//在修改计数的事务中追加一条日志, 出错时 panic 回滚整个事务; 已被新的master 取代时不允许修改计数
+func appendReplicationLog(tx *bolt.Tx, entry *ReplicationLogEntry) {
+	checkErr(appendReplicationLogTx(tx, entry))
+}
+
+func appendReplicationLogTx(tx *bolt.Tx, entry *ReplicationLogEntry) (err error) {
+	if replicationMetaUint64(tx, replicationFencedKey) > 0 {
+		return ErrMasterFenced
+	}
+
+	if _, err = ensureReplicationLogId(tx); err != nil {
+		return err
+	}
+
+	bucket, err := tx.CreateBucketIfNotExists([]byte(REPLICATION_LOG_BUCKET_NAME))
+	if err != nil {
+		return err
+	}
+
+	if entry.Seq, err = bucket.NextSequence(); err != nil {
+		return err
+	}
+
+	if entry.Time == 0 {
+		entry.Time = time.Now().Unix()
+	}
+
+	if err = putReplicationLog(bucket, entry); err != nil {
+		return err
+	}
+
+	tx.OnCommit(notifyReplicationLogAppended)
+
+	return nil
+}
+
+//追加了同步日志的事务提交时关闭, 等待新日志的同步请求立即返回
+var replicationLogAppended = make(chan bool)
+var replicationLogAppendedLock sync.Mutex
+
+func replicationLogAppendedChan() chan bool {
+	replicationLogAppendedLock.Lock()
+	defer replicationLogAppendedLock.Unlock()
+
+	return replicationLogAppended
+}
+
+func notifyReplicationLogAppended() {
+	replicationLogAppendedLock.Lock()
+	defer replicationLogAppendedLock.Unlock()
+
+	close(replicationLogAppended)
+	replicationLogAppended = make(chan bool)
+}
+
+//写入其他bucket 的一个key 并追加同步日志, value 为nil 时删除, 在同一个事务中执行
+func putReplicatedBucketValue(tx *bolt.Tx, bucketName string, key []byte, value []byte) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(bucketName))
+	if err != nil {
+		return err
+	}
+
+	entry := &ReplicationLogEntry{Op: REPLICATION_OP_PUT, Bucket: bucketName, Key: key, Value: value}
+	if value == nil {
+		entry.Op = REPLICATION_OP_DELETE
+		err = bucket.Delete(key)
+	} else {
+		err = bucket.Put(key, value)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return appendReplicationLogTx(tx, entry)
+}
+
+//slave 应用其他bucket 的写入, 同步日志本身的bucket 不允许通过日志修改
+func applyReplicatedBucketValue(tx *bolt.Tx, entry *ReplicationLogEntry) error {
+	if entry.Bucket == "" || entry.Bucket == REPLICATION_LOG_BUCKET_NAME || entry.Bucket == REPLICATION_META_BUCKET_NAME {
+		return errors.New(fmt.Sprintf("同步日志的bucket 错误: %q, seq: %d", entry.Bucket, entry.Seq))
+	}
+
+	bucket, err := tx.CreateBucketIfNotExists([]byte(entry.Bucket))
+	if err != nil {
+		return err
+	}
+
+	if entry.Op == REPLICATION_OP_DELETE {
+		return bucket.Delete(entry.Key)
+	}
+
+	return bucket.Put(entry.Key, entry.Value)
+}
+
+//写入日志, 并清理超出保留条数的旧日志
+func putReplicationLog(bucket *bolt.Bucket, entry *ReplicationLogEntry) error {
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if err := bucket.Put(replicationLogKey(entry.Seq), value); err != nil {
+		return err
+	}
+
+	if size := replicationLogSize(); entry.Seq > size {
+		return bucket.Delete(replicationLogKey(entry.Seq - size))
+	}
+
+	return nil
+}
+
+//和 ReadReplicationLog 相同, 已是最新时 等待新的日志追加 或 超时
+func WaitReplicationLog(boltDb *bolt.DB, logId string, afterSeq uint64, limit int, timeout time.Duration) (*ReplicationLogBatch, error) {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		//先取通知, 读取之后追加的日志不会错过
+		appended := replicationLogAppendedChan()
+
+		batch, err := ReadReplicationLog(boltDb, logId, afterSeq, limit)
+		if err != nil || len(batch.Entries) > 0 {
+			return batch, err
+		}
+
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return batch, nil
+		}
+
+		select {
+		case <-appended:
+		case <-time.After(wait):
+		}
+	}
+}
+
+//master 读取 afterSeq 之后的日志, 最多 limit 条, slave 已是最新时返回空的 Entries
+func ReadReplicationLog(boltDb *bolt.DB, logId string, afterSeq uint64, limit int) (*ReplicationLogBatch, error) {
+	batch := &ReplicationLogBatch{Entries: make([]*ReplicationLogEntry, 0)}
+
+	err := boltDb.View(func(tx *bolt.Tx) error {
+		masterLogId, lastSeq := replicationState(tx)
+		batch.LogId = masterLogId
+
+		if masterLogId == "" && lastSeq == 0 && afterSeq == 0 {
+			return nil //master 还没有数据
+		}
+
+		if logId != masterLogId || afterSeq > lastSeq {
+			return ErrReplicationSnapshotRequired
+		}
+
+		if afterSeq == lastSeq {
+			return nil
+		}
+
+		cursor := tx.Bucket([]byte(REPLICATION_LOG_BUCKET_NAME)).Cursor()
+
+		key, value := cursor.Seek(replicationLogKey(afterSeq + 1))
+		if key == nil || binary.BigEndian.Uint64(key) != afterSeq+1 {
+			return ErrReplicationSnapshotRequired //已被清理
+		}
+
+		for ; key != nil && len(batch.Entries) < limit; key, value = cursor.Next() {
+			entry := new(ReplicationLogEntry)
+			if err := json.Unmarshal(value, entry); err != nil {
+				return err
+			}
+
+			batch.Entries = append(batch.Entries, entry)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return batch, nil
+}
+
+//slave 已应用的日志标识, 最大序号 和 快照对应的master 事务id
+func ReplicationState(boltDb *bolt.DB) (request *ReplicationSyncRequest, err error) {
+	request = new(ReplicationSyncRequest)
+
+	err = boltDb.View(func(tx *bolt.Tx) error {
+		request.LogId, request.Seq = replicationState(tx)
+		request.TxId = replicationTxId(tx)
+		request.Epoch = replicationEpoch(tx)
+		return nil
+	})
+
+	return request, err
+}
+
+//同步元数据中大端保存的数值, 没有时为0
+func replicationMetaUint64(tx *bolt.Tx, key []byte) uint64 {
+	if bucket := tx.Bucket([]byte(REPLICATION_META_BUCKET_NAME)); bucket != nil {
+		if value := bucket.Get(key); len(value) == 8 {
+			return binary.BigEndian.Uint64(value)
+		}
+	}
+
+	return 0
+}
+
+func putReplicationMetaUint64(tx *bolt.Tx, key []byte, number uint64) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(REPLICATION_META_BUCKET_NAME))
+	if err != nil {
+		return err
+	}
+
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, number)
+
+	return bucket.Put(key, value)
+}
+
+func replicationTxId(tx *bolt.Tx) int {
+	return int(replicationMetaUint64(tx, replicationTxIdKey))
+}
+
+func putReplicationTxId(tx *bolt.Tx, txId int) error {
+	return putReplicationMetaUint64(tx, replicationTxIdKey, uint64(txId))
+}
+
+//slave 安装全量数据后 记录快照对应的master 事务id
+func SetReplicationTxId(boltDb *bolt.DB, txId int) error {
+	return boltDb.Update(func(tx *bolt.Tx) error {
+		return putReplicationTxId(tx, txId)
+	})
+}
+
+//master 当前已提交的事务id, 和slave 的事务id 相同时 数据没有变化
+func CurrentTxId(boltDb *bolt.DB) (txId int, err error) {
+	err = boltDb.View(func(tx *bolt.Tx) error {
+		txId = tx.ID()
+		return nil
+	})
+
+	return txId, err
+}
+
+//slave 在一个事务中应用一批日志, 只会增大计数, 日志必须紧接着已应用的序号, 不修改记录的master 事务id
+func ApplyReplicationLog(boltDb *bolt.DB, batch *ReplicationLogBatch) error {
+	return boltDb.Update(func(tx *bolt.Tx) error {
+		logId, lastSeq := replicationState(tx)
+		if logId != batch.LogId {
+			return ErrReplicationSnapshotRequired
+		}
+
+		if len(batch.Entries) == 0 {
+			return nil
+		}
+
+		logBucket, err := tx.CreateBucketIfNotExists([]byte(REPLICATION_LOG_BUCKET_NAME))
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range batch.Entries {
+			if entry.Seq != lastSeq+1 {
+				return errors.New(fmt.Sprintf("同步日志不连续, 已应用: %d, 收到: %d", lastSeq, entry.Seq))
+			}
+
+			switch entry.Op {
+			case REPLICATION_OP_PUT, REPLICATION_OP_DELETE:
+				if err := applyReplicatedBucketValue(tx, entry); err != nil {
+					return err
+				}
+
+			case "":
+				bucketName, _ := boltBucketNames(entry.Namespace)
+				bucket, err := tx.CreateBucketIfNotExists([]byte(bucketName))
+				if err != nil {
+					return err
+				}
+
+				record := getBoltSourceRecord(bucket, entry.Source)
+				if record == nil {
+					record = &boltSourceRecord{CreatedAt: entry.Time}
+				}
+
+				if entry.CurrentId > record.CurrentId {
+					record.CurrentId = entry.CurrentId
+					record.BucketStep = entry.BucketStep
+					putBoltSourceRecord(bucket, entry.Source, record)
+				}
+
+			default:
+				return errors.New(fmt.Sprintf("不识别的同步日志: %q, seq: %d", entry.Op, entry.Seq))
+			}
+
+			if err := putReplicationLog(logBucket, entry); err != nil {
+				return err
+			}
+
+			if err := logBucket.SetSequence(entry.Seq); err != nil {
+				return err
+			}
+
+			lastSeq = entry.Seq
+		}
+
+		//增量日志只记录序号, 事务id 只在安装全量数据时记录, 这时slave 的数据才和master 的事务完全一致
+		return nil
+	})
+}
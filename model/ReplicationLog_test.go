@@ -0,0 +1,231 @@
+package model
+
+import (
+	"github.com/boltdb/bolt"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+//slave 的数据文件, 全量同步时复制master 的数据
+func newTestSlaveBoltDb(t *testing.T, master *bolt.DB) *bolt.DB {
+	filePath := filepath.Join(t.TempDir(), "slave.db")
+
+	err := master.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(filePath, 0644)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slave, err := bolt.Open(filePath, 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return slave
+}
+
+func slaveCurrentId(t *testing.T, slave *bolt.DB, namespace string, source string) int {
+	currentId := -1
+
+	err := slave.View(func(tx *bolt.Tx) error {
+		bucketName, _ := boltBucketNames(namespace)
+		if bucket := tx.Bucket([]byte(bucketName)); bucket != nil {
+			if record := getBoltSourceRecord(bucket, source); record != nil {
+				currentId = record.CurrentId
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return currentId
+}
+
+func TestReplicationLogIncremental(t *testing.T) {
+	master := initTestBoltDb(t)
+
+	namespace := "replication" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	store := NewBoltDbServiceWithNamespace(namespace)
+	store.LoadCurrentIdFromDb("order", 10)
+
+	slave := newTestSlaveBoltDb(t, master)
+	defer slave.Close()
+
+	request, err := ReplicationState(slave)
+	if err != nil || request.LogId == "" || request.Seq == 0 {
+		t.Fatalf("slave state: %+v, %v", request, err)
+	}
+
+	//已是最新
+	batch, err := ReadReplicationLog(master, request.LogId, request.Seq, REPLICATION_LOG_BATCH_SIZE)
+	if err != nil || len(batch.Entries) != 0 {
+		t.Fatalf("up to date: %+v, %v", batch, err)
+	}
+
+	store.IncrSourceCurrentId("order", 10, 10)
+	store.LoadCurrentIdFromDb("user", 5)
+
+	batch, err = ReadReplicationLog(master, request.LogId, request.Seq, 1)
+	if err != nil || len(batch.Entries) != 1 || batch.Entries[0].Seq != request.Seq+1 {
+		t.Fatalf("limited batch: %+v, %v", batch, err)
+	}
+
+	if entry := batch.Entries[0]; entry.Namespace != namespace || entry.Source != "order" || entry.CurrentId != 20 || entry.BucketStep != 10 {
+		t.Errorf("entry: %+v", entry)
+	}
+
+	batch, err = ReadReplicationLog(master, request.LogId, request.Seq, REPLICATION_LOG_BATCH_SIZE)
+	if err != nil || len(batch.Entries) != 2 {
+		t.Fatalf("batch: %+v, %v", batch, err)
+	}
+
+	if err := ApplyReplicationLog(slave, batch); err != nil {
+		t.Fatal(err)
+	}
+
+	if currentId := slaveCurrentId(t, slave, namespace, "order"); currentId != 20 {
+		t.Errorf("slave order: %d", currentId)
+	}
+	if currentId := slaveCurrentId(t, slave, namespace, "user"); currentId != 5 {
+		t.Errorf("slave user: %d", currentId)
+	}
+
+	//重复应用时 序号不连续
+	if err := ApplyReplicationLog(slave, batch); err == nil {
+		t.Error("duplicate batch applied")
+	}
+
+	slaveRequest, _ := ReplicationState(slave)
+	if slaveRequest.Seq != request.Seq+2 {
+		t.Errorf("slave seq: %d", slaveRequest.Seq)
+	}
+
+	//增量日志不修改slave 记录的master 事务id, 仍然是全量同步时的值
+	if slaveRequest.TxId != request.TxId {
+		t.Errorf("tx id, snapshot: %d, slave: %d", request.TxId, slaveRequest.TxId)
+	}
+
+	//没有新的日志时 什么也不修改
+	if err := ApplyReplicationLog(slave, &ReplicationLogBatch{LogId: batch.LogId}); err != nil {
+		t.Fatal(err)
+	}
+	if slaveRequest, _ = ReplicationState(slave); slaveRequest.TxId != request.TxId || slaveRequest.Seq != request.Seq+2 {
+		t.Errorf("empty batch: %+v", slaveRequest)
+	}
+
+	//日志标识不一致 或 slave 的序号更大
+	if _, err := ReadReplicationLog(master, "other", slaveRequest.Seq, 10); err != ErrReplicationSnapshotRequired {
+		t.Errorf("other log id: %v", err)
+	}
+	if _, err := ReadReplicationLog(master, request.LogId, slaveRequest.Seq+100, 10); err != ErrReplicationSnapshotRequired {
+		t.Errorf("slave ahead: %v", err)
+	}
+}
+
+//需要的日志已被清理时 全量同步
+func TestReplicationLogTruncated(t *testing.T) {
+	master := initTestBoltDb(t)
+
+	GetApplication().ConfigData.Bolt.ReplicationLogSize = 3
+	defer func() { GetApplication().ConfigData.Bolt.ReplicationLogSize = 0 }()
+
+	store := NewBoltDbServiceWithNamespace("truncated" + strconv.FormatInt(time.Now().UnixNano(), 10))
+	store.LoadCurrentIdFromDb("order", 1)
+
+	request, err := ReplicationState(master)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		store.LoadCurrentIdFromDb("order", 1)
+	}
+
+	if _, err := ReadReplicationLog(master, request.LogId, request.Seq, 10); err != ErrReplicationSnapshotRequired {
+		t.Errorf("truncated log: %v", err)
+	}
+
+	batch, err := ReadReplicationLog(master, request.LogId, request.Seq+2, 10)
+	if err != nil || len(batch.Entries) != 3 {
+		t.Errorf("retained log: %+v, %v", batch, err)
+	}
+}
+
+//source 配置 和 worker id 租约的修改也通过同步日志复制到slave
+func TestReplicationLogBucketValues(t *testing.T) {
+	master := initTestBoltDb(t)
+	store := NewBoltDbService()
+
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 10)
+	deleted := &SourceConfig{Source: "deleted" + suffix, StartId: 1}
+	if err := store.SaveSourceConfig(deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	slave := newTestSlaveBoltDb(t, master)
+	defer slave.Close()
+
+	request, _ := ReplicationState(slave)
+
+	saved := &SourceConfig{Source: "saved" + suffix, StartId: 100, BucketStep: 10}
+	if err := store.SaveSourceConfig(saved); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteSourceConfig(deleted.Source); err != nil {
+		t.Fatal(err)
+	}
+
+	owner := "replication" + suffix
+	workerId, err := store.AcquireWorkerLease(owner, 1023, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	released, err := store.AcquireWorkerLease(owner+"_released", 1023, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.ReleaseWorkerLease(owner+"_released", released); err != nil {
+		t.Fatal(err)
+	}
+
+	batch, err := ReadReplicationLog(master, request.LogId, request.Seq, REPLICATION_LOG_BATCH_SIZE)
+	if err != nil || len(batch.Entries) != 5 {
+		t.Fatalf("batch: %+v, %v", batch, err)
+	}
+
+	if err := ApplyReplicationLog(slave, batch); err != nil {
+		t.Fatal(err)
+	}
+
+	err = slave.View(func(tx *bolt.Tx) error {
+		sources := tx.Bucket([]byte(SOURCE_BUCKET_NAME))
+		if sources.Get([]byte(saved.Source)) == nil || sources.Get([]byte(deleted.Source)) != nil {
+			t.Errorf("source configs on slave")
+		}
+
+		leases := tx.Bucket([]byte(WORKER_LEASE_BUCKET_NAME))
+		if leases.Get([]byte(strconv.FormatInt(workerId, 10))) == nil || leases.Get([]byte(strconv.FormatInt(released, 10))) != nil {
+			t.Errorf("worker leases on slave")
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//同步日志本身的bucket 不能通过日志修改
+	slaveRequest, _ := ReplicationState(slave)
+	forged := &ReplicationLogBatch{LogId: batch.LogId, Entries: []*ReplicationLogEntry{
+		{Seq: slaveRequest.Seq + 1, Op: REPLICATION_OP_PUT, Bucket: REPLICATION_META_BUCKET_NAME, Key: replicationLogIdKey, Value: []byte("other")},
+	}}
+	if err := ApplyReplicationLog(slave, forged); err == nil {
+		t.Error("replication meta overwritten")
+	}
+}
@@ -0,0 +1,108 @@
+package model
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	PERSIST_TYPE_MYSQL  = "mysql"  //mysql持久化
+	PERSIST_TYPE_BOLTDB = "boltdb" //boltdb持久化
+	PERSIST_TYPE_RPC    = "rpc"    //slave 通过 rpc 使用master 的boltdb
+)
+
+//号段分配的持久化, 每个source 保存一个已分配的最大值
+//新的持久化方式实现这个接口, 并通过 RegisterSegmentStore 注册, 配置中的 persistType 选择使用哪一个
+//如果同时实现了 SourceRegistryStore, WorkerLeaseStore, source 配置和 worker id 租约也使用同一个持久化
+type SegmentStore interface {
+	//第一次加载source, 返回当前的最大值, 并将持久化的最大值增加 bucketStep
+	LoadCurrentIdFromDb(source string, bucketStep int) int
+	//持久化一个新号段, 返回实际的起始id 和新的最大值(不可用)
+	IncrSourceCurrentId(source string, currentId int, bucketStep int) (int, int)
+	//source 最近一次使用的步长, 没有记录时返回0
+	LoadSourceStep(source string) int
+}
+
+//创建持久化实例, 出错时直接 panic, 和 NewBoltDbService, NewMysqlService 一致
+//namespace 为空表示默认的namespace, 不同namespace 的数据不能互相影响
+type SegmentStoreFactory func(namespace string) SegmentStore
+
+var segmentStoreFactories = make(map[string]SegmentStoreFactory)
+var segmentStoreLock sync.RWMutex
+
+//注册一个持久化方式, 一般在持久化实现所在文件的 init 中调用
+func RegisterSegmentStore(name string, factory SegmentStoreFactory) {
+	name = strings.ToLower(name)
+	if name == "" || factory == nil {
+		panic("持久化方式的名称和创建方法不能为空")
+	}
+
+	segmentStoreLock.Lock()
+	defer segmentStoreLock.Unlock()
+
+	if _, exist := segmentStoreFactories[name]; exist {
+		panic("持久化方式重复注册: " + name)
+	}
+
+	segmentStoreFactories[name] = factory
+}
+
+//按名称获取持久化实例
+func GetSegmentStore(name string, namespace string) (SegmentStore, error) {
+	segmentStoreLock.RLock()
+	factory, exist := segmentStoreFactories[strings.ToLower(name)]
+	segmentStoreLock.RUnlock()
+
+	if !exist {
+		return nil, errors.New("不支持的持久化方式: " + name + ", 可选: " + strings.Join(SegmentStoreNames(), ", "))
+	}
+
+	return factory(namespace), nil
+}
+
+//持久化方式是否已注册
+func HasSegmentStore(name string) bool {
+	segmentStoreLock.RLock()
+	defer segmentStoreLock.RUnlock()
+
+	_, exist := segmentStoreFactories[strings.ToLower(name)]
+
+	return exist
+}
+
+//已注册的持久化方式
+func SegmentStoreNames() []string {
+	segmentStoreLock.RLock()
+	defer segmentStoreLock.RUnlock()
+
+	names := make([]string, 0, len(segmentStoreFactories))
+	for name := range segmentStoreFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+//当前使用的持久化方式, slave 的boltdb 通过 rpc 访问master, cluster 模式使用 raft
+func currentPersistType() string {
+	configData := GetApplication().ConfigData
+	role := GetApplication().currentRole()
+	if role == SERVER_CLUSTER {
+		return PERSIST_TYPE_RAFT
+	}
+
+	persistType := strings.ToLower(string(configData.PersistType))
+	if persistType == PERSIST_TYPE_BOLTDB && role == SERVER_SLAVE {
+		return PERSIST_TYPE_RPC
+	}
+
+	return persistType
+}
+
+//当前配置的持久化实例, 默认namespace
+func getCurrentSegmentStore() (SegmentStore, error) {
+	return GetSegmentStore(currentPersistType(), "")
+}
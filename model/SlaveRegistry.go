@@ -0,0 +1,383 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"idGenerator/model/logger"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_REPLICATION_SYNC_INTERVAL_MS = 2000 //slave 请求同步日志的默认间隔
+	DEFAULT_SEMI_SYNC_TIMEOUT_MS         = 5000 //半同步等待slave 确认的默认超时
+	REPLICATION_MAX_WAIT_MS              = 5000 //slave 的同步请求在master 上最多等待新日志的时间, 小于连接不活跃的检查时间
+)
+
+var ErrSemiSyncTimeout = errors.New("等待slave 确认同步日志超时")
+
+//master 上登记的slave 同步状态, slave 每次同步请求中带上已应用的日志序号, 作为确认
+type SlaveStatus struct {
+	SlaveId     string `json:"slaveId"`
+	Address     string `json:"address"`     //slave 的连接地址
+	Connected   bool   `json:"connected"`
+	LogId       string `json:"logId"`       //slave 数据对应的日志标识, 和master 不一致时需要全量同步
+	Seq         uint64 `json:"seq"`         //已应用的最大日志序号
+	TxId        int    `json:"txId"`        //最近一次全量同步的快照对应的master 事务id
+	Epoch       uint64 `json:"epoch"`
+	LagSeq      uint64 `json:"lagSeq"`      //落后master 的日志条数, 日志标识不一致时为master 的最大序号
+	LagSeconds  int64  `json:"lagSeconds"`  //最早一条没有应用的日志 到现在的秒数
+	FullSyncs   int    `json:"fullSyncs"`   //全量同步的次数
+	ConnectedAt int64  `json:"connectedAt"`
+	AckedAt     int64  `json:"ackedAt"`     //最近一次同步请求的时间
+}
+
+//master 的同步状态 和 所有登记过的slave
+type ReplicationStatus struct {
+	LogId          string         `json:"logId"`
+	Seq            uint64         `json:"seq"`
+	Epoch          uint64         `json:"epoch"`
+	SemiSyncSlaves int            `json:"semiSyncSlaves"`
+	Slaves         []*SlaveStatus `json:"slaves"`
+}
+
+//半同步: 已提交 还没有被足够的slave 确认的号段
+type semiSyncSegment struct {
+	logId   string
+	seq     uint64
+	firstId int //号段中可能发出的最小id
+	maxId   int //号段的上界(不可用)
+}
+
+type slaveRegistryItem struct {
+	status  SlaveStatus
+	context *Context //当前连接, 断开后为nil
+}
+
+//master 记录每个slave 的同步进度, 断开的slave 保留最后的状态
+type SlaveRegistry struct {
+	lock   sync.Mutex
+	acked  *sync.Cond //slave 确认 或 断开时通知等待半同步的请求
+	slaves map[string]*slaveRegistryItem
+
+	pending map[string][]semiSyncSegment //key 为带namespace 的source, 按序号排列
+}
+
+var slaveRegistryInstance *SlaveRegistry
+var slaveRegistryOnce sync.Once
+
+//单例获取 slave 同步状态
+func GetSlaveRegistry() *SlaveRegistry {
+	slaveRegistryOnce.Do(func() {
+		slaveRegistryInstance = newSlaveRegistry()
+	})
+
+	return slaveRegistryInstance
+}
+
+func newSlaveRegistry() *SlaveRegistry {
+	registry := &SlaveRegistry{slaves: make(map[string]*slaveRegistryItem), pending: make(map[string][]semiSyncSegment)}
+	registry.acked = sync.NewCond(&registry.lock)
+
+	return registry
+}
+
+//slave 的标识, 没有配置时使用 主机名:应用根目录
+func replicationSlaveId() string {
+	if slaveId := GetApplication().ConfigData.Bolt.SlaveId; slaveId != "" {
+		return slaveId
+	}
+
+	hostname, _ := os.Hostname()
+
+	return hostname + ":" + GetApplication().BasePath
+}
+
+func replicationSyncInterval() time.Duration {
+	if interval := GetApplication().ConfigData.Bolt.SyncIntervalMs; interval > 0 {
+		return time.Duration(interval) * time.Millisecond
+	}
+
+	return DEFAULT_REPLICATION_SYNC_INTERVAL_MS * time.Millisecond
+}
+
+//旧版本的slave 不带标识, 使用连接地址
+func requestSlaveId(context *Context, request *ReplicationSyncRequest) string {
+	if request.SlaveId != "" {
+		return request.SlaveId
+	}
+
+	return context.Connection.RemoteAddr().String()
+}
+
+//收到同步请求时 更新slave 已应用的日志
+func (registry *SlaveRegistry) ack(context *Context, request *ReplicationSyncRequest) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	slaveId := requestSlaveId(context, request)
+	now := time.Now().Unix()
+
+	item, exist := registry.slaves[slaveId]
+	if !exist {
+		item = &slaveRegistryItem{status: SlaveStatus{SlaveId: slaveId}}
+		registry.slaves[slaveId] = item
+	}
+
+	if item.context != context {
+		item.context = context
+		item.status.Address = context.Connection.RemoteAddr().String()
+		item.status.ConnectedAt = now
+	}
+
+	item.status.Connected = true
+	item.status.LogId = request.LogId
+	item.status.Seq = request.Seq
+	item.status.TxId = request.TxId
+	item.status.Epoch = request.Epoch
+	item.status.AckedAt = now
+
+	registry.prunePending()
+	registry.acked.Broadcast()
+}
+
+//给这个连接的slave 发送了全量数据
+func (registry *SlaveRegistry) fullSync(context *Context) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	for _, item := range registry.slaves {
+		if item.context == context {
+			item.status.FullSyncs++
+		}
+	}
+}
+
+//连接断开, 不再计入半同步的确认
+func (registry *SlaveRegistry) disconnect(context *Context) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	for _, item := range registry.slaves {
+		if item.context == context {
+			item.context = nil
+			item.status.Connected = false
+		}
+	}
+
+	registry.acked.Broadcast()
+}
+
+//最近一次收到任何slave 同步请求的时间戳, 没有时为0
+func (registry *SlaveRegistry) lastAckedAt() int64 {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	var ackedAt int64
+	for _, item := range registry.slaves {
+		if item.status.AckedAt > ackedAt {
+			ackedAt = item.status.AckedAt
+		}
+	}
+
+	return ackedAt
+}
+
+//已连接 并应用了 logId 的 seq 之后的日志的slave 数
+func (registry *SlaveRegistry) ackedCount(logId string, seq uint64) int {
+	count := 0
+	for _, item := range registry.slaves {
+		if item.status.Connected && item.status.LogId == logId && item.status.Seq >= seq {
+			count++
+		}
+	}
+
+	return count
+}
+
+//提交了一个号段, 半同步时 发出其中的id 之前等待确认
+func (registry *SlaveRegistry) addPending(source string, segment semiSyncSegment) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	registry.pending[source] = append(registry.pending[source], segment)
+}
+
+//删除已被足够slave 确认的号段, 调用方需要持有锁
+func (registry *SlaveRegistry) prunePending() {
+	count := GetApplication().ConfigData.Bolt.SemiSyncSlaves
+
+	for source, segments := range registry.pending {
+		kept := segments[:0]
+		for _, segment := range segments {
+			if count > 0 && registry.ackedCount(segment.logId, segment.seq) < count {
+				kept = append(kept, segment)
+			}
+		}
+
+		if len(kept) == 0 {
+			delete(registry.pending, source)
+		} else {
+			registry.pending[source] = kept
+		}
+	}
+}
+
+//id 所在的还没有确认的号段, 预加载的下一个号段不影响当前号段的id
+func (registry *SlaveRegistry) pendingSegment(source string, id int) (semiSyncSegment, bool) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	for _, segment := range registry.pending[source] {
+		if segment.firstId <= id && id < segment.maxId {
+			return segment, true
+		}
+	}
+
+	return semiSyncSegment{}, false
+}
+
+//删除 seq 之前(包含)的号段, 确认 或 超时后调用
+func (registry *SlaveRegistry) removePending(source string, seq uint64) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	segments := registry.pending[source]
+	for len(segments) > 0 && segments[0].seq <= seq {
+		segments = segments[1:]
+	}
+
+	if len(segments) == 0 {
+		delete(registry.pending, source)
+	} else {
+		registry.pending[source] = segments
+	}
+}
+
+//等待至少 count 个slave 应用了 seq 对应的日志, 超时返回 ErrSemiSyncTimeout
+func (registry *SlaveRegistry) WaitAck(logId string, seq uint64, count int, timeout time.Duration) error {
+	expired := false
+	timer := time.AfterFunc(timeout, func() {
+		registry.lock.Lock()
+		expired = true
+		registry.acked.Broadcast()
+		registry.lock.Unlock()
+	})
+	defer timer.Stop()
+
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	for registry.ackedCount(logId, seq) < count {
+		if expired {
+			return ErrSemiSyncTimeout
+		}
+
+		registry.acked.Wait()
+	}
+
+	return nil
+}
+
+//所有slave 的同步状态, 按master 当前的日志计算落后的条数和时间
+func (registry *SlaveRegistry) Status(boltDb *bolt.DB) (*ReplicationStatus, error) {
+	registry.lock.Lock()
+	slaves := make([]*SlaveStatus, 0, len(registry.slaves))
+	for _, item := range registry.slaves {
+		status := item.status
+		slaves = append(slaves, &status)
+	}
+	registry.lock.Unlock()
+
+	sort.Slice(slaves, func(i, j int) bool {
+		return slaves[i].SlaveId < slaves[j].SlaveId
+	})
+
+	result := &ReplicationStatus{SemiSyncSlaves: GetApplication().ConfigData.Bolt.SemiSyncSlaves, Slaves: slaves}
+	now := time.Now().Unix()
+
+	err := boltDb.View(func(tx *bolt.Tx) error {
+		result.LogId, result.Seq = replicationState(tx)
+		result.Epoch = replicationEpoch(tx)
+
+		for _, slave := range slaves {
+			if slave.LogId != result.LogId {
+				slave.LagSeq = result.Seq
+			} else if slave.Seq < result.Seq {
+				slave.LagSeq = result.Seq - slave.Seq
+			}
+
+			if slave.LagSeq == 0 {
+				continue
+			}
+
+			//第一条没有应用的日志, 已被清理时使用最早的一条
+			bucket := tx.Bucket([]byte(REPLICATION_LOG_BUCKET_NAME))
+			if bucket == nil {
+				continue
+			}
+
+			value := bucket.Get(replicationLogKey(result.Seq - slave.LagSeq + 1))
+			if value == nil {
+				_, value = bucket.Cursor().First()
+			}
+
+			entry := new(ReplicationLogEntry)
+			if value != nil && json.Unmarshal(value, entry) == nil && entry.Time > 0 {
+				slave.LagSeconds = now - entry.Time
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+//半同步: 发出id 之前 等待配置数量的slave 应用了id 所在号段的日志, 在source 的锁之外调用
+//超时不是错误: 号段已提交, id 照常发出; master 宕机时提升的slave 跳过 步长 + safetyMargin, 没有同步到的号段被浪费, 不会重复分配
+func waitSemiSyncAck(source string, id int) {
+	configData := GetApplication().ConfigData.Bolt
+	if configData.SemiSyncSlaves <= 0 {
+		return
+	}
+
+	registry := GetSlaveRegistry()
+	segment, exist := registry.pendingSegment(source, id)
+	if !exist {
+		return
+	}
+
+	timeout := time.Duration(configData.SemiSyncTimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = DEFAULT_SEMI_SYNC_TIMEOUT_MS * time.Millisecond
+	}
+
+	if err := registry.WaitAck(segment.logId, segment.seq, configData.SemiSyncSlaves, timeout); err != nil {
+		logger.AsyncInfo(fmt.Sprintf("%v, source: %s, seq: %d, semiSyncSlaves: %d, 号段已提交, 继续发出", err, source, segment.seq, configData.SemiSyncSlaves))
+	}
+
+	registry.removePending(source, segment.seq)
+}
+
+//master 的同步状态, 只有使用boltdb 的master 记录slave
+func (application *Application) ReplicationStatus() (*ReplicationStatus, error) {
+	if currentPersistType() != PERSIST_TYPE_BOLTDB {
+		return nil, errors.New("只有使用boltdb 的master 记录slave 同步状态, 当前持久化方式: " + currentPersistType())
+	}
+
+	boltDb, errGetBolt := application.GetBoltDB()
+	if errGetBolt != nil {
+		return nil, errors.New(fmt.Sprintf("打开数据文件失败: %v", errGetBolt))
+	}
+
+	return GetSlaveRegistry().Status(boltDb)
+}
@@ -0,0 +1,190 @@
+package model
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestSlaveContext(t *testing.T) *Context {
+	connection, peer := net.Pipe()
+	t.Cleanup(func() {
+		connection.Close()
+		peer.Close()
+	})
+
+	return &Context{connection, time.Now().Unix(), new(sync.Mutex), nil, nil}
+}
+
+func TestSlaveRegistryStatus(t *testing.T) {
+	master := initTestBoltDb(t)
+
+	store := NewBoltDbServiceWithNamespace("slaves" + strconv.FormatInt(time.Now().UnixNano(), 10))
+	for i := 0; i < 3; i++ {
+		store.LoadCurrentIdFromDb("order"+strconv.Itoa(i), 10)
+	}
+
+	masterState, _ := ReplicationState(master)
+
+	registry := newSlaveRegistry()
+	contextA, contextB, contextC := newTestSlaveContext(t), newTestSlaveContext(t), newTestSlaveContext(t)
+
+	registry.ack(contextA, &ReplicationSyncRequest{SlaveId: "a", LogId: masterState.LogId, Seq: masterState.Seq})
+	registry.ack(contextB, &ReplicationSyncRequest{SlaveId: "b", LogId: masterState.LogId, Seq: masterState.Seq - 2})
+	registry.fullSync(contextB)
+	//日志标识不一致, 需要全量同步
+	registry.ack(contextC, &ReplicationSyncRequest{SlaveId: "c", LogId: "other", Seq: masterState.Seq})
+	registry.disconnect(contextA)
+
+	status, err := registry.Status(master)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status.LogId != masterState.LogId || status.Seq != masterState.Seq || len(status.Slaves) != 3 {
+		t.Fatalf("status: %+v", status)
+	}
+
+	a, b, c := status.Slaves[0], status.Slaves[1], status.Slaves[2]
+	if a.SlaveId != "a" || a.Connected || a.LagSeq != 0 {
+		t.Errorf("a: %+v", a)
+	}
+
+	if b.SlaveId != "b" || !b.Connected || b.LagSeq != 2 || b.FullSyncs != 1 || b.LagSeconds < 0 {
+		t.Errorf("b: %+v", b)
+	}
+
+	if c.SlaveId != "c" || c.LagSeq != masterState.Seq {
+		t.Errorf("c: %+v", c)
+	}
+
+	//重新连接后使用新的连接
+	contextA2 := newTestSlaveContext(t)
+	registry.ack(contextA2, &ReplicationSyncRequest{SlaveId: "a", LogId: masterState.LogId, Seq: masterState.Seq})
+	registry.disconnect(contextA)
+
+	if status, _ := registry.Status(master); !status.Slaves[0].Connected {
+		t.Errorf("reconnected a: %+v", status.Slaves[0])
+	}
+}
+
+func TestSlaveRegistryWaitAck(t *testing.T) {
+	registry := newSlaveRegistry()
+	contextA, contextB := newTestSlaveContext(t), newTestSlaveContext(t)
+
+	registry.ack(contextA, &ReplicationSyncRequest{SlaveId: "a", LogId: "log", Seq: 5})
+
+	if err := registry.WaitAck("log", 5, 1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := registry.WaitAck("log", 6, 1, 50*time.Millisecond); err != ErrSemiSyncTimeout {
+		t.Fatalf("no ack: %v", err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		//其他日志标识的确认不计入
+		registry.ack(contextB, &ReplicationSyncRequest{SlaveId: "b", LogId: "other", Seq: 10})
+		registry.ack(contextA, &ReplicationSyncRequest{SlaveId: "a", LogId: "log", Seq: 6})
+	}()
+
+	if err := registry.WaitAck("log", 6, 1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := registry.WaitAck("log", 6, 2, 50*time.Millisecond); err != ErrSemiSyncTimeout {
+		t.Fatalf("one slave acked: %v", err)
+	}
+
+	//断开的slave 不计入
+	registry.disconnect(contextA)
+	if err := registry.WaitAck("log", 6, 1, 50*time.Millisecond); err != ErrSemiSyncTimeout {
+		t.Fatalf("disconnected slave: %v", err)
+	}
+}
+
+//半同步: 提交的号段在确认前登记, 等待在锁外进行, 超时不报错 并不再等待这个号段
+func TestSemiSyncPendingSegments(t *testing.T) {
+	initTestBoltDb(t)
+
+	boltConfig := &GetApplication().ConfigData.Bolt
+	boltConfig.SemiSyncSlaves, boltConfig.SemiSyncTimeoutMs = 1, 50
+	defer func() { boltConfig.SemiSyncSlaves, boltConfig.SemiSyncTimeoutMs = 0, 0 }()
+
+	namespace := "semi" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	source := NamespacedSource(namespace, "order")
+	store := NewBoltDbServiceWithNamespace(namespace)
+	registry := GetSlaveRegistry()
+
+	currentId := store.LoadCurrentIdFromDb("order", 10)
+	if _, exist := registry.pendingSegment(source, currentId+1); !exist {
+		t.Fatal("load not pending")
+	}
+
+	//没有slave 时 超时后照常返回
+	start := time.Now()
+	waitSemiSyncAck(source, currentId+1)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("returned before timeout: %v", elapsed)
+	}
+	if _, exist := registry.pendingSegment(source, currentId+1); exist {
+		t.Error("timed out segment still pending")
+	}
+
+	//当前号段 和 预加载的下一个号段, 当前号段的id 只等待当前号段
+	first, firstMax := store.IncrSourceCurrentId("order", currentId+10, 10)
+	second, _ := store.IncrSourceCurrentId("order", firstMax, 10)
+
+	firstSegment, _ := registry.pendingSegment(source, first)
+	secondSegment, _ := registry.pendingSegment(source, second)
+	if firstSegment.seq == 0 || secondSegment.seq != firstSegment.seq+1 {
+		t.Fatalf("segments: %+v, %+v", firstSegment, secondSegment)
+	}
+
+	//slave 确认了第一个号段
+	context := newTestSlaveContext(t)
+	registry.ack(context, &ReplicationSyncRequest{SlaveId: namespace, LogId: firstSegment.logId, Seq: firstSegment.seq})
+	defer registry.disconnect(context)
+
+	start = time.Now()
+	waitSemiSyncAck(source, first)
+	if elapsed := time.Since(start); elapsed >= 50*time.Millisecond {
+		t.Errorf("acked segment waited: %v", elapsed)
+	}
+	if _, exist := registry.pendingSegment(source, second); !exist {
+		t.Error("next segment not pending")
+	}
+}
+
+//master 在同步请求上等待, 有新的日志追加时立即返回
+func TestWaitReplicationLog(t *testing.T) {
+	master := initTestBoltDb(t)
+
+	store := NewBoltDbServiceWithNamespace("wait" + strconv.FormatInt(time.Now().UnixNano(), 10))
+	store.LoadCurrentIdFromDb("order", 10)
+
+	request, _ := ReplicationState(master)
+
+	start := time.Now()
+	batch, err := WaitReplicationLog(master, request.LogId, request.Seq, 10, 50*time.Millisecond)
+	if err != nil || len(batch.Entries) != 0 || time.Since(start) < 50*time.Millisecond {
+		t.Fatalf("no new log: %+v, %v", batch, err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		store.LoadCurrentIdFromDb("order", 10)
+	}()
+
+	start = time.Now()
+	batch, err = WaitReplicationLog(master, request.LogId, request.Seq, 10, 5*time.Second)
+	if err != nil || len(batch.Entries) != 1 {
+		t.Fatalf("appended: %+v, %v", batch, err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("waited until timeout: %v", elapsed)
+	}
+}
@@ -0,0 +1,135 @@
+package model
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"idGenerator/model/persistent"
+	"os"
+	"path/filepath"
+)
+
+const SNAPSHOT_TMP_SUFFIX = ".sync.tmp" //slave 接收全量数据的临时文件
+
+//全量同步结束时 master 在 ACTION_CHUNK_END 中发送的校验信息, TxId 为生成快照的master 读事务id
+type SnapshotChecksum struct {
+	Size int64  `json:"size"`
+	Md5  string `json:"md5"`
+	TxId int    `json:"txId"`
+}
+
+//slave 接收全量数据, 先写临时文件, 校验通过后再替换数据文件, 传输中断不会损坏已有的数据
+type snapshotReceiver struct {
+	FilePath string //最终的数据文件
+	file     *os.File
+	hash     hash.Hash
+	size     int64
+}
+
+func newSnapshotReceiver(filePath string) *snapshotReceiver {
+	return &snapshotReceiver{FilePath: filePath}
+}
+
+func (receiver *snapshotReceiver) tmpFilePath() string {
+	return receiver.FilePath + SNAPSHOT_TMP_SUFFIX
+}
+
+//是否正在接收
+func (receiver *snapshotReceiver) receiving() bool {
+	return receiver.file != nil
+}
+
+//开始接收, 之前未完成的临时文件会被覆盖
+func (receiver *snapshotReceiver) begin() error {
+	receiver.abort()
+
+	file, err := os.OpenFile(receiver.tmpFilePath(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	receiver.file = file
+	receiver.hash = md5.New()
+	receiver.size = 0
+
+	return nil
+}
+
+func (receiver *snapshotReceiver) write(data []byte) error {
+	if receiver.file == nil {
+		return errors.New("还没有开始接收全量数据")
+	}
+
+	n, err := receiver.file.Write(data)
+	receiver.hash.Write(data[:n])
+	receiver.size += int64(n)
+
+	return err
+}
+
+//校验通过后 fsync 并原子替换数据文件, 重新打开 boltdb 单例
+func (receiver *snapshotReceiver) finish(checksumData []byte) (int64, error) {
+	if receiver.file == nil {
+		return 0, errors.New("还没有开始接收全量数据")
+	}
+
+	defer receiver.abort()
+
+	checksum := new(SnapshotChecksum)
+	if err := json.Unmarshal(checksumData, checksum); err != nil {
+		return 0, errors.New("master 没有发送全量数据的校验值")
+	}
+
+	md5Value := fmt.Sprintf("%x", receiver.hash.Sum(nil))
+	if checksum.Size != receiver.size || checksum.Md5 != md5Value {
+		return 0, errors.New(fmt.Sprintf("全量数据校验失败, size: %d/%d, md5: %s/%s", receiver.size, checksum.Size, md5Value, checksum.Md5))
+	}
+
+	if err := receiver.file.Sync(); err != nil {
+		return 0, err
+	}
+
+	if err := receiver.file.Close(); err != nil {
+		return 0, err
+	}
+	receiver.file = nil
+
+	//替换之前关闭已打开的数据文件
+	if err := persistent.CloseBoltDB(); err != nil {
+		return 0, err
+	}
+
+	if err := os.Rename(receiver.tmpFilePath(), receiver.FilePath); err != nil {
+		return 0, err
+	}
+
+	//rename 写入目录之后才能保证掉电不丢
+	if dir, err := os.Open(filepath.Dir(receiver.FilePath)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	boltDb, err := GetApplication().GetBoltDB()
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("打开同步后的数据文件失败: %v", err))
+	}
+
+	//记录快照对应的master 事务id, 之后只请求这个事务之后的修改
+	if err := SetReplicationTxId(boltDb, checksum.TxId); err != nil {
+		return 0, err
+	}
+
+	return receiver.size, nil
+}
+
+//放弃本次接收, 删除临时文件
+func (receiver *snapshotReceiver) abort() {
+	if receiver.file != nil {
+		receiver.file.Close()
+		receiver.file = nil
+	}
+
+	os.Remove(receiver.tmpFilePath())
+}
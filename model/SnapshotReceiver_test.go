@@ -0,0 +1,94 @@
+package model
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func receiveTestSnapshot(t *testing.T, receiver *snapshotReceiver, data []byte, checksum *SnapshotChecksum) (int64, error) {
+	if err := receiver.begin(); err != nil {
+		t.Fatal(err)
+	}
+
+	//分块写入
+	for start := 0; start < len(data); start += 1024 {
+		end := start + 1024
+		if end > len(data) {
+			end = len(data)
+		}
+
+		if err := receiver.write(data[start:end]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checksumData, _ := json.Marshal(checksum)
+
+	return receiver.finish(checksumData)
+}
+
+func TestSnapshotReceiverInstall(t *testing.T) {
+	boltDb := initTestBoltDb(t)
+
+	namespace := "snapshot" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	store := NewBoltDbServiceWithNamespace(namespace)
+	store.LoadCurrentIdFromDb("order", 10)
+
+	var snapshot bytes.Buffer
+	err := boltDb.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(&snapshot)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//快照之后的修改, 安装快照后回到快照时的值
+	store.LoadCurrentIdFromDb("order", 10)
+
+	receiver := newSnapshotReceiver(GetApplication().ConfigData.Bolt.FilePath)
+	data := snapshot.Bytes()
+
+	//校验失败时 保留原数据文件, 删除临时文件
+	if _, err := receiveTestSnapshot(t, receiver, data[:len(data)/2], &SnapshotChecksum{Size: int64(len(data)), Md5: fmt.Sprintf("%x", md5.Sum(data))}); err == nil {
+		t.Fatal("truncated snapshot installed")
+	}
+	if _, err := os.Stat(receiver.tmpFilePath()); !os.IsNotExist(err) {
+		t.Errorf("tmp file left: %v", err)
+	}
+	if currentId := slaveCurrentId(t, initTestBoltDb(t), namespace, "order"); currentId != 20 {
+		t.Errorf("after failed install: %d", currentId)
+	}
+
+	//master 没有发送校验值
+	receiver.begin()
+	receiver.write(data)
+	if _, err := receiver.finish([]byte{0x1}); err == nil {
+		t.Fatal("snapshot without checksum installed")
+	}
+
+	size, err := receiveTestSnapshot(t, receiver, data, &SnapshotChecksum{Size: int64(len(data)), Md5: fmt.Sprintf("%x", md5.Sum(data)), TxId: 12345})
+	if err != nil || size != int64(len(data)) {
+		t.Fatalf("install: %d, %v", size, err)
+	}
+	if receiver.receiving() {
+		t.Error("still receiving")
+	}
+
+	//重新打开的数据文件
+	if currentId := slaveCurrentId(t, initTestBoltDb(t), namespace, "order"); currentId != 10 {
+		t.Errorf("after install: %d", currentId)
+	}
+
+	//快照对应的master 事务id
+	if request, err := ReplicationState(initTestBoltDb(t)); err != nil || request.TxId != 12345 {
+		t.Errorf("snapshot tx id: %+v, %v", request, err)
+	}
+}
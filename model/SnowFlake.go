@@ -3,8 +3,9 @@
 // its link is: https://github.com/twitter/snowflake/releases/tag/snowflake-2010
 //
 
+// default layout, see SnowFlakeLayout.go for the configurable one
 // +---------------+----------------+----------------+
-// |timestamp(ms)42  | worker id(10) | sequence(12)	 |
+// |timestamp(ms)41  | worker id(10) | sequence(12)	 |
 // +---------------+----------------+----------------+
 
 // Copyright (C) 2017 by cclehui
@@ -13,6 +14,7 @@ package model
 
 import (
 	"errors"
+	"strconv"
 	"sync"
 	"time"
 	//"fmt"
@@ -34,49 +36,85 @@ const (
 // SnowFlakeIdWorker Struct
 type SnowFlakeIdWorker struct {
 	workerId      int64
+	dataCenterId  int64
 	lastTimeStamp int64
 	sequence      int64
 	maxWorkerId   int64
+	layout        *SnowFlakeLayout
+	clockPolicy   ClockBackwardPolicy
+	borrowing     bool                  //回拨后借用逻辑时钟中, 真实时钟追上后结束
+	lease         *SnowFlakeWorkerLease //worker id 来自租约时 租约失效后拒绝生成
+	now           func() int64          //当前毫秒时间, 测试时可替换
 	lock          *sync.Mutex
 }
 
-// NewSnowFlakeIdWorker Func: Generate NewSnowFlakeIdWorker with Given workerid
+// NewSnowFlakeIdWorker Func: Generate NewSnowFlakeIdWorker with Given workerid, use the configured layout
 func NewSnowFlakeIdWorker(workerid int64) (iw *SnowFlakeIdWorker, err error) {
-	maxWorkerId := getMaxWorkerId()
+	application := GetApplication()
+
+	iw, err = NewSnowFlakeIdWorkerWithLayout(application.GetSnowFlakeLayout(), application.ConfigData.SnowFlake.DataCenterId, workerid)
+	if err != nil {
+		return nil, err
+	}
+
+	iw.SetClockBackwardPolicy(ClockBackwardPolicy{
+		MaxWaitMs:   application.ConfigData.SnowFlake.MaxWaitBackwardMs,
+		MaxBorrowMs: application.ConfigData.SnowFlake.MaxBorrowBackwardMs,
+	})
+
+	return iw, nil
+}
+
+// NewSnowFlakeIdWorkerWithLayout Func: Generate NewSnowFlakeIdWorker with Given layout, datacenter id and workerid
+func NewSnowFlakeIdWorkerWithLayout(layout *SnowFlakeLayout, dataCenterId int64, workerid int64) (iw *SnowFlakeIdWorker, err error) {
+	maxWorkerId := layout.MaxWorkerId()
 
 	if workerid > maxWorkerId || workerid < 0 {
 		return nil, errors.New("workerid 异常")
 	}
 
+	if dataCenterId > layout.MaxDataCenterId() || dataCenterId < 0 {
+		return nil, errors.New("datacenter id 异常")
+	}
+
 	logger.Printf("NewSnowFlakeIdWorker, max worker ID:%#v, current:%#v\n", maxWorkerId, workerid)
 
 	iw = new(SnowFlakeIdWorker)
 	iw.maxWorkerId = maxWorkerId
 	iw.workerId = workerid
+	iw.dataCenterId = dataCenterId
 	iw.lastTimeStamp = -1
 	iw.sequence = 0
+	iw.layout = layout
+	iw.now = currentTimeMillis
 	iw.lock = new(sync.Mutex)
 
 	return iw, nil
 }
 
-func getMaxWorkerId() int64 {
-	return -1 ^ -1<<CWorkerIdBits
+// SetClockBackwardPolicy Func: set how to deal with clock moving backwards
+func (iw *SnowFlakeIdWorker) SetClockBackwardPolicy(policy ClockBackwardPolicy) {
+	iw.lock.Lock()
+	defer iw.lock.Unlock()
+
+	iw.clockPolicy = policy
 }
 
-func getSequenceMask() int64 {
-	return -1 ^ -1<<CSenquenceBits
+func currentTimeMillis() int64 {
+	return time.Now().UnixNano() / 1000 / 1000
 }
 
 // return in ms
 func (iw *SnowFlakeIdWorker) timeGen() int64 {
-	return time.Now().UnixNano() / 1000 / 1000
+	return iw.now()
 }
 
+// wait until next ms
 func (iw *SnowFlakeIdWorker) timeReGen(last int64) int64 {
-	ts := time.Now().UnixNano()
+	ts := iw.timeGen()
 	for {
-		if ts < last {
+		if ts <= last {
+			time.Sleep(100 * time.Microsecond)
 			ts = iw.timeGen()
 		} else {
 			break
@@ -85,34 +123,107 @@ func (iw *SnowFlakeIdWorker) timeReGen(last int64) int64 {
 	return ts
 }
 
-// NewId Func: Generate next id
-func (iw *SnowFlakeIdWorker) NextId() (ts int64, err error) {
-	iw.lock.Lock()
-	defer iw.lock.Unlock()
+// nextSequence Func: move to the next available sequence, the caller must hold the lock
+// return the timestamp and the first unused sequence of it
+func (iw *SnowFlakeIdWorker) nextSequence() (ts int64, sequence int64, err error) {
+	if iw.lease != nil && !iw.lease.IsValid() {
+		return 0, 0, ErrWorkerLeaseLost
+	}
+
 	ts = iw.timeGen()
+
+	// borrow means using lastTimeStamp as a logical clock until the real clock catches up
+	var borrow bool
+
+	if ts < iw.lastTimeStamp {
+		ts, borrow, err = iw.handleClockBackwards(ts)
+		if err != nil {
+			return 0, 0, err
+		}
+	} else {
+		iw.borrowing = false
+	}
+
+	if err = iw.layout.CheckTimeStamp(ts); err != nil {
+		return 0, 0, err
+	}
+
 	if ts == iw.lastTimeStamp {
-		iw.sequence = (iw.sequence + 1) & CSequenceMask
-		if iw.sequence == 0 {
-			ts = iw.timeReGen(ts)
+		if iw.sequence >= iw.layout.SequenceMask() {
+			// sequence of current ms is exhausted
+			if borrow {
+				ts = ts + 1
+			} else {
+				ts = iw.timeReGen(ts)
+			}
+			sequence = 0
+		} else {
+			sequence = iw.sequence + 1
 		}
 	} else {
-		iw.sequence = 0
+		sequence = 0
 	}
 
-	if ts < iw.lastTimeStamp {
-		err = errors.New("Clock moved backwards, Refuse gen id")
+	iw.lastTimeStamp = ts
+	iw.sequence = sequence
+
+	return ts, sequence, nil
+}
+
+func (iw *SnowFlakeIdWorker) composeId(ts int64, sequence int64) int64 {
+	return iw.layout.Compose(ts, iw.dataCenterId, iw.workerId, sequence)
+}
+
+// NewId Func: Generate next id
+func (iw *SnowFlakeIdWorker) NextId() (ts int64, err error) {
+	iw.lock.Lock()
+	defer iw.lock.Unlock()
+
+	ts, sequence, err := iw.nextSequence()
+	if err != nil {
 		return 0, err
 	}
-	iw.lastTimeStamp = ts
-	ts = (ts-CEpoch)<<CTimeStampShift | iw.workerId<<CWorkerIdShift | iw.sequence
-	return ts, nil
+
+	return iw.composeId(ts, sequence), nil
+}
+
+// NextIds Func: Generate n ids, fill the whole sequence window of a ms at once
+// and wait for the next ms when the sequence rolls over
+func (iw *SnowFlakeIdWorker) NextIds(n int) ([]int64, error) {
+	if n < 1 || n > MAX_BATCH_COUNT {
+		return nil, errors.New("批量获取数量错误, 范围 1-" + strconv.Itoa(MAX_BATCH_COUNT))
+	}
+
+	iw.lock.Lock()
+	defer iw.lock.Unlock()
+
+	ids := make([]int64, 0, n)
+
+	for len(ids) < n {
+		ts, sequence, err := iw.nextSequence()
+		if err != nil {
+			return nil, err
+		}
+
+		// take as many as possible from current ms
+		for {
+			ids = append(ids, iw.composeId(ts, sequence))
+
+			if len(ids) >= n || sequence >= iw.layout.SequenceMask() {
+				break
+			}
+			sequence++
+		}
+
+		iw.sequence = sequence
+	}
+
+	return ids, nil
 }
 
-// ParseId Func: reverse uid to timestamp, workid, seq
+// ParseId Func: reverse uid to timestamp, workid, seq with the configured layout
 func ParseId(id int64) (t time.Time, ts int64, workerId int64, seq int64) {
-	seq = id & CSequenceMask
-	workerId = (id >> CWorkerIdShift) & CMaxWorker
-	ts = (id >> CTimeStampShift) + CEpoch
-	t = time.Unix(ts/1000, (ts%1000)*1000000)
-	return
+	info := GetApplication().GetSnowFlakeLayout().Parse(id)
+
+	return info.Time, info.TimeStamp, info.WorkerId, info.Sequence
 }
@@ -0,0 +1,104 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"idGenerator/model/logger"
+)
+
+// 时钟回拨的处理方式
+const (
+	CLOCK_BACKWARD_WAIT   = 1 //回拨较小, 等待时钟追上
+	CLOCK_BACKWARD_BORROW = 2 //回拨中等, 使用逻辑时钟继续生成
+	CLOCK_BACKWARD_REFUSE = 3 //回拨过大, 拒绝生成
+)
+
+// ClockBackwardPolicy Struct: 单位毫秒, 0 表示不容忍回拨
+type ClockBackwardPolicy struct {
+	MaxWaitMs   int64 //回拨不超过这个值时 等待时钟追上
+	MaxBorrowMs int64 //回拨不超过这个值时 借用逻辑时钟, 超过直接失败
+}
+
+// ClockBackwardStats Struct: 时钟回拨事件的统计
+type ClockBackwardStats struct {
+	Waited        int64 `json:"waited"`
+	Borrowed      int64 `json:"borrowed"`
+	Refused       int64 `json:"refused"`
+	MaxBackwardMs int64 `json:"maxBackwardMs"`
+}
+
+var clockBackwardStats ClockBackwardStats
+
+// GetClockBackwardStats Func: 获取所有 snowflake worker 的时钟回拨统计
+func GetClockBackwardStats() ClockBackwardStats {
+	return ClockBackwardStats{
+		Waited:        atomic.LoadInt64(&clockBackwardStats.Waited),
+		Borrowed:      atomic.LoadInt64(&clockBackwardStats.Borrowed),
+		Refused:       atomic.LoadInt64(&clockBackwardStats.Refused),
+		MaxBackwardMs: atomic.LoadInt64(&clockBackwardStats.MaxBackwardMs),
+	}
+}
+
+// 记录一次回拨事件
+func recordClockBackward(action int, backwardMs int64) {
+	switch action {
+	case CLOCK_BACKWARD_WAIT:
+		atomic.AddInt64(&clockBackwardStats.Waited, 1)
+	case CLOCK_BACKWARD_BORROW:
+		atomic.AddInt64(&clockBackwardStats.Borrowed, 1)
+	default:
+		atomic.AddInt64(&clockBackwardStats.Refused, 1)
+	}
+
+	recordMaxClockBackward(backwardMs)
+}
+
+// 记录回拨的最大值
+func recordMaxClockBackward(backwardMs int64) {
+	for {
+		oldMax := atomic.LoadInt64(&clockBackwardStats.MaxBackwardMs)
+		if backwardMs <= oldMax || atomic.CompareAndSwapInt64(&clockBackwardStats.MaxBackwardMs, oldMax, backwardMs) {
+			break
+		}
+	}
+}
+
+// 按照策略选择回拨的处理方式
+func (policy ClockBackwardPolicy) decide(backwardMs int64) int {
+	switch {
+	case backwardMs <= policy.MaxWaitMs:
+		return CLOCK_BACKWARD_WAIT
+	case backwardMs <= policy.MaxBorrowMs:
+		return CLOCK_BACKWARD_BORROW
+	default:
+		return CLOCK_BACKWARD_REFUSE
+	}
+}
+
+// handleClockBackwards Func: ts 小于 lastTimeStamp 时调用, the caller must hold the lock
+// 返回可以继续使用的时间戳, 以及是否在借用逻辑时钟
+func (iw *SnowFlakeIdWorker) handleClockBackwards(ts int64) (int64, bool, error) {
+	backwardMs := iw.lastTimeStamp - ts
+	action := iw.clockPolicy.decide(backwardMs)
+
+	// 借用期间真实时钟还没追上, 是同一次回拨, 继续借用, 只统计一次
+	if iw.borrowing && action != CLOCK_BACKWARD_REFUSE {
+		recordMaxClockBackward(backwardMs)
+		return iw.lastTimeStamp, true, nil
+	}
+
+	recordClockBackward(action, backwardMs)
+	logger.AsyncInfo(fmt.Sprintf("snowflake clock moved backwards %d ms, workerId:%d, action:%d", backwardMs, iw.workerId, action))
+
+	iw.borrowing = action == CLOCK_BACKWARD_BORROW
+
+	switch action {
+	case CLOCK_BACKWARD_WAIT:
+		return iw.timeReGen(iw.lastTimeStamp - 1), false, nil
+	case CLOCK_BACKWARD_BORROW:
+		return iw.lastTimeStamp, true, nil
+	default:
+		return 0, false, errors.New(fmt.Sprintf("Clock moved backwards %d ms, Refuse gen id", backwardMs))
+	}
+}
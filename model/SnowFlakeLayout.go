@@ -0,0 +1,164 @@
+// +-------------------+------------------+----------------+----------------+
+// | timestamp(ms)     | datacenter id    | worker id      | sequence       |
+// +-------------------+------------------+----------------+----------------+
+//
+// the bits of each part and the epoch can be set in config [snowFlake]
+
+// Copyright (C) 2017 by cclehui
+
+package model
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"idGenerator/model/config"
+)
+
+const (
+	CTimeStampBits  = 41 // Num of TimeStamp Bits of default layout
+	CDataCenterBits = 0  // Num of DataCenter Bits of default layout
+
+	CMaxTotalBits = 63 // the sign bit is not used
+)
+
+// SnowFlakeLayout Struct: bit layout of a snowflake id
+type SnowFlakeLayout struct {
+	Epoch          int64
+	TimeStampBits  uint
+	DataCenterBits uint
+	WorkerIdBits   uint
+	SequenceBits   uint
+
+	workerIdShift   uint
+	dataCenterShift uint
+	timeStampShift  uint
+
+	sequenceMask    int64
+	maxWorkerId     int64
+	maxDataCenterId int64
+	maxTimeStamp    int64
+}
+
+// SnowFlakeIdInfo Struct: every part of a parsed id
+type SnowFlakeIdInfo struct {
+	Id           int64
+	Time         time.Time
+	TimeStamp    int64
+	DataCenterId int64
+	WorkerId     int64
+	Sequence     int64
+}
+
+// DefaultSnowFlakeLayout Func: the layout used before it was configurable
+func DefaultSnowFlakeLayout() *SnowFlakeLayout {
+	layout, err := NewSnowFlakeLayout(CEpoch, CTimeStampBits, CDataCenterBits, CWorkerIdBits, CSenquenceBits)
+	CheckErr(err)
+
+	return layout
+}
+
+// NewSnowFlakeLayout Func: validate the bits and epoch, and compute shifts and masks
+func NewSnowFlakeLayout(epoch int64, timeStampBits uint, dataCenterBits uint,
+	workerIdBits uint, sequenceBits uint) (*SnowFlakeLayout, error) {
+
+	if timeStampBits < 1 || sequenceBits < 1 {
+		return nil, errors.New("snowflake 时间戳和序列号位数必须大于0")
+	}
+
+	totalBits := timeStampBits + dataCenterBits + workerIdBits + sequenceBits
+	if totalBits > CMaxTotalBits {
+		return nil, errors.New(fmt.Sprintf("snowflake 总位数 %d 超过 %d", totalBits, CMaxTotalBits))
+	}
+
+	now := time.Now().UnixNano() / 1000 / 1000
+	if epoch < 0 || epoch > now {
+		return nil, errors.New(fmt.Sprintf("snowflake epoch 异常: %d", epoch))
+	}
+
+	layout := &SnowFlakeLayout{
+		Epoch:          epoch,
+		TimeStampBits:  timeStampBits,
+		DataCenterBits: dataCenterBits,
+		WorkerIdBits:   workerIdBits,
+		SequenceBits:   sequenceBits,
+	}
+
+	layout.workerIdShift = sequenceBits
+	layout.dataCenterShift = sequenceBits + workerIdBits
+	layout.timeStampShift = sequenceBits + workerIdBits + dataCenterBits
+
+	layout.sequenceMask = -1 ^ -1<<sequenceBits
+	layout.maxWorkerId = -1 ^ -1<<workerIdBits
+	layout.maxDataCenterId = -1 ^ -1<<dataCenterBits
+	layout.maxTimeStamp = -1 ^ -1<<timeStampBits
+
+	if now-epoch > layout.maxTimeStamp {
+		return nil, errors.New("snowflake 时间戳位数不足, 当前时间已超出可表示范围")
+	}
+
+	return layout, nil
+}
+
+// NewSnowFlakeLayoutFromConfig Func: all bits empty means the default layout
+func NewSnowFlakeLayoutFromConfig(snowFlakeConfig config.SnowFlake) (*SnowFlakeLayout, error) {
+	if snowFlakeConfig.TimeStampBits == 0 && snowFlakeConfig.DataCenterBits == 0 &&
+		snowFlakeConfig.WorkerIdBits == 0 && snowFlakeConfig.SequenceBits == 0 {
+
+		if snowFlakeConfig.Epoch == 0 {
+			return DefaultSnowFlakeLayout(), nil
+		}
+
+		return NewSnowFlakeLayout(snowFlakeConfig.Epoch, CTimeStampBits, CDataCenterBits, CWorkerIdBits, CSenquenceBits)
+	}
+
+	epoch := snowFlakeConfig.Epoch
+	if epoch == 0 {
+		epoch = CEpoch
+	}
+
+	return NewSnowFlakeLayout(epoch, snowFlakeConfig.TimeStampBits, snowFlakeConfig.DataCenterBits,
+		snowFlakeConfig.WorkerIdBits, snowFlakeConfig.SequenceBits)
+}
+
+func (layout *SnowFlakeLayout) MaxWorkerId() int64 {
+	return layout.maxWorkerId
+}
+
+func (layout *SnowFlakeLayout) MaxDataCenterId() int64 {
+	return layout.maxDataCenterId
+}
+
+func (layout *SnowFlakeLayout) SequenceMask() int64 {
+	return layout.sequenceMask
+}
+
+// Compose Func: ts is the unix time in ms
+func (layout *SnowFlakeLayout) Compose(ts int64, dataCenterId int64, workerId int64, sequence int64) int64 {
+	return (ts-layout.Epoch)<<layout.timeStampShift |
+		dataCenterId<<layout.dataCenterShift |
+		workerId<<layout.workerIdShift |
+		sequence
+}
+
+// CheckTimeStamp Func: ts must be inside the lifetime of the layout
+func (layout *SnowFlakeLayout) CheckTimeStamp(ts int64) error {
+	if ts < layout.Epoch || ts-layout.Epoch > layout.maxTimeStamp {
+		return errors.New("timestamp out of snowflake layout range, Refuse gen id")
+	}
+
+	return nil
+}
+
+// Parse Func: reverse id to timestamp, datacenter id, worker id, seq
+func (layout *SnowFlakeLayout) Parse(id int64) *SnowFlakeIdInfo {
+	info := &SnowFlakeIdInfo{Id: id}
+
+	info.Sequence = id & layout.sequenceMask
+	info.WorkerId = (id >> layout.workerIdShift) & layout.maxWorkerId
+	info.DataCenterId = (id >> layout.dataCenterShift) & layout.maxDataCenterId
+	info.TimeStamp = (id >> layout.timeStampShift) + layout.Epoch
+	info.Time = time.Unix(info.TimeStamp/1000, (info.TimeStamp%1000)*1000000)
+
+	return info
+}
@@ -0,0 +1,101 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewSnowFlakeLayoutValidate(t *testing.T) {
+	now := time.Now().UnixNano() / 1000 / 1000
+
+	cases := []struct {
+		name           string
+		epoch          int64
+		timeStampBits  uint
+		dataCenterBits uint
+		workerIdBits   uint
+		sequenceBits   uint
+		ok             bool
+	}{
+		{"default", CEpoch, 41, 0, 10, 12, true},
+		{"datacenter", CEpoch, 41, 3, 5, 12, true},
+		{"all 63 bits", CEpoch, 41, 5, 5, 12, true},
+		{"over 63 bits", CEpoch, 42, 5, 5, 12, false},
+		{"no timestamp bits", CEpoch, 0, 0, 10, 12, false},
+		{"no sequence bits", CEpoch, 41, 0, 10, 0, false},
+		{"negative epoch", -1, 41, 0, 10, 12, false},
+		{"epoch in future", now + 60000, 41, 0, 10, 12, false},
+		//30 位时间戳只能表示约12天, 已经溢出
+		{"timestamp overflow", CEpoch, 30, 0, 10, 12, false},
+		{"recent epoch with short timestamp", now - 1000, 30, 0, 10, 12, true},
+	}
+
+	for _, c := range cases {
+		layout, err := NewSnowFlakeLayout(c.epoch, c.timeStampBits, c.dataCenterBits, c.workerIdBits, c.sequenceBits)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: layout: %+v, err: %v", c.name, layout, err)
+		}
+	}
+}
+
+func TestSnowFlakeLayoutComposeParse(t *testing.T) {
+	now := time.Now().UnixNano() / 1000 / 1000
+
+	cases := []struct {
+		name           string
+		timeStampBits  uint
+		dataCenterBits uint
+		workerIdBits   uint
+		sequenceBits   uint
+	}{
+		{"default", 41, 0, 10, 12},
+		{"datacenter", 41, 5, 5, 12},
+		{"small sequence", 41, 3, 14, 5},
+		{"no worker bits", 41, 0, 0, 22},
+		{"short timestamp", 36, 2, 8, 8},
+	}
+
+	for _, c := range cases {
+		epoch := int64(CEpoch)
+		if c.timeStampBits < 41 {
+			epoch = now - 1000*3600
+		}
+
+		layout, err := NewSnowFlakeLayout(epoch, c.timeStampBits, c.dataCenterBits, c.workerIdBits, c.sequenceBits)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		if layout.MaxWorkerId() != int64(1)<<c.workerIdBits-1 || layout.MaxDataCenterId() != int64(1)<<c.dataCenterBits-1 ||
+			layout.SequenceMask() != int64(1)<<c.sequenceBits-1 {
+			t.Errorf("%s: masks: %+v", c.name, layout)
+		}
+
+		//每一部分都取最大值 和 0, 解析后不能互相影响
+		for _, part := range []struct{ dataCenterId, workerId, sequence int64 }{
+			{layout.MaxDataCenterId(), layout.MaxWorkerId(), layout.SequenceMask()},
+			{0, 0, 0},
+			{layout.MaxDataCenterId(), 0, layout.SequenceMask()},
+			{0, layout.MaxWorkerId(), 0},
+		} {
+			id := layout.Compose(now, part.dataCenterId, part.workerId, part.sequence)
+			if id < 0 {
+				t.Fatalf("%s: negative id %d", c.name, id)
+			}
+
+			info := layout.Parse(id)
+			if info.TimeStamp != now || info.DataCenterId != part.dataCenterId || info.WorkerId != part.workerId ||
+				info.Sequence != part.sequence || info.Time.UnixNano()/1000/1000 != now {
+				t.Errorf("%s: compose %+v, parsed %+v", c.name, part, info)
+			}
+		}
+
+		if err := layout.CheckTimeStamp(now); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+
+		if err := layout.CheckTimeStamp(epoch - 1); err == nil {
+			t.Errorf("%s: timestamp before epoch accepted", c.name)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+	"idGenerator/model/logger"
+)
+
+const (
+	WORKER_LEASE_BUCKET_NAME = "SnowFlakeWorkerLease" //boltdb 中保存worker id 租约的bucket
+	WORKER_LEASE_TABLE_NAME  = "idGeneratorWorkerLease" //mysql 中保存worker id 租约的表
+
+	DEFAULT_WORKER_LEASE_TTL = 30 //默认租约时长 单位秒
+)
+
+var ErrWorkerLeaseLost = errors.New("snowflake worker id 租约已丢失")
+var ErrNoFreeWorkerId = errors.New("没有可用的 snowflake worker id")
+
+//worker id 租约的持久化, boltdb, mysql, rpc 都实现了
+type WorkerLeaseStore interface {
+	AcquireWorkerLease(owner string, maxWorkerId int64, ttl int) (int64, error)
+	RenewWorkerLease(owner string, workerId int64, ttl int) error
+	ReleaseWorkerLease(owner string, workerId int64) error
+}
+
+//持久化的租约记录
+type workerLeaseRecord struct {
+	Owner    string `json:"owner"`
+	ExpireAt int64  `json:"expireAt"` //过期时间戳 单位秒
+}
+
+//当前实例持有的worker id 租约
+type SnowFlakeWorkerLease struct {
+	Store    WorkerLeaseStore
+	Owner    string
+	WorkerId int64
+	Ttl      int
+
+	expireAt int64 //本地记录的过期时间戳 单位秒
+	lost     int32
+	released int32
+	stopChan chan bool
+}
+
+func NewSnowFlakeWorkerLease(store WorkerLeaseStore, ttl int) *SnowFlakeWorkerLease {
+	if ttl < 3 {
+		ttl = DEFAULT_WORKER_LEASE_TTL
+	}
+
+	hostName, _ := os.Hostname()
+
+	return &SnowFlakeWorkerLease{
+		Store:    store,
+		Owner:    fmt.Sprintf("%s-%d-%d", hostName, os.Getpid(), time.Now().UnixNano()),
+		WorkerId: -1,
+		Ttl:      ttl,
+		stopChan: make(chan bool),
+	}
+}
+
+//申请租约, 并开始心跳续约
+func (lease *SnowFlakeWorkerLease) Start(maxWorkerId int64) error {
+	start := time.Now().Unix()
+
+	workerId, err := lease.Store.AcquireWorkerLease(lease.Owner, maxWorkerId, lease.Ttl)
+	if err != nil {
+		return err
+	}
+
+	lease.WorkerId = workerId
+	atomic.StoreInt64(&lease.expireAt, start+int64(lease.Ttl))
+
+	logger.AsyncInfo(fmt.Sprintf("snowflake worker id 租约获取成功, owner:%s, workerId:%d", lease.Owner, workerId))
+
+	go lease.heartbeat()
+
+	return nil
+}
+
+//心跳续约, 续约间隔为租约时长的 1/3
+func (lease *SnowFlakeWorkerLease) heartbeat() {
+	interval := time.Duration(lease.Ttl) * time.Second / 3
+
+	for {
+		select {
+		case <-lease.stopChan:
+			return
+		case <-time.After(interval):
+		}
+
+		start := time.Now().Unix()
+
+		err := lease.Store.RenewWorkerLease(lease.Owner, lease.WorkerId, lease.Ttl)
+		if err == nil {
+			atomic.StoreInt64(&lease.expireAt, start+int64(lease.Ttl))
+			continue
+		}
+
+		logger.AsyncInfo(fmt.Sprintf("snowflake worker id 续约失败, workerId:%d, err:%#v", lease.WorkerId, err.Error()))
+
+		if isWorkerLeaseLost(err) {
+			atomic.StoreInt32(&lease.lost, 1)
+			return
+		}
+	}
+}
+
+//租约是否有效, 已丢失或本地时间已过期都是无效的
+func (lease *SnowFlakeWorkerLease) IsValid() bool {
+	if atomic.LoadInt32(&lease.lost) == 1 {
+		return false
+	}
+
+	return time.Now().Unix() < atomic.LoadInt64(&lease.expireAt)
+}
+
+//释放租约, 停止心跳
+func (lease *SnowFlakeWorkerLease) Release() error {
+	if lease.WorkerId < 0 || !atomic.CompareAndSwapInt32(&lease.released, 0, 1) {
+		return nil
+	}
+
+	close(lease.stopChan)
+	atomic.StoreInt32(&lease.lost, 1)
+
+	err := lease.Store.ReleaseWorkerLease(lease.Owner, lease.WorkerId)
+	logger.AsyncInfo(fmt.Sprintf("snowflake worker id 租约释放, workerId:%d, err:%#v", lease.WorkerId, err))
+
+	return err
+}
+
+//rpc 返回的错误只保留了字符串
+func isWorkerLeaseLost(err error) bool {
+	return err != nil && err.Error() == ErrWorkerLeaseLost.Error()
+}
@@ -0,0 +1,229 @@
+package model
+
+import (
+	"sync"
+	"testing"
+)
+
+//可控的时钟, 每次读取后前进 step 毫秒
+type fakeSnowFlakeClock struct {
+	lock  sync.Mutex
+	ts    int64
+	step  int64
+	calls int
+}
+
+func (clock *fakeSnowFlakeClock) now() int64 {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	clock.calls++
+	ts := clock.ts
+	clock.ts += clock.step
+
+	return ts
+}
+
+func (clock *fakeSnowFlakeClock) set(ts int64, step int64) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	clock.ts, clock.step, clock.calls = ts, step, 0
+}
+
+func newTestSnowFlakeWorker(t *testing.T, policy ClockBackwardPolicy) (*SnowFlakeIdWorker, *fakeSnowFlakeClock) {
+	iw, err := NewSnowFlakeIdWorkerWithLayout(DefaultSnowFlakeLayout(), 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := &fakeSnowFlakeClock{ts: CEpoch + 1000*1000}
+	iw.now = clock.now
+	iw.SetClockBackwardPolicy(policy)
+
+	return iw, clock
+}
+
+func TestSnowFlakeClockBackwardPolicy(t *testing.T) {
+	policy := ClockBackwardPolicy{MaxWaitMs: 5, MaxBorrowMs: 100}
+	base := int64(CEpoch + 1000*1000)
+
+	cases := []struct {
+		name       string
+		backwardMs int64
+		action     int
+	}{
+		{"wait", 3, CLOCK_BACKWARD_WAIT},
+		{"wait limit", 5, CLOCK_BACKWARD_WAIT},
+		{"borrow", 50, CLOCK_BACKWARD_BORROW},
+		{"borrow limit", 100, CLOCK_BACKWARD_BORROW},
+		{"refuse", 101, CLOCK_BACKWARD_REFUSE},
+	}
+
+	for _, c := range cases {
+		iw, clock := newTestSnowFlakeWorker(t, policy)
+
+		first, err := iw.NextId()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		before := GetClockBackwardStats()
+
+		//回拨后 等待时每次读取前进1毫秒, 其他情况时钟不动
+		step := int64(0)
+		if c.action == CLOCK_BACKWARD_WAIT {
+			step = 1
+		}
+		clock.set(base-c.backwardMs, step)
+
+		id, err := iw.NextId()
+		after := GetClockBackwardStats()
+		info := iw.layout.Parse(id)
+
+		switch c.action {
+		case CLOCK_BACKWARD_WAIT:
+			//等到时钟追上 lastTimeStamp 才生成
+			if err != nil || info.TimeStamp != base || info.Sequence != 1 || id <= first {
+				t.Errorf("%s: id: %d, info: %+v, err: %v", c.name, id, info, err)
+			}
+			if clock.calls != int(c.backwardMs)+1 {
+				t.Errorf("%s: clock read %d times", c.name, clock.calls)
+			}
+			if after.Waited-before.Waited != 1 {
+				t.Errorf("%s: stats %+v -> %+v", c.name, before, after)
+			}
+		case CLOCK_BACKWARD_BORROW:
+			//继续使用 lastTimeStamp, 不等待
+			if err != nil || info.TimeStamp != base || info.Sequence != 1 || id <= first || clock.calls != 1 {
+				t.Errorf("%s: id: %d, info: %+v, calls: %d, err: %v", c.name, id, info, clock.calls, err)
+			}
+			if after.Borrowed-before.Borrowed != 1 {
+				t.Errorf("%s: stats %+v -> %+v", c.name, before, after)
+			}
+		default:
+			if err == nil {
+				t.Errorf("%s: id %d generated", c.name, id)
+			}
+			if after.Refused-before.Refused != 1 {
+				t.Errorf("%s: stats %+v -> %+v", c.name, before, after)
+			}
+		}
+
+		if after.MaxBackwardMs < c.backwardMs {
+			t.Errorf("%s: max backward %d", c.name, after.MaxBackwardMs)
+		}
+	}
+}
+
+//批量获取时 一毫秒的序号用完后等到下一毫秒再继续
+func TestSnowFlakeNextIdsWaitsNextMs(t *testing.T) {
+	iw, _ := newTestSnowFlakeWorker(t, ClockBackwardPolicy{})
+	base := int64(CEpoch + 1000*1000)
+
+	//前3次读取停在 base, 之后进入下一毫秒
+	reads := 0
+	iw.now = func() int64 {
+		reads++
+		if reads <= 3 {
+			return base
+		}
+
+		return base + 1
+	}
+
+	sequenceCount := int(iw.layout.SequenceMask()) + 1
+
+	ids, err := iw.NextIds(sequenceCount + 10)
+	if err != nil || len(ids) != sequenceCount+10 {
+		t.Fatalf("ids: %d, err: %v", len(ids), err)
+	}
+
+	for i, id := range ids {
+		info := iw.layout.Parse(id)
+
+		ts, sequence := base, int64(i)
+		if i >= sequenceCount {
+			ts, sequence = base+1, int64(i-sequenceCount)
+		}
+
+		if info.TimeStamp != ts || info.Sequence != sequence || info.WorkerId != 1 || (i > 0 && id <= ids[i-1]) {
+			t.Fatalf("id at %d: %+v", i, info)
+		}
+	}
+
+	//序号用完后 重新读取时钟直到进入下一毫秒
+	if reads != 4 {
+		t.Errorf("clock read %d times", reads)
+	}
+}
+
+func TestSnowFlakeBorrowSequenceRollover(t *testing.T) {
+	iw, clock := newTestSnowFlakeWorker(t, ClockBackwardPolicy{MaxBorrowMs: 100})
+	base := clock.ts
+
+	if _, err := iw.NextId(); err != nil {
+		t.Fatal(err)
+	}
+
+	//借用逻辑时钟时 序号用完直接进入下一毫秒, 不等待真实时钟
+	clock.set(base-10, 0)
+
+	ids, err := iw.NextIds(int(iw.layout.SequenceMask()) + 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[int64]bool, len(ids))
+	for i, id := range ids {
+		if seen[id] || (i > 0 && id <= ids[i-1]) {
+			t.Fatalf("id %d at %d not increasing", id, i)
+		}
+		seen[id] = true
+	}
+
+	if last := iw.layout.Parse(ids[len(ids)-1]); last.TimeStamp != base+1 {
+		t.Errorf("last: %+v", last)
+	}
+}
+
+//借用逻辑时钟期间 同一次回拨只统计一次, 时钟追上后再次回拨是新的一次
+func TestSnowFlakeBorrowCountedOncePerBackward(t *testing.T) {
+	iw, clock := newTestSnowFlakeWorker(t, ClockBackwardPolicy{MaxWaitMs: 5, MaxBorrowMs: 100})
+	base := clock.ts
+
+	if _, err := iw.NextId(); err != nil {
+		t.Fatal(err)
+	}
+
+	before := GetClockBackwardStats()
+
+	//回拨50毫秒, 每次读取前进1毫秒, 追上之前的回拨小于 MaxWaitMs 时也继续借用
+	clock.set(base-50, 1)
+	for i := 0; i < 49; i++ {
+		if _, err := iw.NextId(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if after := GetClockBackwardStats(); after.Borrowed-before.Borrowed != 1 || after.Waited != before.Waited {
+		t.Fatalf("one backward: %+v -> %+v", before, after)
+	}
+
+	//时钟追上后 再次回拨
+	clock.set(base+100, 0)
+	if _, err := iw.NextId(); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.set(base+50, 0)
+	for i := 0; i < 10; i++ {
+		if _, err := iw.NextId(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if after := GetClockBackwardStats(); after.Borrowed-before.Borrowed != 2 {
+		t.Fatalf("two backwards: %+v -> %+v", before, after)
+	}
+}
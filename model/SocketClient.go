@@ -1,12 +1,13 @@
 package model
 
 import (
+	"errors"
 	"net"
 	"time"
 	"idGenerator/model/logger"
 	"fmt"
 	"sync"
-	"os"
+	"sync/atomic"
 	"encoding/json"
 	"net/rpc"
 	"bufio"
@@ -20,6 +21,9 @@ type Client struct {
 	Context *Context
 	MasterAddress string
 	RpcClient *rpc.Client
+	LastReceivedTs int64 //最近一次收到master 数据的时间戳, 判断master 是否已宕机
+	stopped bool //提升为master 后停止, 不再重连
+	stopLock sync.Mutex //停止 和 写入同步数据 互斥
 }
 
 //var client *Client
@@ -40,6 +44,7 @@ func NewClient(masterAddress string) *Client {
 	client := &Client{
 		Context:context,
 		MasterAddress:masterAddress,
+		LastReceivedTs:now,
 		}
 
 	return client
@@ -64,6 +69,10 @@ func (client *Client) StartRpcClient() {
 
 		}()
 		<- channelRedo
+		if client.isStopped() {
+			return
+		}
+
 		time.Sleep(2 * time.Second)
 	}
 
@@ -74,7 +83,7 @@ func (client *Client) doRpcClientKeepAlive() {
 	count :=0;
 	response := 0;
 
-	for {
+	for !client.isStopped() {
 		err := rpcClient.Call("BoltDbRpcService.KeepAlive", count, &response)
 		if err != nil {
 			logger.AsyncInfo(fmt.Sprintf("rpc error:%#v", err))
@@ -144,6 +153,11 @@ func (client *Client) StartClientBackUp()  {
 
 		}()
 		<- channelRedo
+		if client.isStopped() {
+			logger.AsyncInfo("主从同步已停止")
+			return
+		}
+
 		time.Sleep(2 * time.Second)
 	}
 }
@@ -173,54 +187,54 @@ func (client *Client) doDatabaseBackup() {
 
 	syncDataMsgChan <- true
 
-	//读数据
-	var backupDataFile *os.File = nil
-	var err error
-	var totalSize int64 = 0
+	//读数据, 全量数据先写临时文件, 连接中断时不会损坏已有的数据文件
+	receiver := newSnapshotReceiver(GetApplication().ConfigData.Bolt.FilePath)
+	defer receiver.abort()
+
 	count := 0
+	applied := false //本次同步应用了日志 或 全量数据
 	for {
 		count++
 
 		dataPackage := GetDecodedPackageData(client.Context.getReader(), client.Context.Connection)
+		atomic.StoreInt64(&client.LastReceivedTs, time.Now().Unix())
 		//logger.AsyncInfo(fmt.Sprintf("开始解包: count:%d, action: %#v, length:%d", count, dataPackage.ActionType, dataPackage.DataLength))
 
 		switch dataPackage.ActionType {
 		case ACTION_PING:
 			//logger.AsyncInfo("心跳包返回")
 		case ACTION_SYNC_DATA:
-			// 重复写入一个文件 xxxxxxxxxxxxxx  cclehui_todo
-
-			backupDataFile, err = os.OpenFile(GetApplication().ConfigData.Bolt.FilePath, os.O_WRONLY|os.O_CREATE, 0644)
-			checkErr(err)
-
-			err = backupDataFile.Truncate(0)
-			checkErr(err)
-
-			n, err := backupDataFile.Write(dataPackage.Data)
-			checkErr(err)
-			//backupDataFile.Close()
-
-			//重新以append 方式打开文件
-			//backupDataFile, err = os.OpenFile(GetApplication().ConfigData.Bolt.FilePath, os.O_WRONLY|os.O_APPEND, 0644)
-			//defer backupDataFile.Close()
-			//checkErr(err)
-
-			totalSize = int64(n)
+			checkErr(receiver.begin())
+			checkErr(receiver.write(dataPackage.Data))
 
 		case ACTION_CHUNK_DATA:
-			if backupDataFile != nil {
-				n, err := backupDataFile.Write(dataPackage.Data)
-				checkErr(err)
-
-				totalSize += int64(n)
+			if receiver.receiving() {
+				checkErr(receiver.write(dataPackage.Data))
 			}
+		case ACTION_LOG_ENTRIES:
+			batch := new(ReplicationLogBatch)
+			checkErr(json.Unmarshal(dataPackage.Data, batch))
+
+			//应用失败时 下次同步请求会从已应用的序号重新开始
+			if err := client.applyReplicationLog(batch); err != nil {
+				logger.AsyncInfo(fmt.Sprintf("应用同步日志异常: %#v", err))
+			} else if len(batch.Entries) > 0 {
+				applied = true
+			}
+
 		case ACTION_CHUNK_END:
-			if backupDataFile != nil {
-				logger.AsyncInfo(fmt.Sprintf("同步完成， 共同步数据 : %d bytes", totalSize))
-				backupDataFile.Close()
-				totalSize = 0
+			if receiver.receiving() {
+				//校验失败时丢弃, 下次同步重新全量
+				totalSize, err := client.installSnapshot(receiver, dataPackage.Data)
+				if err != nil {
+					logger.AsyncInfo(fmt.Sprintf("全量同步失败: %v", err))
+				} else {
+					logger.AsyncInfo(fmt.Sprintf("同步完成， 共同步数据 : %d bytes", totalSize))
+					applied = true
+				}
 			}
-			syncDataMsgChan <- true //启动重新同步
+			syncDataMsgChan <- !applied //启动重新同步
+			applied = false
 
 		default:
 			logger.AsyncInfo(fmt.Sprintf("未识别的包, %#v", dataPackage))
@@ -232,6 +246,10 @@ func (client *Client) doDatabaseBackup() {
 
 //重连master
 func (client *Client) reConnect() {
+	if client.isStopped() {
+		panic("连接已停止, 不再重连")
+	}
+
 	_, err := net.ResolveTCPAddr("tcp", client.MasterAddress)
 	CheckErr(err)
 
@@ -252,18 +270,20 @@ func (client *Client) sendSyncDatabaseRequest(msgChan chan bool) {
 		logger.AsyncInfo(fmt.Sprintf("sendSyncDatabaseRequest error : %#v",err))
 	}()
 
-	for {
-		<- msgChan  //等待同步消息启动
-		time.Sleep(2 * time.Second)
+	requestedAt := time.Now()
 
-		data := make(map[string]string)
-		data["md5"] = CaculteFileMd5(GetApplication().ConfigData.Bolt.FilePath)
-		data["ts"] = time.Now().Format(TIME_FORMAT)
+	for {
+		//等待同步消息启动, 刚应用了数据时立即请求, master 据此确认 slave 的进度
+		//master 会等待新的日志再回复, 已等待过的时间不再重复等待; 旧版本的master 立即回复
+		if wait := <- msgChan; wait {
+			time.Sleep(replicationSyncInterval() - time.Since(requestedAt))
+		}
+		requestedAt = time.Now()
 
-		encodedData, _ := json.Marshal(data)
+		encodedData, _ := json.Marshal(client.syncRequest())
 
-		//获取数据的请求包
-		requestDataPackage := NewBackupPackage(ACTION_SYNC_DATA)
+		//获取已应用序号之后的同步日志
+		requestDataPackage := NewBackupPackage(ACTION_SYNC_LOG)
 		//requestDataPackage.encodeData(intToBytes(int(time.Now().Unix())))
 		requestDataPackage.encodeData(encodedData)
 
@@ -273,6 +293,64 @@ func (client *Client) sendSyncDatabaseRequest(msgChan chan bool) {
 	}
 }
 
+//slave 已应用的同步日志, 数据文件无法打开时返回空, master 会回复全量数据
+func (client *Client) syncRequest() (request *ReplicationSyncRequest) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.AsyncInfo(fmt.Sprintf("读取同步状态异常, 请求全量同步: %#v", err))
+			request = &ReplicationSyncRequest{SlaveId: replicationSlaveId()}
+		}
+	}()
+
+	boltDb, errGetBolt := GetApplication().GetBoltDB()
+	CheckErr(errGetBolt)
+
+	request, err := ReplicationState(boltDb)
+	CheckErr(err)
+
+	request.SlaveId = replicationSlaveId()
+	request.WaitMs = int(replicationSyncInterval() / time.Millisecond)
+
+	return request
+}
+
+//校验并替换数据文件, 停止后不再替换
+func (client *Client) installSnapshot(receiver *snapshotReceiver, checksumData []byte) (int64, error) {
+	client.stopLock.Lock()
+	defer client.stopLock.Unlock()
+
+	if client.stopped {
+		return 0, errors.New("主从同步已停止")
+	}
+
+	return receiver.finish(checksumData)
+}
+
+func (client *Client) applyReplicationLog(batch *ReplicationLogBatch) (err error) {
+	defer func() {
+		if errRecovered := recover(); errRecovered != nil {
+			err = errors.New(fmt.Sprintf("%v", errRecovered))
+		}
+	}()
+
+	//停止后不再写入master 的数据
+	client.stopLock.Lock()
+	defer client.stopLock.Unlock()
+
+	if client.stopped {
+		return errors.New("主从同步已停止")
+	}
+
+	boltDb, errGetBolt := GetApplication().GetBoltDB()
+	CheckErr(errGetBolt)
+
+	if err = ApplyReplicationLog(boltDb, batch); err == nil && len(batch.Entries) > 0 {
+		logger.AsyncInfo(fmt.Sprintf("应用同步日志, seq: %d - %d", batch.Entries[0].Seq, batch.Entries[len(batch.Entries)-1].Seq))
+	}
+
+	return err
+}
+
 //发送心跳包
 func (client *Client) sendHeartBeat() {
 	defer func() {
@@ -291,4 +369,24 @@ func (client *Client) sendHeartBeat() {
 
 		time.Sleep(5 * time.Second)
 	}
-}
\ No newline at end of file
+}
+
+//停止同步并关闭连接, 正在写入的同步数据完成后返回
+func (client *Client) Stop() {
+	client.stopLock.Lock()
+	defer client.stopLock.Unlock()
+
+	client.stopped = true
+	client.Context.Connection.Close()
+}
+
+func (client *Client) isStopped() bool {
+	client.stopLock.Lock()
+	defer client.stopLock.Unlock()
+
+	return client.stopped
+}
+
+func (client *Client) getLastReceivedTs() int64 {
+	return atomic.LoadInt64(&client.LastReceivedTs)
+}
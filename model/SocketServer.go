@@ -16,9 +16,10 @@ import (
 	"os"
 	"path"
 	"encoding/json"
-	"strings"
 	"net/rpc"
 	"encoding/gob"
+	"crypto/md5"
+	"github.com/boltdb/bolt"
 )
 
 //var	contextList *list.List
@@ -205,6 +206,7 @@ func (masterServer *MasterServer) doConnectionAliveCheck() {
 func (masterServer *MasterServer) handleDataBackupConnection(context *Context) {
 	defer func() {
 		context.Connection.Close()
+		GetSlaveRegistry().disconnect(context)
 		masterServer.WaitGroup.Done() //子goroutine 退出
 
 		err := recover()
@@ -235,6 +237,7 @@ func (masterServer *MasterServer) handleAction(context *Context, dataPacakge *Ba
 	//logger.AsyncInfo("开始处理请求" + fmt.Sprintf("dataPacakge:%#v", dataPacakge))
 
 	var sendChunkEnd bool = false
+	var checksum *SnapshotChecksum = nil //全量同步的校验值
 
 	switch dataPacakge.ActionType {
 	case ACTION_PING:
@@ -247,94 +250,93 @@ func (masterServer *MasterServer) handleAction(context *Context, dataPacakge *Ba
 
 	case ACTION_SYNC_DATA:
 
-		var slaveFileInfo map[string]string
-		json.Unmarshal(dataPacakge.Data, &slaveFileInfo)
+		//slave 的数据对应的master 事务id 和当前已提交的事务id 相同时 数据无修改
+		request := new(ReplicationSyncRequest)
+		json.Unmarshal(dataPacakge.Data, request)
 
-		caculatedMd5 := CaculteFileMd5(GetApplication().ConfigData.Bolt.FilePath)
-
-		if strings.Compare(slaveFileInfo["md5"],caculatedMd5) == 0 {
-			logger.AsyncInfo("数据无修改，无需备份\t" + time.Now().Format(TIME_FORMAT) )
+		if masterServer.isFenced(request) {
 			sendChunkEnd = true
 			break
 		}
 
-		logger.AsyncInfo("开始备份数据\t" + time.Now().Format(TIME_FORMAT) )
-		//logger.AsyncInfo(slaveFileInfo)
-		//logger.AsyncInfo("master md5值:\t" + caculatedMd5)
+		GetSlaveRegistry().ack(context, request)
 
-		// start 复制临时文件
-		srcFile, err := os.Open(GetApplication().ConfigData.Bolt.FilePath)
-		defer srcFile.Close()
-		checkErr(err)
-		destFilePath := path.Join(path.Dir(GetApplication().ConfigData.Bolt.FilePath), fmt.Sprintf("%d_%s_%s", os.Getpid(), MyMd5(context.Connection.RemoteAddr()), time.Now().Format("2006010215")))
-		logger.AsyncInfo("临时文件路径:" + destFilePath)
-		destFile, err := os.OpenFile(destFilePath, os.O_WRONLY|os.O_CREATE, 0644)
-		defer os.Remove(destFilePath) //同步完成删除临时文件
+		boltDb, errGetBolt := GetApplication().GetBoltDB()
+		CheckErr(errGetBolt)
 
-		_, err = io.Copy(destFile, srcFile)
+		txId, err := CurrentTxId(boltDb)
 		checkErr(err)
-		destFile.Close()
 
-		//end 复制临时文件
+		if request.TxId > 0 && request.TxId == txId {
+			logger.AsyncInfo("数据无修改，无需备份\t" + time.Now().Format(TIME_FORMAT) )
+			sendChunkEnd = true
+			break
+		}
 
-		destFile, err = os.Open(destFilePath)
-		defer destFile.Close()
-		checkErr(err)
+		checksum = masterServer.sendDataFile(context)
+		sendChunkEnd = true
+		break
 
-		buffer := make([]byte, 1024)
-		var isChunk bool = false
-		var totalBytes int64 = 0;
+	case ACTION_SYNC_LOG:
+		request := new(ReplicationSyncRequest)
+		checkErr(json.Unmarshal(dataPacakge.Data, request))
 
-		//for i:=1;i < 3;i++ {
-		//	dataPackage := NewBackupPackage(ACTION_SYNC_DATA)
-		//	dataPackage.encodeData([]byte(strconv.Itoa(i)))
-		//	_, err = context.writePackage(dataPackage)
-		//	checkErr(err)
-		//}
+		if masterServer.isFenced(request) {
+			sendChunkEnd = true
+			break
+		}
 
-		for {
-			n, err := destFile.Read(buffer)
-			if n <= 0 || (err != nil  && err != io.EOF) {
-				if err != io.EOF {
-					logger.AsyncInfo(fmt.Sprintf("读文件内容异常, %d,  %#v", n, err))
-				}
+		//请求中的序号为slave 已应用的日志, 作为确认
+		GetSlaveRegistry().ack(context, request)
 
-				sendChunkEnd = true
+		boltDb, errGetBolt := GetApplication().GetBoltDB()
+		CheckErr(errGetBolt)
 
+		//已是最新时 等待新的日志追加, 追加后立即推送, 半同步的确认不依赖 slave 的请求间隔
+		waitMs := request.WaitMs
+		if waitMs > REPLICATION_MAX_WAIT_MS {
+			waitMs = REPLICATION_MAX_WAIT_MS
+		}
 
+		batch, err := WaitReplicationLog(boltDb, request.LogId, request.Seq, REPLICATION_LOG_BATCH_SIZE, time.Duration(waitMs)*time.Millisecond)
+		if err == ErrReplicationSnapshotRequired {
+			logger.AsyncInfo(fmt.Sprintf("slave 需要全量同步, logId: %s, seq: %d", request.LogId, request.Seq))
+			checksum = masterServer.sendDataFile(context)
+			sendChunkEnd = true
+			break
+		}
+		checkErr(err)
 
-				break
-			}
+		//有新的日志时发送, 已是最新时只发送结束包
+		if len(batch.Entries) > 0 {
+			encodedBatch, err := json.Marshal(batch)
+			checkErr(err)
 
-			var dataPackage *BackupPackage
+			dataPackage := NewBackupPackage(ACTION_LOG_ENTRIES)
+			dataPackage.encodeData(encodedBatch)
+			_, err = context.writePackage(dataPackage)
+			checkErr(err)
 
-			if isChunk {
-				dataPackage = NewBackupPackage(ACTION_CHUNK_DATA)
-				//dataPackage = NewBackupPackage(ACTION_SYNC_DATA)
-			} else {
-				dataPackage = NewBackupPackage(ACTION_SYNC_DATA)
-				isChunk = true
-			}
+			logger.AsyncInfo(fmt.Sprintf("同步日志, seq: %d - %d", batch.Entries[0].Seq, batch.Entries[len(batch.Entries)-1].Seq))
+		}
 
-			dataPackage.encodeData(buffer[0:n])
-			logger.AsyncInfo(fmt.Sprintf("同步包, action:%#v, length:%d", dataPackage.ActionType, dataPackage.DataLength))
-			//logger.AsyncInfo(fmt.Sprintf("同步包, %#v", dataPackage))
-			//if dataPackage.ActionType == ACTION_SYNC_DATA {
-			//	logger.AsyncInfo(dataPackage)
-			//}
+		sendChunkEnd = true
+		break
 
-			_, err = context.writePackage(dataPackage)
-			checkErr(err)
+	case ACTION_FENCE:
+		request := new(FenceRequest)
+		checkErr(json.Unmarshal(dataPacakge.Data, request))
 
-			totalBytes += int64(n)
+		response, err := fenceMaster(request.Epoch)
+		checkErr(err)
 
-			//time.Sleep(1 * time.Second)
+		encodedResponse, err := json.Marshal(response)
+		checkErr(err)
 
-			if n < 1024 {
-				break
-			}
-		}
-		logger.AsyncInfo(fmt.Sprintf("end备份数据\t%#v, total size: %#v", time.Now().Format(TIME_FORMAT), totalBytes))
+		dataPackage := NewBackupPackage(ACTION_FENCE)
+		dataPackage.encodeData(encodedResponse)
+		_, err = context.writePackage(dataPackage)
+		checkErr(err)
 		break
 
 	default:
@@ -344,7 +346,14 @@ func (masterServer *MasterServer) handleAction(context *Context, dataPacakge *Ba
 	if sendChunkEnd {
 		//同步完成的 tag 包
 		chunkEndPackage := NewBackupPackage(ACTION_CHUNK_END)
-		chunkEndPackage.encodeData([]byte{0x1})
+		if checksum != nil {
+			//全量同步时带上校验值, slave 校验通过后才替换数据文件
+			encodedChecksum, err := json.Marshal(checksum)
+			checkErr(err)
+			chunkEndPackage.encodeData(encodedChecksum)
+		} else {
+			chunkEndPackage.encodeData([]byte{0x1})
+		}
 		_, err := context.writePackage(chunkEndPackage)
 		checkErr(err)
 	}
@@ -354,6 +363,101 @@ func (masterServer *MasterServer) handleAction(context *Context, dataPacakge *Ba
 	return
 }
 
+//已被新的master 取代时不再向slave 发送数据, 避免slave 回退到旧的数据; slave 见过更高的代数时 说明已有新的master
+func (masterServer *MasterServer) isFenced(request *ReplicationSyncRequest) bool {
+	response, err := fenceMaster(request.Epoch)
+	checkErr(err)
+
+	if response.Fenced {
+		logger.AsyncInfo(fmt.Sprintf("已被第 %d 代master 取代, 不再同步数据", response.Epoch))
+	}
+
+	return response.Fenced
+}
+
+//全量发送数据文件, 第一个包为 ACTION_SYNC_DATA, 之后为 ACTION_CHUNK_DATA, 返回已发送数据的校验值 和 快照的事务id
+func (masterServer *MasterServer) sendDataFile(context *Context) *SnapshotChecksum {
+	logger.AsyncInfo("开始备份数据\t" + time.Now().Format(TIME_FORMAT) )
+
+	// start 在读事务中写快照到临时文件, 不会复制到写了一半的数据, 读事务只在本地复制期间持有
+	boltDb, errGetBolt := GetApplication().GetBoltDB()
+	CheckErr(errGetBolt)
+
+	destFilePath := path.Join(path.Dir(GetApplication().ConfigData.Bolt.FilePath), fmt.Sprintf("%d_%s_%s", os.Getpid(), MyMd5(context.Connection.RemoteAddr()), time.Now().Format("2006010215")))
+	logger.AsyncInfo("临时文件路径:" + destFilePath)
+	defer os.Remove(destFilePath) //同步完成删除临时文件
+
+	GetSlaveRegistry().fullSync(context)
+
+	var txId int
+	err := boltDb.View(func(tx *bolt.Tx) error {
+		txId = tx.ID()
+		return tx.CopyFile(destFilePath, 0644)
+	})
+	checkErr(err)
+
+	//end 复制临时文件
+
+	destFile, err := os.Open(destFilePath)
+	defer destFile.Close()
+	checkErr(err)
+
+	buffer := make([]byte, 1024)
+	var isChunk bool = false
+	var totalBytes int64 = 0;
+	hash := md5.New()
+
+	//for i:=1;i < 3;i++ {
+	//	dataPackage := NewBackupPackage(ACTION_SYNC_DATA)
+	//	dataPackage.encodeData([]byte(strconv.Itoa(i)))
+	//	_, err = context.writePackage(dataPackage)
+	//	checkErr(err)
+	//}
+
+	for {
+		n, err := destFile.Read(buffer)
+		if n <= 0 || (err != nil  && err != io.EOF) {
+			if err != io.EOF {
+				logger.AsyncInfo(fmt.Sprintf("读文件内容异常, %d,  %#v", n, err))
+			}
+
+			break
+		}
+
+		var dataPackage *BackupPackage
+
+		if isChunk {
+			dataPackage = NewBackupPackage(ACTION_CHUNK_DATA)
+			//dataPackage = NewBackupPackage(ACTION_SYNC_DATA)
+		} else {
+			dataPackage = NewBackupPackage(ACTION_SYNC_DATA)
+			isChunk = true
+		}
+
+		dataPackage.encodeData(buffer[0:n])
+		logger.AsyncInfo(fmt.Sprintf("同步包, action:%#v, length:%d", dataPackage.ActionType, dataPackage.DataLength))
+		//logger.AsyncInfo(fmt.Sprintf("同步包, %#v", dataPackage))
+		//if dataPackage.ActionType == ACTION_SYNC_DATA {
+		//	logger.AsyncInfo(dataPackage)
+		//}
+
+		_, err = context.writePackage(dataPackage)
+		checkErr(err)
+
+		totalBytes += int64(n)
+		hash.Write(buffer[0:n])
+
+		//time.Sleep(1 * time.Second)
+
+		if n < 1024 {
+			break
+		}
+	}
+	logger.AsyncInfo(fmt.Sprintf("end备份数据\t%#v, total size: %#v, txId: %d", time.Now().Format(TIME_FORMAT), totalBytes, txId))
+
+	return &SnapshotChecksum{Size: totalBytes, Md5: fmt.Sprintf("%x", hash.Sum(nil)), TxId: txId}
+}
+
 func (masterServer *MasterServer) isDead() bool {
 	if masterServer.ServerStatus == SERVER_STATUS_DEAD {
 		return true
@@ -376,7 +480,7 @@ func getDataLength(socketio *bufio.ReadWriter) (int, error) {
 
 //是否是可识别的action
 func isNewAction(action byte) bool {
-	if action == ACTION_PING || action == ACTION_SYNC_DATA {
+	if action == ACTION_PING || action == ACTION_SYNC_DATA || action == ACTION_SYNC_LOG || action == ACTION_FENCE {
 		return true
 	}
 
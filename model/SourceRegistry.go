@@ -0,0 +1,213 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"idGenerator/model/cmap"
+	"idGenerator/model/logger"
+)
+
+const (
+	SOURCE_BUCKET_NAME = "IdGeneratorSource" //boltdb 中保存source 配置的bucket
+	SOURCE_TABLE_NAME  = "idGeneratorSource" //mysql 中保存source 配置的表
+
+	SOURCE_CONFIG_CACHE_TS = 10 //source 配置在内存中的缓存时间 单位秒
+
+	//source 允许使用的生成方式, 为空时不限制
+	GENERATOR_TYPE_AUTOINCREMENT = "autoincrement"
+	GENERATOR_TYPE_SNOWFLAKE     = "snowflake"
+)
+
+var ErrSourceRegistryUnsupported = errors.New("当前持久化方式不支持source 配置")
+
+//单个source 的配置
+type SourceConfig struct {
+	Source        string `json:"source"`
+	StartId       int    `json:"startId"`       //起始id, 只在source 第一次加载时生效
+	BucketStep    int    `json:"bucketStep"`    //步长, 0 表示使用全局配置
+	MaxId         int    `json:"maxId"`         //最大id, 0 表示不限制
+	GeneratorType string `json:"generatorType"` //允许的生成方式
+	Description   string `json:"description"`
+	Owner         string `json:"owner"`
+	CreatedAt     int64  `json:"createdAt"`
+	UpdatedAt     int64  `json:"updatedAt"`
+}
+
+//source 配置的持久化, boltdb, mysql, rpc 都实现了
+type SourceRegistryStore interface {
+	GetSourceConfig(source string) (*SourceConfig, error) //不存在时返回 nil, nil
+	SaveSourceConfig(sourceConfig *SourceConfig) error
+	DeleteSourceConfig(source string) error
+	ListSourceConfigs() ([]*SourceConfig, error)
+}
+
+//带缓存的source 配置
+type SourceRegistry struct {
+	cache cmap.ConcurrentMap
+}
+
+type sourceConfigCacheItem struct {
+	sourceConfig *SourceConfig
+	loadedAt     int64
+}
+
+var sourceRegistryInstance *SourceRegistry
+var sourceRegistryOnce sync.Once
+
+//单例获取 source 配置
+func GetSourceRegistry() *SourceRegistry {
+	sourceRegistryOnce.Do(func() {
+		sourceRegistryInstance = &SourceRegistry{cmap.New()}
+	})
+
+	return sourceRegistryInstance
+}
+
+//获取当前持久化方式对应的store, 持久化没有实现 SourceRegistryStore 时返回 ErrSourceRegistryUnsupported
+func (registry *SourceRegistry) getStore() (SourceRegistryStore, error) {
+	segmentStore, err := getCurrentSegmentStore()
+	if err != nil {
+		return nil, err
+	}
+
+	store, ok := segmentStore.(SourceRegistryStore)
+	if !ok {
+		return nil, ErrSourceRegistryUnsupported
+	}
+
+	return store, nil
+}
+
+//校验source 是否允许使用 generatorType 生成id, 未注册的source 根据配置拒绝或自动创建
+func (registry *SourceRegistry) CheckSource(source string, generatorType string) (*SourceConfig, error) {
+	sourceConfig, err := registry.GetSourceConfig(source)
+	if err == ErrSourceRegistryUnsupported && !GetApplication().ConfigData.RejectUnknownSource {
+		return nil, nil //不支持source 配置时 不做限制
+	} else if err != nil {
+		return nil, err
+	}
+
+	if sourceConfig == nil {
+		if GetApplication().ConfigData.RejectUnknownSource {
+			return nil, errors.New("未注册的source: " + source)
+		}
+
+		sourceConfig = &SourceConfig{Source: source, Description: "auto created"}
+		if err := registry.SaveSourceConfig(sourceConfig); err != nil {
+			return nil, err
+		}
+
+		logger.AsyncInfo("自动创建source: " + source)
+	}
+
+	if sourceConfig.GeneratorType != "" && sourceConfig.GeneratorType != generatorType {
+		return nil, errors.New(fmt.Sprintf("source %s 只允许使用 %s 方式", source, sourceConfig.GeneratorType))
+	}
+
+	return sourceConfig, nil
+}
+
+//获取source 配置, 优先使用缓存
+func (registry *SourceRegistry) GetSourceConfig(source string) (*SourceConfig, error) {
+	now := time.Now().Unix()
+
+	if cached, ok := registry.cache.Get(source); ok {
+		item := cached.(*sourceConfigCacheItem)
+		if now-item.loadedAt < SOURCE_CONFIG_CACHE_TS {
+			return item.sourceConfig, nil
+		}
+	}
+
+	store, err := registry.getStore()
+	if err != nil {
+		return nil, err
+	}
+
+	sourceConfig, err := store.GetSourceConfig(source)
+	if err != nil {
+		return nil, err
+	}
+
+	registry.cache.Set(source, &sourceConfigCacheItem{sourceConfig, now})
+
+	return sourceConfig, nil
+}
+
+//新增或更新source 配置
+func (registry *SourceRegistry) SaveSourceConfig(sourceConfig *SourceConfig) error {
+	if err := ValidateSourceConfig(sourceConfig); err != nil {
+		return err
+	}
+
+	store, err := registry.getStore()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+
+	oldConfig, err := store.GetSourceConfig(sourceConfig.Source)
+	if err != nil {
+		return err
+	}
+
+	sourceConfig.CreatedAt = now
+	if oldConfig != nil {
+		sourceConfig.CreatedAt = oldConfig.CreatedAt
+	}
+	sourceConfig.UpdatedAt = now
+
+	if err := store.SaveSourceConfig(sourceConfig); err != nil {
+		return err
+	}
+
+	registry.cache.Set(sourceConfig.Source, &sourceConfigCacheItem{sourceConfig, now})
+
+	return nil
+}
+
+func (registry *SourceRegistry) DeleteSourceConfig(source string) error {
+	store, err := registry.getStore()
+	if err != nil {
+		return err
+	}
+
+	if err := store.DeleteSourceConfig(source); err != nil {
+		return err
+	}
+
+	registry.cache.Remove(source)
+
+	return nil
+}
+
+func (registry *SourceRegistry) ListSourceConfigs() ([]*SourceConfig, error) {
+	store, err := registry.getStore()
+	if err != nil {
+		return nil, err
+	}
+
+	return store.ListSourceConfigs()
+}
+
+//校验source 配置
+func ValidateSourceConfig(sourceConfig *SourceConfig) error {
+	switch {
+	case sourceConfig == nil || sourceConfig.Source == "":
+		return errors.New("source 不能为空")
+	case sourceConfig.StartId < 0 || sourceConfig.BucketStep < 0 || sourceConfig.MaxId < 0:
+		return errors.New("startId, bucketStep, maxId 不能小于0")
+	case sourceConfig.MaxId > 0 && sourceConfig.MaxId < sourceConfig.StartId:
+		return errors.New("maxId 不能小于 startId")
+	}
+
+	switch sourceConfig.GeneratorType {
+	case "", GENERATOR_TYPE_AUTOINCREMENT, GENERATOR_TYPE_SNOWFLAKE:
+	default:
+		return errors.New("不识别的 generatorType: " + sourceConfig.GeneratorType)
+	}
+
+	return nil
+}
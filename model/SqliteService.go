@@ -0,0 +1,219 @@
+//go:build sqlite
+// +build sqlite
+
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"idGenerator/model/logger"
+	"idGenerator/model/persistent"
+	"strconv"
+	"sync"
+)
+
+const (
+	PERSIST_TYPE_SQLITE = "sqlite" //sqlite 单文件持久化, 依赖 cgo, 使用 -tags sqlite 编译时才注册
+)
+
+//sqlite 的表结构, 下标+1 为对应的版本号, 记录在 PRAGMA user_version 中, 只能追加
+var sqliteMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS idGenerator (
+		worker_source TEXT    NOT NULL PRIMARY KEY,
+		current_id    INTEGER NOT NULL DEFAULT 0,
+		bucket_step   INTEGER NOT NULL DEFAULT 0
+	)`,
+}
+
+var sqliteMigrateOnce sync.Once
+var sqliteMigrateErr error
+
+//使用 sqlite 单文件保存每个source 已分配的最大值, 事务语义和 BoltDbService 一致
+type SqliteService struct {
+	DB        *sql.DB
+	TableName string
+}
+
+func init() {
+	RegisterSegmentStore(PERSIST_TYPE_SQLITE, func(namespace string) SegmentStore {
+		return withSourceNamespace(NewSqliteService(), namespace)
+	})
+
+	//第一次打开时升级表结构
+	registerSchemaMigrator(PERSIST_TYPE_SQLITE, func(application *Application) ([]int, error) {
+		if _, err := application.GetSqliteDB(); err != nil {
+			return nil, errors.New(fmt.Sprintf("sqlite 表结构升级失败: %v", err))
+		}
+
+		return nil, nil
+	})
+}
+
+//获取sqlite 连接, 第一次打开时升级表结构
+func (application *Application) GetSqliteDB() (db *sql.DB, err interface{}) {
+	defer func() {
+		err = recover()
+		return
+	}()
+
+	db = persistent.GetSqliteDB(application.ConfigData.Sqlite.FilePath, application.ConfigData.Sqlite.BusyTimeoutMs)
+
+	sqliteMigrateOnce.Do(func() {
+		sqliteMigrateErr = MigrateSqlite(db)
+	})
+
+	if sqliteMigrateErr != nil {
+		panic(sqliteMigrateErr)
+	}
+
+	return db, nil
+}
+
+func NewSqliteService() *SqliteService {
+	db, err := GetApplication().GetSqliteDB()
+	checkErr(err)
+
+	return &SqliteService{db, "idGenerator"}
+}
+
+//升级表结构到最新版本, 在一个事务中执行, 已是最新版本时不做修改
+func MigrateSqlite(db *sql.DB) (err error) {
+	dbTx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			dbTx.Rollback()
+		} else {
+			err = dbTx.Commit()
+		}
+	}()
+
+	var version int
+	if err = dbTx.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+
+	for ; version < len(sqliteMigrations); version++ {
+		if _, err = dbTx.Exec(sqliteMigrations[version]); err != nil {
+			return err
+		}
+
+		logger.AsyncInfo("sqlite schema migrated to version " + strconv.Itoa(version+1))
+	}
+
+	//PRAGMA 不支持参数绑定
+	_, err = dbTx.Exec("PRAGMA user_version = " + strconv.Itoa(version))
+
+	return err
+}
+
+//在 IMMEDIATE 事务中执行, panic 时回滚
+func (serviceInstance *SqliteService) withTx(handler func(dbTx *sql.Tx)) {
+	dbTx, err := serviceInstance.DB.Begin()
+	checkErr(err)
+
+	defer func() {
+		err := recover()
+
+		if err != nil {
+			dbTx.Rollback() //回滚事务
+		} else {
+			err = dbTx.Commit() //提交事务
+		}
+
+		checkErr(err)
+	}()
+
+	handler(dbTx)
+}
+
+//查询source 当前的最大值, 没有记录时 exist 为 false
+func (serviceInstance *SqliteService) getCurrentIdTx(dbTx *sql.Tx, source string) (currentId int, exist bool) {
+	err := dbTx.QueryRow(
+		"SELECT current_id FROM "+serviceInstance.TableName+" WHERE worker_source = ?",
+		source).Scan(&currentId)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, false
+	case err != nil:
+		panic(err)
+	default:
+		return currentId, true
+	}
+}
+
+func (serviceInstance *SqliteService) saveCurrentIdTx(dbTx *sql.Tx, source string, currentId int, bucketStep int) {
+	_, err := dbTx.Exec(
+		"INSERT OR REPLACE INTO "+serviceInstance.TableName+" (worker_source, current_id, bucket_step) VALUES (?, ?, ?)",
+		source, currentId, bucketStep)
+	checkErr(err)
+}
+
+//使用事务 从db中load当前的current_id ，并增大库中的id
+func (serviceInstance *SqliteService) LoadCurrentIdFromDb(source string, bucketStep int) int {
+	if source == "" || bucketStep < 1 {
+		panic("业务参数错误，或者id递增步长错误")
+	}
+
+	var currentId int
+
+	serviceInstance.withTx(func(dbTx *sql.Tx) {
+		currentId, _ = serviceInstance.getCurrentIdTx(dbTx, source)
+		serviceInstance.saveCurrentIdTx(dbTx, source, currentId+bucketStep, bucketStep)
+	})
+
+	logger.AsyncInfo("load current id from sqlite, source: " + source + " , currentId: " + strconv.Itoa(currentId))
+
+	return currentId
+}
+
+//使用事务更新数据
+func (serviceInstance *SqliteService) IncrSourceCurrentId(source string, currentId int, bucketStep int) (resultCurrentId int, newDbCurrentId int) {
+	if currentId < 1 || bucketStep < 1 {
+		panic("parameter error")
+	}
+
+	serviceInstance.withTx(func(dbTx *sql.Tx) {
+		oldCurrentId, exist := serviceInstance.getCurrentIdTx(dbTx, source)
+		if !exist {
+			panic("sqlite中数据不存在, 不可更新")
+		}
+
+		resultCurrentId = currentId
+		newDbCurrentId = currentId + bucketStep
+
+		if oldCurrentId > currentId {
+			resultCurrentId = oldCurrentId + 1
+			newDbCurrentId = oldCurrentId + bucketStep
+		}
+
+		serviceInstance.saveCurrentIdTx(dbTx, source, newDbCurrentId, bucketStep)
+	})
+
+	logger.AsyncInfo("source: " + source + " update sqlite current_id to " + strconv.Itoa(newDbCurrentId))
+
+	return resultCurrentId, newDbCurrentId
+}
+
+//获取source 最近一次使用的步长, 没有记录时返回0
+func (serviceInstance *SqliteService) LoadSourceStep(source string) int {
+	var bucketStep int
+
+	err := serviceInstance.DB.QueryRow(
+		"SELECT bucket_step FROM "+serviceInstance.TableName+" WHERE worker_source = ?",
+		source).Scan(&bucketStep)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return 0
+	case err != nil:
+		panic(err)
+	default:
+		return bucketStep
+	}
+}
@@ -0,0 +1,136 @@
+//go:build sqlite
+// +build sqlite
+
+package model
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"idGenerator/model/cmap"
+	"idGenerator/model/persistent"
+)
+
+func openTestSqlite(t *testing.T, filePath string) *SqliteService {
+	db, err := persistent.OpenSqliteDB(filePath, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := MigrateSqlite(db); err != nil {
+		t.Fatal(err)
+	}
+
+	return &SqliteService{db, "idGenerator"}
+}
+
+func TestSqliteServiceMigrateAndIncr(t *testing.T) {
+	dir, err := ioutil.TempDir("", "idGenerator_sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "id.sqlite")
+	service := openTestSqlite(t, filePath)
+
+	var version int
+	if err := service.DB.QueryRow("PRAGMA user_version").Scan(&version); err != nil || version != len(sqliteMigrations) {
+		t.Fatalf("schema version: %d, err: %v", version, err)
+	}
+
+	if currentId := service.LoadCurrentIdFromDb("order", 10); currentId != 0 {
+		t.Errorf("first load: %d", currentId)
+	}
+
+	if currentId, maxId := service.IncrSourceCurrentId("order", 10, 10); currentId != 10 || maxId != 20 {
+		t.Errorf("incr: %d, %d", currentId, maxId)
+	}
+
+	//其他实例已经分配过了, 和 BoltDbService 一样从库中的值开始
+	if currentId, maxId := service.IncrSourceCurrentId("order", 5, 10); currentId != 21 || maxId != 30 {
+		t.Errorf("incr after other instance: %d, %d", currentId, maxId)
+	}
+
+	if step := service.LoadSourceStep("order"); step != 10 {
+		t.Errorf("stored step: %d", step)
+	}
+
+	service.DB.Close()
+
+	//重新打开时 不重复升级, 数据保留
+	service = openTestSqlite(t, filePath)
+	defer service.DB.Close()
+
+	if currentId := service.LoadCurrentIdFromDb("order", 10); currentId != 30 {
+		t.Errorf("load after reopen: %d", currentId)
+	}
+}
+
+//两个连接模拟两个实例 共用一个sqlite 文件并发获取id, 不能有重复
+func TestSqliteServiceConcurrentUnique(t *testing.T) {
+	dir, err := ioutil.TempDir("", "idGenerator_sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "id.sqlite")
+	services := []*SqliteService{openTestSqlite(t, filePath), openTestSqlite(t, filePath)}
+	defer services[0].DB.Close()
+	defer services[1].DB.Close()
+
+	setTestSegmentStore("sqlite_concurrent_0", services[0])
+	setTestSegmentStore("sqlite_concurrent_1", services[1])
+
+	GetApplication().ConfigData.BucketStep = 5
+	GetApplication().ConfigData.PersistType = "sqlite_concurrent_0"
+
+	workers := []*AutoIncrIdWorker{
+		{WorkerMap: cmap.New(), PersistType: "sqlite_concurrent_0"},
+		{WorkerMap: cmap.New(), PersistType: "sqlite_concurrent_1"},
+	}
+
+	var lock sync.Mutex
+	seen := make(map[int]bool)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+
+		go func(index int) {
+			defer wg.Done()
+
+			worker := workers[index%len(workers)]
+			var ids []int
+
+			for j := 0; j < 20; j++ {
+				id, err := worker.NextId("", "sqlite_source")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				ids = append(ids, id)
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			for _, id := range ids {
+				if seen[id] {
+					t.Errorf("duplicate id: %d", id)
+				}
+				seen[id] = true
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if len(seen) != 50*20 {
+		t.Errorf("got %d ids", len(seen))
+	}
+}
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"github.com/BurntSushi/toml"
 	"io/ioutil"
 )
@@ -9,21 +11,99 @@ type Config struct {
 	Addr           string `toml: "addr"`
 	LogPath        string `toml: "log_path"`
 	LogLevel       string `toml: "logLevel"`
-	PersistType    int    `toml: "persistType"`
+	PersistType    PersistType `toml:"persistType"` //持久化方式的名称, 兼容旧的数字配置
 	DataDir        string    `toml: "dataDir"`
 	BucketStep     int    `toml: "bucketStep"`
+	MinBucketStep  int    `toml:"minBucketStep"` //自适应步长的下限, 和上限都配置时开启自适应
+	MaxBucketStep  int    `toml:"maxBucketStep"` //自适应步长的上限
+	BucketStepTargetTs int `toml:"bucketStepTargetTs"` //一个号段期望的使用时长 单位秒
 	ServerType     string    `toml: "serverType"`
 	MasterAddress  string      `toml: "masterAddress"`
 	RpcSeverAddress  string      `toml: "rpcSeverAddress"`
 	MaxUnActiveTs int `toml:"maxUnactiveTs"`
 	UseTransAction bool   `toml: "useTransAction"`
+	AutoMigrate    bool   `toml:"autoMigrate"` //启动 master, slave, cluster 时自动升级表结构, 也可以通过 server.go migrate 手动执行
+	RejectUnknownSource bool `toml:"rejectUnknownSource"` //未注册的source 是否拒绝, false 时自动创建
+	AdminToken     string `toml:"adminToken"` //管理接口的token, 请求头 X-Admin-Token, 为空时拒绝所有管理请求
 	Bolt           Bolt  `toml: "bolt"`
 	Mysql          Mysql  `toml: "mysql"`
+	Redis          Redis  `toml:"redis"`
+	Postgres       Postgres `toml:"postgres"`
+	Sqlite         Sqlite `toml:"sqlite"`
+	SnowFlake      SnowFlake `toml:"snowFlake"`
+	Failover       Failover `toml:"failover"`
+	Raft           Raft `toml:"raft"`
+}
+
+//集群模式(server.go cluster), 多个节点通过 raft 复制每个source 已分配的最大值
+type Raft struct {
+	NodeId            int      `toml:"nodeId"`            //当前节点在 peers 中的序号, 从1开始
+	Peers             []string `toml:"peers"`             //所有节点的 raft 地址 host:port, 3 或 5 个
+	FilePath          string   `toml:"filePath"`          //raft 日志文件
+	HttpPort          int      `toml:"httpPort"`          //http 服务端口, 默认 8182
+	ElectionTimeoutMs int      `toml:"electionTimeoutMs"` //选举超时 单位毫秒, 默认 1000
+	HeartbeatMs       int      `toml:"heartbeatMs"`       //leader 心跳间隔 单位毫秒, 默认 100
+	ProposeTimeoutMs  int      `toml:"proposeTimeoutMs"`  //等待多数节点确认的超时 单位毫秒, 默认 3000
+	SnapshotLogs      int      `toml:"snapshotLogs"`      //已执行的日志超过这个条数时 生成快照并删除之前的日志, 默认 10000
+}
+
+//slave 提升为master
+type Failover struct {
+	Timeout           int    `toml:"timeout"`           //和master 断开超过这个时长(秒) 自动提升为master, 0 时只能通过管理接口手动提升, 需要同时配置 masterLease
+	MasterLease       int    `toml:"masterLease"`       //master 超过这个时长(秒) 没有收到slave 的同步请求时 停止发出id, 0 时不限制, 需要小于 timeout
+	SafetyMargin      int    `toml:"safetyMargin"`      //提升时每个source 在 步长 之外额外跳过的id 数, 默认 10000
+	DataBackUpAddress string `toml:"dataBackUpAddress"` //提升后数据同步服务监听的地址, 默认 masterAddress 的端口
+	RpcAddress        string `toml:"rpcAddress"`        //提升后rpc 服务监听的地址, 默认 rpcSeverAddress 的端口
+}
+
+//snowflake id 的位分布, 不配置时使用默认的 41位时间戳 + 10位worker id + 12位序列号
+type SnowFlake struct {
+	Epoch          int64 `toml:"epoch"` //起始时间戳 单位毫秒
+	TimeStampBits  uint  `toml:"timeStampBits"`
+	DataCenterBits uint  `toml:"dataCenterBits"`
+	WorkerIdBits   uint  `toml:"workerIdBits"`
+	SequenceBits   uint  `toml:"sequenceBits"`
+	DataCenterId   int64 `toml:"dataCenterId"` //当前实例的数据中心id
+
+	MaxWaitBackwardMs   int64 `toml:"maxWaitBackwardMs"`   //时钟回拨不超过这个值(毫秒)时 等待时钟追上
+	MaxBorrowBackwardMs int64 `toml:"maxBorrowBackwardMs"` //时钟回拨不超过这个值(毫秒)时 借用逻辑时钟, 超过则拒绝生成
+
+	LeaseWorkerId bool `toml:"leaseWorkerId"` //是否由server 从持久化层租用唯一的 worker id
+	LeaseTtl      int  `toml:"leaseTtl"`      //租约时长 单位秒
+}
+
+//持久化方式, 配置为注册的名称, 如 "mysql", "boltdb"
+type PersistType string
+
+//兼容旧配置 1:mysql, 2:boltdb
+func (persistType *PersistType) UnmarshalTOML(data interface{}) error {
+	switch value := data.(type) {
+	case string:
+		*persistType = PersistType(value)
+	case int64:
+		switch value {
+		case 1:
+			*persistType = "mysql"
+		case 2:
+			*persistType = "boltdb"
+		default:
+			return errors.New(fmt.Sprintf("persistType 错误: %d", value))
+		}
+	default:
+		return errors.New(fmt.Sprintf("persistType 格式错误: %#v", data))
+	}
+
+	return nil
 }
 
 type Bolt struct {
-	FilePath         string `toml: "filePath"`
-	BucketName       string `toml: "bucketName"`
+	FilePath           string `toml: "filePath"`
+	BucketName         string `toml: "bucketName"`
+	ReplicationLogSize int    `toml:"replicationLogSize"` //主从同步日志保留的条数, 默认 100000
+	SlaveId            string `toml:"slaveId"`            //slave 在master 上登记的标识, 默认 主机名:应用根目录
+	SyncIntervalMs     int    `toml:"syncIntervalMs"`     //slave 请求同步日志的间隔 单位毫秒, 默认 2000, master 在请求上最多等待这么久
+	SemiSyncSlaves     int    `toml:"semiSyncSlaves"`     //半同步: master 自己和rpc 发出新号段的id 前等待多少个slave 确认, 0 时不等待
+	SemiSyncTimeoutMs  int    `toml:"semiSyncTimeoutMs"`  //等待slave 确认的超时 单位毫秒, 默认 5000, 超时后退化为异步复制
 }
 
 type Mysql struct {
@@ -36,6 +116,31 @@ type Mysql struct {
 	MaxOpenConns int    `toml: "maxOpenConns"`
 }
 
+type Postgres struct {
+	Host         string `toml:"host"`
+	Port         int    `toml:"port"`
+	Name         string `toml:"name"`
+	User         string `toml:"user"`
+	Password     string `toml:"password"`
+	SslMode      string `toml:"sslMode"` //默认 disable
+	MaxIdleConns int    `toml:"maxIdleConns"`
+	MaxOpenConns int    `toml:"maxOpenConns"`
+}
+
+type Sqlite struct {
+	FilePath      string `toml:"filePath"`
+	BusyTimeoutMs int    `toml:"busyTimeoutMs"` //等待其他进程释放写锁的时间 单位毫秒
+}
+
+type Redis struct {
+	Address      string `toml:"address"` //host:port
+	Password     string `toml:"password"`
+	Db           int    `toml:"db"`
+	KeyPrefix    string `toml:"keyPrefix"` //key 前缀, 默认 idGenerator:
+	MaxIdleConns int    `toml:"maxIdleConns"`
+	TimeoutMs    int    `toml:"timeoutMs"` //连接和读写超时 单位毫秒
+}
+
 func GetConfigFromFile(configFile string) Config {
 	if configFile == "" {
 		panic("配置文件不存在")
@@ -5,6 +5,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"log"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -14,11 +15,12 @@ type MyLogger struct {
 }
 
 var loggerInstance *MyLogger = nil
+var loggerOnce sync.Once
 
-//获取logger实例 单例模式
+//获取logger实例 单例模式, 并发调用时只初始化一次
 func GetLogger() *MyLogger {
 
-	if loggerInstance == nil {
+	loggerOnce.Do(func() {
 		loggerInstance = new(MyLogger)
 		loggerInstance.Logger = log.New(os.Stdout, "[cclehui]\t", log.Ldate|log.Ltime)
 		loggerInstance.ChannelInfo = make(chan string, 1024)
@@ -31,7 +33,7 @@ func GetLogger() *MyLogger {
 				}
 			}
 		}()
-	}
+	})
 
 	return loggerInstance
 }
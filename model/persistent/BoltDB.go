@@ -3,25 +3,44 @@ package persistent
 import (
 	//"strconv"
 	"os"
+	"sync"
 	"github.com/boltdb/bolt"
 )
 
 var boltDb *bolt.DB
+var boltDbLock sync.Mutex
 
 func GetBoltDB(dbFile string, mode os.FileMode, options *bolt.Options) *bolt.DB {
+	boltDbLock.Lock()
+	defer boltDbLock.Unlock()
 
 	//单例
 	if boltDb != nil {
 		return boltDb
 	}
 
-	var err error
-
-	boltDb, err = bolt.Open(dbFile, mode, options)
+	db, err := bolt.Open(dbFile, mode, options)
 
 	if err != nil {
 		panic(err.Error())
 	}
 
+	boltDb = db
+
 	return boltDb
 }
+
+//关闭单例, 替换数据文件之前调用, 下次 GetBoltDB 时重新打开
+func CloseBoltDB() error {
+	boltDbLock.Lock()
+	defer boltDbLock.Unlock()
+
+	if boltDb == nil {
+		return nil
+	}
+
+	err := boltDb.Close()
+	boltDb = nil
+
+	return err
+}
@@ -0,0 +1,45 @@
+package persistent
+
+import (
+	"database/sql"
+	_ "github.com/lib/pq"
+	"fmt"
+)
+
+var postgresDb *sql.DB
+
+func GetPostgresDB(userName string, password string,
+	host string, port int, dbName string, sslMode string, maxIdleCon int, maxOpenCon int) *sql.DB {
+
+	//单例
+	if postgresDb != nil {
+		return postgresDb
+	}
+
+	if sslMode == "" {
+		sslMode = "disable"
+	}
+
+	connectStr := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		host, port, userName, password, dbName, sslMode)
+
+	var err error
+
+	postgresDb, err = sql.Open("postgres", connectStr)
+
+	if err != nil {
+		panic(err.Error())
+	}
+
+	//sql 连接池功能
+	postgresDb.SetMaxIdleConns(maxIdleCon) //最大空闲连接数
+	postgresDb.SetMaxOpenConns(maxOpenCon) //最大能打开的连接数
+
+	err = postgresDb.Ping()
+	if err != nil {
+		postgresDb = nil
+		panic(err.Error())
+	}
+
+	return postgresDb
+}
@@ -0,0 +1,272 @@
+package persistent
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//redis 返回的错误, 如 "ERR value is not an integer"
+type RedisError string
+
+func (err RedisError) Error() string {
+	return string(err)
+}
+
+//使用 RESP 协议的 redis 连接池, 只实现了 id 生成需要的命令
+type RedisPool struct {
+	Address  string
+	Password string
+	Db       int
+	Timeout  time.Duration
+
+	idleConns chan *RedisConn
+}
+
+//单个 redis 连接
+type RedisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+var redisPool *RedisPool
+var redisPoolLock sync.Mutex
+
+//单例获取 redis 连接池
+func GetRedisPool(address string, password string, db int, maxIdleConns int, timeout time.Duration) *RedisPool {
+	redisPoolLock.Lock()
+	defer redisPoolLock.Unlock()
+
+	if redisPool != nil {
+		return redisPool
+	}
+
+	pool := NewRedisPool(address, password, db, maxIdleConns, timeout)
+
+	//检查连接
+	if _, err := pool.Do("PING"); err != nil {
+		panic(err.Error())
+	}
+
+	redisPool = pool
+
+	return redisPool
+}
+
+func NewRedisPool(address string, password string, db int, maxIdleConns int, timeout time.Duration) *RedisPool {
+	if maxIdleConns < 1 {
+		maxIdleConns = 1
+	}
+
+	if timeout <= 0 {
+		timeout = 3 * time.Second
+	}
+
+	return &RedisPool{
+		Address:   address,
+		Password:  password,
+		Db:        db,
+		Timeout:   timeout,
+		idleConns: make(chan *RedisConn, maxIdleConns),
+	}
+}
+
+//执行一个命令, 返回 int64, string, nil, []interface{} 或 RedisError
+func (pool *RedisPool) Do(args ...string) (interface{}, error) {
+	redisConn, err := pool.get()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := redisConn.do(pool.Timeout, args...)
+	if _, isRedisError := err.(RedisError); err != nil && !isRedisError {
+		//网络错误时 连接不再复用
+		redisConn.conn.Close()
+		return nil, err
+	}
+
+	pool.put(redisConn)
+
+	return reply, err
+}
+
+//执行返回整数的命令, 如 INCRBY
+func (pool *RedisPool) DoInt(args ...string) (int64, error) {
+	reply, err := pool.Do(args...)
+	if err != nil {
+		return 0, err
+	}
+
+	value, ok := reply.(int64)
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("redis 返回类型错误: %#v", reply))
+	}
+
+	return value, nil
+}
+
+//执行返回字符串的命令, 如 GET, 不存在时 exist 为 false
+func (pool *RedisPool) DoString(args ...string) (value string, exist bool, err error) {
+	reply, err := pool.Do(args...)
+	if err != nil || reply == nil {
+		return "", false, err
+	}
+
+	value, ok := reply.(string)
+	if !ok {
+		return "", false, errors.New(fmt.Sprintf("redis 返回类型错误: %#v", reply))
+	}
+
+	return value, true, nil
+}
+
+//关闭空闲的连接
+func (pool *RedisPool) Close() {
+	for {
+		select {
+		case redisConn := <-pool.idleConns:
+			redisConn.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+//优先使用空闲连接, 没有时新建
+func (pool *RedisPool) get() (*RedisConn, error) {
+	select {
+	case redisConn := <-pool.idleConns:
+		return redisConn, nil
+	default:
+	}
+
+	conn, err := net.DialTimeout("tcp", pool.Address, pool.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	redisConn := &RedisConn{conn, bufio.NewReader(conn), bufio.NewWriter(conn)}
+
+	if pool.Password != "" {
+		if _, err := redisConn.do(pool.Timeout, "AUTH", pool.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if pool.Db > 0 {
+		if _, err := redisConn.do(pool.Timeout, "SELECT", strconv.Itoa(pool.Db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return redisConn, nil
+}
+
+//放回连接池, 空闲连接过多时直接关闭
+func (pool *RedisPool) put(redisConn *RedisConn) {
+	select {
+	case pool.idleConns <- redisConn:
+	default:
+		redisConn.conn.Close()
+	}
+}
+
+func (redisConn *RedisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	redisConn.conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := WriteRedisCommand(redisConn.writer, args...); err != nil {
+		return nil, err
+	}
+
+	if err := redisConn.writer.Flush(); err != nil {
+		return nil, err
+	}
+
+	return ReadRedisReply(redisConn.reader)
+}
+
+//按 RESP 协议写一个命令, 命令和参数都作为 bulk string
+func WriteRedisCommand(writer *bufio.Writer, args ...string) error {
+	if _, err := writer.WriteString("*" + strconv.Itoa(len(args)) + "\r\n"); err != nil {
+		return err
+	}
+
+	for _, arg := range args {
+		if _, err := writer.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//按 RESP 协议读取一个回复
+func ReadRedisReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := readRedisLine(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 {
+		return nil, errors.New("redis 协议错误: 空行")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, RedisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 {
+			return nil, err
+		}
+
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+
+		return string(data[:length]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count < 0 {
+			return nil, err
+		}
+
+		items := make([]interface{}, count)
+		for i := range items {
+			items[i], err = ReadRedisReply(reader)
+			if _, isRedisError := err.(RedisError); err != nil && !isRedisError {
+				return nil, err
+			}
+		}
+
+		return items, nil
+	}
+
+	return nil, errors.New("redis 协议错误: " + line)
+}
+
+func readRedisLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errors.New("redis 协议错误: " + line)
+	}
+
+	return line[:len(line)-2], nil
+}
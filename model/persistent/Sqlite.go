@@ -0,0 +1,56 @@
+//go:build sqlite
+// +build sqlite
+
+package persistent
+
+import (
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	"strconv"
+	"sync"
+)
+
+var sqliteDb *sql.DB
+var sqliteDbLock sync.Mutex
+
+//单例获取 sqlite 连接, 写事务使用 BEGIN IMMEDIATE, 避免多个事务同时升级写锁时死锁
+func GetSqliteDB(filePath string, busyTimeoutMs int) *sql.DB {
+	sqliteDbLock.Lock()
+	defer sqliteDbLock.Unlock()
+
+	//单例
+	if sqliteDb != nil {
+		return sqliteDb
+	}
+
+	db, err := OpenSqliteDB(filePath, busyTimeoutMs)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	sqliteDb = db
+
+	return sqliteDb
+}
+
+func OpenSqliteDB(filePath string, busyTimeoutMs int) (*sql.DB, error) {
+	if filePath == "" {
+		filePath = "./data/idGenerator.sqlite"
+	}
+
+	if busyTimeoutMs < 1 {
+		busyTimeoutMs = 5000
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+filePath+"?_txlock=immediate&_busy_timeout="+strconv.Itoa(busyTimeoutMs))
+	if err != nil {
+		return nil, err
+	}
+
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
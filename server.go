@@ -5,6 +5,7 @@ package main
 import (
 	"fmt"
 	"flag"
+	"strconv"
 	//"time"
 	//"os"
 	//"idGenerator/model/config"
@@ -31,11 +32,41 @@ func main() {
 
 	port := "8182"
 
-	//启动数据备份server
 	flag.Parse()
 	serverInstancType := flag.Arg(0)
+
+	//启动server 的角色, export/import 等命令不会自动升级表结构
+	isServerRole := serverInstancType == model.SERVER_MASTER || serverInstancType == model.SERVER_SLAVE ||
+		serverInstancType == model.SERVER_CLUSTER
+
+	//升级表结构
+	if serverInstancType == "migrate" || (application.ConfigData.AutoMigrate && isServerRole) {
+		applied, err := application.MigrateSchema()
+		if err != nil {
+			panic(err)
+		}
+
+		fmt.Printf("schema migrated, applied versions: %v\n", applied)
+
+		if serverInstancType == "migrate" {
+			return
+		}
+	}
+
+	//导出/导入各个source 已分配的最大值
+	if serverInstancType == model.COMMAND_EXPORT || serverInstancType == model.COMMAND_IMPORT {
+		if err := model.RunCounterCommand(serverInstancType, flag.Args()[1:]); err != nil {
+			panic(err)
+		}
+
+		return
+	}
+
+	//启动数据备份server
 	switch serverInstancType {
 		case model.SERVER_MASTER:
+			application.Role = model.SERVER_MASTER
+
 			logger.AsyncInfo("启动备份server端程序")
 			application.StartDataBackUpServer()
 
@@ -45,7 +76,7 @@ func main() {
 		case model.SERVER_SLAVE:
 
 			port = "8183"
-			application.ConfigData.ServerType = model.SERVER_SLAVE
+			application.Role = model.SERVER_SLAVE
 
 			logger.AsyncInfo("启动slave端数据备份程序")
 			application.ConfigData.Bolt.FilePath +=  ".backup"
@@ -54,11 +85,28 @@ func main() {
 			logger.AsyncInfo("启动rpc client")
 			application.StartRpcClient()
 
+			//master 宕机时自动提升为master
+			application.StartFailoverWatcher()
+
+		case model.SERVER_CLUSTER:
+			application.Role = model.SERVER_CLUSTER
+
+			logger.AsyncInfo("启动 raft 节点")
+			application.StartRaftNode()
+
+			if httpPort := application.ConfigData.Raft.HttpPort; httpPort > 0 {
+				port = strconv.Itoa(httpPort)
+			}
+
 		default:
 			logger.AsyncInfo("输入参数:" + serverInstancType)
-			panic("服务实例类型只能是master 或 slave")
+			panic("服务实例类型只能是master, slave, cluster, migrate, export 或 import")
 	}
 
+	//租用snowflake worker id
+	application.StartSnowFlakeWorkerLease()
+	application.HandleShutdownSignal()
+
 	//异步写log
 	logger.AsyncInfo("application inited......")
 
@@ -76,9 +124,32 @@ func main() {
 	// Snow Flake算法
 	r.GET("/snowflake/:id", controller.SnowFlakeAction)
 
+	// Snow Flake算法, 使用租约的 worker id
+	r.GET("/snowflake", controller.SnowFlakeLeaseAction)
+
+	// Snow Flake id 解析, /snowflake/parse/:value, 批量解析 /snowflake/parse?ids=xxx,yyy 由 SnowFlakeAction 处理
+	r.GET("/snowflake/:id/:value", controller.SnowFlakeParseAction)
+
+	// Snow Flake 时钟回拨统计
+	r.GET("/stats/snowflake", controller.SnowFlakeStatsAction)
+
 	//自增方式
 	r.GET("/autoincrement", controller.AutoIncrementAction)
 
+	//自增方式 批量获取
+	r.POST("/autoincrement", controller.AutoIncrementBatchAction)
+
+	//管理接口
+	admin := r.Group("/admin", controller.AdminAuth())
+	{
+		admin.GET("/sources", controller.AdminSourceListAction)
+		admin.GET("/sources/:source", controller.AdminSourceGetAction)
+		admin.POST("/sources", controller.AdminSourceSaveAction)
+		admin.DELETE("/sources/:source", controller.AdminSourceDeleteAction)
+		admin.POST("/promote", controller.AdminPromoteAction)
+		admin.GET("/slaves", controller.AdminSlaveListAction)
+	}
+
 	// Listen and Server in 0.0.0.0:8182
 	r.Run(":" + port)
 
@@ -1,7 +1,48 @@
+-- 推荐使用 go run server.go migrate (或配置 autoMigrate=true) 自动建表和升级, 版本记录在 idGeneratorSchemaMigration 表
+-- 下面是最新版本的表结构, 手动建表时使用
+
 CREATE TABLE `idGenerator` (
   `id` int(10) unsigned NOT NULL AUTO_INCREMENT COMMENT '主键',/*modifiable*/
   `worker_source` varchar(255) NOT NULL DEFAULT '' COMMENT '业务类型',/*modifiable*/
   `current_id` bigint(20) unsigned NOT NULL DEFAULT 0 COMMENT '业务当前的递增id',/*modifiable*/
+  `bucket_step` int(10) unsigned NOT NULL DEFAULT 0 COMMENT '最近一次使用的步长',/*modifiable*/
+  `max_id` bigint(20) unsigned NOT NULL DEFAULT 0 COMMENT '最大id, 0 不限制, 和source 配置同步',/*modifiable*/
+  `updated_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT '更新时间',/*modifiable*/
   PRIMARY KEY (`id`),
-  KEY `idx_worker_source` (`worker_source`)
+  UNIQUE KEY `uk_worker_source` (`worker_source`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8 COMMENT='递增id保持表';
+
+CREATE TABLE `idGeneratorWorkerLease` (
+  `worker_id` int(10) unsigned NOT NULL COMMENT 'snowflake worker id',/*modifiable*/
+  `owner` varchar(255) NOT NULL DEFAULT '' COMMENT '租约持有者',/*modifiable*/
+  `expire_at` bigint(20) unsigned NOT NULL DEFAULT 0 COMMENT '租约过期时间戳 单位秒',/*modifiable*/
+  PRIMARY KEY (`worker_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COMMENT='snowflake worker id 租约表';
+
+CREATE TABLE `idGeneratorSource` (
+  `worker_source` varchar(255) NOT NULL DEFAULT '' COMMENT '业务类型',/*modifiable*/
+  `start_id` bigint(20) unsigned NOT NULL DEFAULT 0 COMMENT '起始id',/*modifiable*/
+  `bucket_step` int(10) unsigned NOT NULL DEFAULT 0 COMMENT '步长, 0 使用全局配置',/*modifiable*/
+  `max_id` bigint(20) unsigned NOT NULL DEFAULT 0 COMMENT '最大id, 0 不限制',/*modifiable*/
+  `generator_type` varchar(32) NOT NULL DEFAULT '' COMMENT '允许的生成方式, 空不限制',/*modifiable*/
+  `description` varchar(1024) NOT NULL DEFAULT '' COMMENT '描述',/*modifiable*/
+  `owner` varchar(255) NOT NULL DEFAULT '' COMMENT '负责人',/*modifiable*/
+  `created_at` bigint(20) unsigned NOT NULL DEFAULT 0 COMMENT '创建时间戳',/*modifiable*/
+  `updated_at` bigint(20) unsigned NOT NULL DEFAULT 0 COMMENT '更新时间戳',/*modifiable*/
+  PRIMARY KEY (`worker_source`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COMMENT='source 配置表';
+
+CREATE TABLE `idGeneratorSchemaMigration` (
+  `version` int(10) unsigned NOT NULL COMMENT '版本号',/*modifiable*/
+  `description` varchar(255) NOT NULL DEFAULT '' COMMENT '描述',/*modifiable*/
+  `applied_at` bigint(20) unsigned NOT NULL DEFAULT 0 COMMENT '执行时间戳',/*modifiable*/
+  PRIMARY KEY (`version`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COMMENT='表结构版本';
+
+-- 手动建表时 标记所有版本已执行
+INSERT INTO `idGeneratorSchemaMigration` (version, description, applied_at) VALUES
+  (1, 'create idGenerator table', 0),
+  (2, 'add idGenerator.bucket_step', 0),
+  (3, 'unique key on idGenerator.worker_source', 0),
+  (4, 'add idGenerator.max_id and updated_at', 0),
+  (5, 'create worker lease and source tables', 0);
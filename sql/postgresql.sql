@@ -0,0 +1,15 @@
+-- persistType="postgresql" 时使用, 表名不加引号 postgresql 会转成小写
+
+CREATE TABLE IF NOT EXISTS idGenerator (
+  id            BIGSERIAL    NOT NULL,
+  worker_source VARCHAR(255) NOT NULL DEFAULT '',
+  current_id    BIGINT       NOT NULL DEFAULT 0,
+  bucket_step   INTEGER      NOT NULL DEFAULT 0,
+  PRIMARY KEY (id),
+  CONSTRAINT uk_idgenerator_worker_source UNIQUE (worker_source)
+);
+
+COMMENT ON TABLE idGenerator IS '递增id保持表';
+COMMENT ON COLUMN idGenerator.worker_source IS '业务类型';
+COMMENT ON COLUMN idGenerator.current_id IS '业务当前的递增id';
+COMMENT ON COLUMN idGenerator.bucket_step IS '最近一次使用的步长';